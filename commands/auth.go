@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/credentials"
+)
+
+var authToFile *bool
+
+func NewAuthCommand() *cobra.Command {
+	authCommand := cobra.Command{
+		Use:   "auth",
+		Short: "manage the stored API key",
+		Long:  "store the API key in the system keyring, or in a private file if no keyring is available",
+		RunE:  showUsage,
+	}
+
+	loginCommand := cobra.Command{
+		Use:   "login",
+		Short: "store the API key",
+		Long:  "store the API key, read on the terminal or from stdin",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return AuthLogin()
+		},
+	}
+
+	authToFile = loginCommand.Flags().Bool("file", false, "Store the key in a private file instead of the keyring")
+	authCommand.AddCommand(&loginCommand)
+
+	authCommand.AddCommand(&cobra.Command{
+		Use:   "logout",
+		Short: "remove the stored API key",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return AuthLogout()
+		},
+	})
+
+	authCommand.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "show where the API key comes from",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return AuthStatus()
+		},
+	})
+
+	return &authCommand
+}
+
+func AuthLogin() error {
+	key, err := readStdin()
+	if err != nil {
+		return fmt.Errorf("could not read stdin: %w", err)
+	}
+
+	if key == "" {
+		if key, err = readSecret("OpenAI API key: "); err != nil {
+			return errUsage("no key given: pipe it on stdin")
+		}
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return errUsage("empty key")
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	source, err := credentials.Save(key, c.KeyFile, *authToFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("API key saved in %s\n", source)
+
+	return nil
+}
+
+func AuthLogout() error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	removed, err := credentials.Delete(c.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	if len(removed) == 0 {
+		fmt.Println("no stored API key")
+		return nil
+	}
+
+	fmt.Printf("API key removed from %s\n", strings.Join(removed, " and "))
+
+	return nil
+}
+
+func AuthStatus() error {
+	key, source, err := resolveAPIKey()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("API key %s from %s\n", credentials.Mask(key), source)
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/batch"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+var (
+	batchInput        *string
+	batchOutput       *string
+	batchConcurrency  *int
+	batchRPM          *int
+	batchModel        *string
+	batchSystemPrompt *string
+	batchMaxTokens    *int
+)
+
+func NewBatchCommand() *cobra.Command {
+	batchCommand := cobra.Command{
+		Use:   "batch",
+		Short: "run prompts of a file concurrently",
+		Long: "run each prompt of a JSONL file, whose lines hold an id, a prompt, and optionally a system_prompt, model and vars " +
+			"replacing {{name}} in the prompt; results are written in input order, and prompts already completed in the output are skipped",
+		Args: usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Batch(*batchInput, *batchOutput)
+		},
+	}
+
+	batchInput = batchCommand.Flags().String("input", "", "JSONL file of prompts")
+	batchOutput = batchCommand.Flags().String("output", "", "JSONL file results are appended to")
+	batchConcurrency = batchCommand.Flags().Int("concurrency", 4, "Number of prompts sent at once")
+	batchRPM = batchCommand.Flags().Int("rpm", 0, "Maximum number of prompts sent by minute (0 for no limit)")
+	batchModel = batchCommand.Flags().String("model", "gpt-3.5-turbo", "Model of prompts not setting one")
+	batchCommand.RegisterFlagCompletionFunc("model", completeModel)
+	batchSystemPrompt = batchCommand.Flags().String("system-prompt", "", "System prompt of prompts not setting one")
+	batchMaxTokens = batchCommand.Flags().Int("max-tokens", 0, "Maximum number of tokens to return")
+
+	addBatchAPICommands(&batchCommand)
+
+	return &batchCommand
+}
+
+func Batch(input, output string) error {
+	if input == "" || output == "" {
+		return errUsage("--input and --output are required")
+	}
+
+	if *batchConcurrency < 1 {
+		return errUsage("concurrency must be at least 1")
+	}
+
+	items, err := readBatchItems(input)
+	if err != nil {
+		return err
+	}
+
+	completed, err := batch.Completed(output)
+	if err != nil {
+		return err
+	}
+
+	pending := []batch.Item{}
+	for _, item := range items {
+		if !completed[item.ID] {
+			pending = append(pending, item)
+		}
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	out, err := os.OpenFile(output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open output: %w", err)
+	}
+	defer out.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var failed atomic.Int32
+
+	err = batch.Run(ctx, pending, batch.Options{
+		Concurrency:       *batchConcurrency,
+		RequestsPerMinute: *batchRPM,
+	}, func(ctx context.Context, item batch.Item) batch.Result {
+		result := completeItem(ctx, client, item)
+		if result.Error != "" {
+			failed.Add(1)
+		}
+		return result
+	}, out)
+
+	fmt.Fprintf(os.Stderr, "%d prompts: %d skipped, %d run, %d failed\n", len(items), len(items)-len(pending), len(pending), failed.Load())
+
+	if errors.Is(err, context.Canceled) {
+		return errors.New("interrupted: run again to resume")
+	} else if err != nil {
+		return err
+	}
+
+	if failed.Load() > 0 {
+		return fmt.Errorf("%d prompt(s) failed: run again to retry them", failed.Load())
+	}
+
+	return nil
+}
+
+// Sends the prompt of an item as a one-off conversation
+func completeItem(ctx context.Context, client *asoai.Client, item batch.Item) batch.Result {
+	model := item.Model
+	if model == "" {
+		model = *batchModel
+	}
+
+	messages := itemMessages(item, *batchSystemPrompt)
+
+	opts := []asoai.SendOption{}
+	if *batchMaxTokens != 0 {
+		opts = append(opts, asoai.WithMaxTokens(*batchMaxTokens))
+	}
+
+	result := batch.Result{ID: item.ID, Model: model}
+
+	reply, err := client.Complete(ctx, model, messages, opts...)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Content = reply.Content
+	result.Usage = &batch.Usage{
+		PromptTokens:     reply.Usage.PromptTokens,
+		CompletionTokens: reply.Usage.CompletionTokens,
+		TotalTokens:      reply.Usage.TotalTokens,
+	}
+
+	return result
+}
+
+// Returns messages of the one-off conversation of an item
+func itemMessages(item batch.Item, defaultSystemPrompt string) []asoai.Message {
+	systemPrompt := item.SystemPrompt
+	if systemPrompt == "" {
+		systemPrompt = defaultSystemPrompt
+	}
+
+	messages := []asoai.Message{}
+	if systemPrompt != "" {
+		messages = append(messages, asoai.Message{Role: openai.ChatMessageRoleSystem, Content: systemPrompt})
+	}
+
+	return append(messages, asoai.Message{Role: openai.ChatMessageRoleUser, Content: item.Text()})
+}
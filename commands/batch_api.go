@@ -0,0 +1,317 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/batch"
+	"git.mkz.me/mycroft/asoai/internal/database"
+)
+
+var (
+	submitInput        *string
+	submitModel        *string
+	submitSystemPrompt *string
+	submitMaxTokens    *int
+
+	fetchOutput *string
+)
+
+// Adds commands handling jobs of the Batch API
+func addBatchAPICommands(batchCommand *cobra.Command) {
+	submitCommand := cobra.Command{
+		Use:   "submit",
+		Short: "submit prompts of a file to the Batch API",
+		Long:  "submit prompts of a JSONL file, as read by batch, to the Batch API; replies are cheaper but may take up to 24 hours",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return BatchSubmit(*submitInput)
+		},
+	}
+
+	submitInput = submitCommand.Flags().String("input", "", "JSONL file of prompts")
+	submitModel = submitCommand.Flags().String("model", "gpt-3.5-turbo", "Model of prompts not setting one")
+	submitCommand.RegisterFlagCompletionFunc("model", completeModel)
+	submitSystemPrompt = submitCommand.Flags().String("system-prompt", "", "System prompt of prompts not setting one")
+	submitMaxTokens = submitCommand.Flags().Int("max-tokens", 0, "Maximum number of tokens to return")
+	batchCommand.AddCommand(&submitCommand)
+
+	batchCommand.AddCommand(&cobra.Command{
+		Use:               "status <id>",
+		Short:             "show the progress of a submitted batch",
+		Args:              usageArgs(cobra.ExactArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeBatch),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return BatchStatus(args[0])
+		},
+	})
+
+	batchCommand.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "list submitted batches",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return BatchList()
+		},
+	})
+
+	fetchCommand := cobra.Command{
+		Use:               "fetch <id>",
+		Short:             "download results of a completed batch",
+		Long:              "download results of a completed batch, written as by batch with the ids of the input prompts",
+		Args:              usageArgs(cobra.ExactArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeBatch),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return BatchFetch(args[0], *fetchOutput)
+		},
+	}
+
+	fetchOutput = fetchCommand.Flags().String("output", "", "JSONL file results are written to (default stdout)")
+	batchCommand.AddCommand(&fetchCommand)
+}
+
+// Returns a client of the Batch API, using the configured API key and profile
+func newBatchAPI() (*batch.API, error) {
+	profile, err := loadProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newHTTPClient(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := apiKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return &batch.API{
+		BaseURL:    profile.BaseURL,
+		APIKey:     key,
+		HTTPClient: httpClient,
+	}, nil
+}
+
+func BatchSubmit(input string) error {
+	if input == "" {
+		return errUsage("--input is required")
+	}
+
+	items, err := readBatchItems(input)
+	if err != nil {
+		return err
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// Aliases are resolved as by asoai.Client.ResolveModel; the database,
+	// which may be encrypted, is only needed to save the job
+	requests := batchRequests(items, func(model string) string {
+		if resolved, ok := c.Models.Aliases[model]; ok {
+			return resolved
+		}
+		return model
+	})
+
+	api, err := newBatchAPI()
+	if err != nil {
+		return err
+	}
+
+	db, err := openRawDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	job, err := api.Submit(context.Background(), requests)
+	if err != nil {
+		return err
+	}
+
+	job.Input = input
+
+	if err := db.SetBatchJob(job); err != nil {
+		return fmt.Errorf("batch %s was submitted but could not be saved: %w", job.ID, err)
+	}
+
+	fmt.Println(job.ID)
+
+	return nil
+}
+
+// Returns chat completion requests of the items, using the model given by
+// --model for items not setting one; resolve returns the model an alias
+// stands for
+func batchRequests(items []batch.Item, resolve func(model string) string) []batch.Request {
+	requests := []batch.Request{}
+
+	for _, item := range items {
+		model := item.Model
+		if model == "" {
+			model = *submitModel
+		}
+
+		req := openai.ChatCompletionRequest{
+			Model:     resolve(model),
+			MaxTokens: *submitMaxTokens,
+		}
+
+		for _, message := range itemMessages(item, *submitSystemPrompt) {
+			req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+				Role:    message.Role,
+				Content: message.Content,
+			})
+		}
+
+		requests = append(requests, batch.Request{
+			CustomID: item.ID,
+			Method:   "POST",
+			URL:      "/v1/chat/completions",
+			Body:     req,
+		})
+	}
+
+	return requests
+}
+
+func BatchStatus(id string) error {
+	api, err := newBatchAPI()
+	if err != nil {
+		return err
+	}
+
+	db, err := openRawDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	job, err := refreshBatchJob(api, db, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Batch: %s\n", job.ID)
+	fmt.Printf("Status: %s\n", job.Status)
+	fmt.Printf("Requests: %d completed, %d failed, %d total\n", job.Completed, job.Failed, job.Total)
+	fmt.Printf("Created: %s\n", job.Created.Format(time.DateTime))
+
+	if job.Input != "" {
+		fmt.Printf("Input: %s\n", job.Input)
+	}
+
+	return nil
+}
+
+func BatchList() error {
+	db, err := openRawDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	jobs, err := db.ListBatchJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		fmt.Printf("%s\t%s\t%d/%d\t%s\t%s\n", job.ID, job.Status, job.Completed, job.Total, job.Created.Format(time.DateTime), job.Input)
+	}
+
+	return nil
+}
+
+func BatchFetch(id, output string) error {
+	api, err := newBatchAPI()
+	if err != nil {
+		return err
+	}
+
+	db, err := openRawDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	job, err := refreshBatchJob(api, db, id)
+	if err != nil {
+		return err
+	}
+
+	if !job.Done() {
+		return fmt.Errorf("batch %s is %s: results are not available yet", id, job.Status)
+	}
+
+	results, err := api.Results(context.Background(), job)
+	if err != nil {
+		return err
+	}
+
+	// Results are sorted as prompts of the input, if it is still around
+	if items, err := readBatchItems(job.Input); err == nil {
+		results = batch.SortResults(results, items)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("could not create output: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, result := range results {
+		if err := encoder.Encode(result); err != nil {
+			return fmt.Errorf("could not write output: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Returns the job with its state updated from the API, and saves it. Jobs
+// submitted elsewhere are tracked from then on.
+func refreshBatchJob(api *batch.API, db database.Store, id string) (batch.Job, error) {
+	job, err := api.Get(context.Background(), id)
+	if err != nil {
+		return job, err
+	}
+
+	if tracked, err := db.GetBatchJob(id); err == nil {
+		job.Input = tracked.Input
+	}
+
+	return job, db.SetBatchJob(job)
+}
+
+func readBatchItems(input string) ([]batch.Item, error) {
+	f, err := os.Open(input)
+	if err != nil {
+		return nil, fmt.Errorf("could not open input: %w", err)
+	}
+	defer f.Close()
+
+	items, err := batch.ReadItems(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+
+	return items, nil
+}
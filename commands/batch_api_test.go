@@ -0,0 +1,84 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"git.mkz.me/mycroft/asoai/internal/batch"
+	"git.mkz.me/mycroft/asoai/internal/database"
+)
+
+func TestBatchRequests(t *testing.T) {
+	submitCommand, _, err := NewBatchCommand().Find([]string{"submit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := submitCommand.ParseFlags([]string{"--model", "fast", "--system-prompt", "be brief"}); err != nil {
+		t.Fatal(err)
+	}
+
+	aliases := map[string]string{"fast": "gpt-4o-mini", "smart": "gpt-4o"}
+	resolve := func(model string) string {
+		if resolved, ok := aliases[model]; ok {
+			return resolved
+		}
+		return model
+	}
+
+	requests := batchRequests([]batch.Item{
+		{ID: "a", Prompt: "p"},
+		{ID: "b", Prompt: "p", Model: "smart"},
+		{ID: "c", Prompt: "p", Model: "o1", SystemPrompt: "be precise"},
+	}, resolve)
+
+	expected := []struct{ model, systemPrompt string }{
+		{"gpt-4o-mini", "be brief"},
+		{"gpt-4o", "be brief"},
+		{"o1", "be precise"},
+	}
+
+	for i, request := range requests {
+		if request.Body.Model != expected[i].model || request.Body.Messages[0].Content != expected[i].systemPrompt || request.Body.Messages[1].Content != "p" {
+			t.Errorf("request %s: got model %s and messages %+v", request.CustomID, request.Body.Model, request.Body.Messages)
+		}
+	}
+}
+
+func TestRefreshBatchJob(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"b1","status":"completed","output_file_id":"file-out","created_at":1700000000,"request_counts":{"total":2,"completed":2}}`)
+	}))
+	defer server.Close()
+
+	db, err := database.Open(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.SetBatchJob(batch.Job{ID: "b1", Status: "in_progress", Input: "prompts.jsonl"}); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &batch.API{BaseURL: server.URL, APIKey: "sk-test", HTTPClient: server.Client()}
+
+	job, err := refreshBatchJob(api, db, "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := db.GetBatchJob("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The input file is only known locally
+	for _, j := range []batch.Job{job, saved} {
+		if j.Status != "completed" || j.OutputFileID != "file-out" || j.Completed != 2 || j.Input != "prompts.jsonl" {
+			t.Errorf("unexpected job %+v", j)
+		}
+	}
+}
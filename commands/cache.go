@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var cacheClearExpired *bool
+
+func NewCacheCommand() *cobra.Command {
+	cacheCommand := cobra.Command{
+		Use:   "cache",
+		Short: "handle the response cache",
+		Long:  "replies are cached when cache.ttl is set in the configuration, or with chat --cache-ttl",
+		RunE:  showUsage,
+	}
+
+	cacheCommand.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "show cached replies count and size",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return CacheStats()
+		},
+	})
+
+	cacheClearCommand := cobra.Command{
+		Use:   "clear",
+		Short: "remove cached replies",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return CacheClear(*cacheClearExpired)
+		},
+	}
+
+	cacheClearExpired = cacheClearCommand.Flags().Bool("expired", false, "Only remove expired replies")
+	cacheCommand.AddCommand(&cacheClearCommand)
+
+	return &cacheCommand
+}
+
+func CacheStats() error {
+	db, err := openRawDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := db.GetCacheStats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Entries: %d (%d expired)\n", stats.Entries, stats.Expired)
+	fmt.Printf("Size: %d bytes\n", stats.Size)
+
+	if stats.Entries > 0 {
+		fmt.Printf("Oldest: %s\n", stats.Oldest.Format(time.DateTime))
+		fmt.Printf("Newest: %s\n", stats.Newest.Format(time.DateTime))
+	}
+
+	return nil
+}
+
+func CacheClear(expiredOnly bool) error {
+	db, err := openRawDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	removed, err := db.ClearCache(expiredOnly)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d cached replies removed\n", removed)
+
+	return nil
+}
@@ -3,30 +3,36 @@ package commands
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"strings"
+	"time"
 
-	"github.com/sashabaranov/go-openai"
 	"github.com/spf13/cobra"
 
 	asoai_chat "git.mkz.me/mycroft/asoai/internal/chat"
-	"git.mkz.me/mycroft/asoai/internal/database"
 	"git.mkz.me/mycroft/asoai/internal/session"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
 )
 
 var (
 	maxTokens  *int
+	ragTopK    *int
 	useStream  *bool
 	newSession *bool
 	replMode   *bool
+	noCache    *bool
+	cacheTTL   *time.Duration
 
 	chatModel       *string
 	chatName        *string
 	chatDescription *string
 	chatPrompt      *string
 	chatOutput      *string
+	chatRag         *string
+
+	allowedCommands *[]string
 )
 
 func NewChatCommand() *cobra.Command {
@@ -34,9 +40,7 @@ func NewChatCommand() *cobra.Command {
 		Use:   "chat",
 		Short: "interact with chatgpt",
 		Long:  "query the OpenAI conversation API with current saved discussion in session",
-		Run: func(cmd *cobra.Command, args []string) {
-			chat(args)
-		},
+		RunE:  chat,
 	}
 
 	maxTokens = chatCommand.Flags().Int("max-tokens", 0, "Maximum number of tokens to return")
@@ -47,50 +51,54 @@ func NewChatCommand() *cobra.Command {
 	chatName = chatCommand.Flags().String("name", "", "Session's name (if created, else ignored)")
 	chatDescription = chatCommand.Flags().String("description", "", "Session's description (if created, else ignored)")
 	chatModel = chatCommand.Flags().String("model", "gpt-3.5-turbo", "Model (gpt-3.5-turbo, gpt-4-turbo, gpt-4o)")
+	chatCommand.RegisterFlagCompletionFunc("model", completeModel)
 	chatPrompt = chatCommand.Flags().String("system-prompt", "", "Set system prompt")
 	chatOutput = chatCommand.Flags().String("output", "", "Output file path (if not set, output to stdout)")
+	chatRag = chatCommand.Flags().String("rag", "", "Retrieve relevant excerpts from given index for each message")
+	chatCommand.RegisterFlagCompletionFunc("rag", completeIndex)
+	ragTopK = chatCommand.Flags().Int("rag-top-k", 5, "Number of excerpts retrieved with --rag")
+	noCache = chatCommand.Flags().Bool("no-cache", false, "Don't use the response cache")
+	cacheTTL = chatCommand.Flags().Duration("cache-ttl", 0, "Serve replies cached for less than this duration, and cache new ones (default cache.ttl of the configuration)")
+	allowedCommands = chatCommand.Flags().StringArray("allow-cmd", nil, "Run commands starting with given words in ![cmd ...] without confirmation (can be repeated)")
 
 	return &chatCommand
 }
 
-func chat(args []string) {
-	var currentSession session.Session
-
-	envVar := os.Getenv("OPENAI_API_KEY")
-	if envVar == "" {
-		fmt.Printf("could not find OPENAI_API_KEY")
-		os.Exit(1)
-	}
-
+func chat(cmd *cobra.Command, args []string) error {
 	input := strings.Join(args, " ")
 
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 
-	db := database.OpenDatabase(*dbPath)
-	defer db.Close()
+	if cmd.Flags().Changed("model") {
+		if *chatModel, err = checkModel(client, *chatModel); err != nil {
+			return err
+		}
+	}
 
-	currentSessionName, err := db.GetCurrentSession()
-	if err != nil {
-		fmt.Printf("could not get current session: %v\n", err)
-		os.Exit(1)
+	currentSessionName, err := client.CurrentSession()
+	if err != nil && !errors.Is(err, asoai.ErrNoCurrentSession) {
+		return err
 	}
 
 	if currentSessionName == "" || *newSession {
 		// create a new default session
-		currentSessionName, currentSession, err = SessionCreate(db, *chatName, *chatModel, *chatPrompt, true)
+		var currentSession session.Session
+
+		currentSessionName, currentSession, err = client.CreateSession(*chatName, *chatModel, *chatPrompt, true)
 		if err != nil {
-			fmt.Printf("could not create a new session: %v\n", err)
-			os.Exit(1)
+			return err
 		}
 
 		if *chatDescription != "" {
 			currentSession.Description = *chatDescription
-		}
-	} else {
-		currentSession, err = db.GetSession(currentSessionName)
-		if err != nil {
-			fmt.Printf("could not get %s session's details: %v\n", currentSessionName, err)
-			os.Exit(1)
+
+			if err := client.SaveSession(currentSessionName, currentSession); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -112,55 +120,49 @@ func chat(args []string) {
 		stdinMessage = strings.Join(stdinData, "\n")
 	}
 
-	if len(input) > 0 {
-		if len(stdinMessage) > 0 {
-			input = strings.Join([]string{input, stdinMessage}, "\n")
-		}
-	} else {
-		input = stdinMessage
-	}
-
-	if len(input) == 0 && !*replMode {
-		fmt.Println("no input; exiting")
-		os.Exit(1)
+	if len(input) == 0 && len(stdinMessage) == 0 && !*replMode {
+		return errUsage("no input")
 	}
 
-	for {
-		messages := []openai.ChatCompletionMessage{}
+	opts := []asoai.SendOption{}
 
-		for _, message := range currentSession.Messages {
-			messages = append(messages, openai.ChatCompletionMessage{
-				Role:    message.Role,
-				Content: message.Content,
-			})
-		}
+	// The session's model is used unless one is explicitly given
+	model := *chatModel
+	if cmd.Flags().Changed("model") {
+		opts = append(opts, asoai.WithModel(*chatModel))
+	} else if s, err := client.Session(currentSessionName); err == nil && s.Model != "" {
+		model = s.Model
+	}
 
-		// overwrite system prompt, if needed
-		if *chatPrompt != "" {
-			messages[0].Content = *chatPrompt
-		}
+	warnDeprecatedModel(model)
 
-		model := currentSession.Model
+	if *chatPrompt != "" {
+		opts = append(opts, asoai.WithSystemPrompt(*chatPrompt))
+	}
 
-		if *chatModel != "" {
-			// model was changed but session is not updated.
-			model = *chatModel
-		}
+	if *maxTokens != 0 {
+		opts = append(opts, asoai.WithMaxTokens(*maxTokens))
+	}
 
-		req := openai.ChatCompletionRequest{
-			Model:    model,
-			Messages: messages,
-		}
+	if *chatRag != "" {
+		opts = append(opts, asoai.WithRAG(*chatRag, *ragTopK))
+	}
 
-		if *maxTokens != 0 {
-			req.MaxTokens = *maxTokens
-		}
+	if ttl, err := responseCacheTTL(cmd); err != nil {
+		return err
+	} else if ttl > 0 {
+		opts = append(opts, asoai.WithCache(ttl))
+	}
 
-		req.Stream = *useStream
+	patcher, err := newPatcher(*allowedCommands)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(os.Stdin)
 
+	for {
 		if *replMode {
 			// Read input
-			reader := bufio.NewReader(os.Stdin)
 			fmt.Print("user> ")
 			input, err = reader.ReadString('\n')
 			input = strings.TrimSpace(input)
@@ -169,105 +171,64 @@ func chat(args []string) {
 			}
 		}
 
-		// Patch input to handle inserting files
-		input, err = asoai_chat.PatchInput(input)
+		warnUnsupportedImages(model, input)
+
+		// Patch input to handle inserting files. Piped data is added
+		// afterwards, so directives it holds are not run.
+		input, err = patcher.Patch(input)
 		if err != nil {
-			fmt.Printf("error while patching input: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("error while patching input: %w", err)
 		}
 
-		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: input,
-		})
-
-		currentSession.Messages = append(currentSession.Messages, session.Message{
-			Role:    openai.ChatMessageRoleUser,
-			Content: input,
-		})
-
-		// Save session, as we added an input
-		db.SetSession(currentSessionName, currentSession)
+		if !*replMode && len(stdinMessage) > 0 {
+			if len(input) > 0 {
+				input = strings.Join([]string{input, stdinMessage}, "\n")
+			} else {
+				input = stdinMessage
+			}
+		}
 
-		returnedRole := ""
 		returnedContent := ""
 
 		if !*useStream {
-			resp, err := client.CreateChatCompletion(context.Background(), req)
+			reply, err := client.Send(context.Background(), currentSessionName, input, opts...)
 			if err != nil {
-				fmt.Printf("ChatCompletion error: %v\n", err)
-				os.Exit(1)
+				return err
 			}
 
-			fmt.Printf("assistant> %s\n", resp.Choices[0].Message.Content)
+			fmt.Printf("assistant> %s\n", reply.Content)
 
-			currentSession.Messages = append(currentSession.Messages, session.Message{
-				Role:    resp.Choices[0].Message.Role,
-				Content: resp.Choices[0].Message.Content,
-			})
-
-			if *chatOutput != "" {
-				f, err := os.OpenFile(*chatOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-				if err != nil {
-					fmt.Printf("could not create output file: %v\n", err)
-					os.Exit(1)
-				}
-				_, err = f.WriteString(resp.Choices[0].Message.Content)
-				if err != nil {
-					fmt.Printf("could not write to output file: %v\n", err)
-					os.Exit(1)
-				}
-
-				f.Close()
-			}
+			returnedContent = reply.Content
 		} else {
-			resp, err := client.CreateChatCompletionStream(context.Background(), req)
+			chunks, err := client.SendStream(context.Background(), currentSessionName, input, opts...)
 			if err != nil {
-				fmt.Printf("ChatCompletionStream error: %v\n", err)
+				return err
 			}
-			defer resp.Close()
 
 			fmt.Printf("assistant> ")
 
-			for {
-				content, err := resp.Recv()
-				if err == io.EOF {
-					break
-				} else if err != nil {
-					fmt.Printf("error while streaming response...")
-					os.Exit(1)
+			for chunk := range chunks {
+				if chunk.Err != nil {
+					return chunk.Err
 				}
 
-				if content.Choices[0].Delta.Role != "" {
-					returnedRole = content.Choices[0].Delta.Role
-					continue
-				}
+				returnedContent += chunk.Content
 
-				returnedContent += content.Choices[0].Delta.Content
-
-				fmt.Print(content.Choices[0].Delta.Content)
+				fmt.Print(chunk.Content)
 			}
 
 			fmt.Println()
+		}
 
-			currentSession.Messages = append(currentSession.Messages, session.Message{
-				Role:    returnedRole,
-				Content: returnedContent,
-			})
-
-			if *chatOutput != "" {
-				f, err := os.OpenFile(*chatOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-				if err != nil {
-					fmt.Printf("could not create output file: %v\n", err)
-					os.Exit(1)
-				}
-				_, err = f.WriteString(returnedContent)
-				if err != nil {
-					fmt.Printf("could not write to output file: %v\n", err)
-					os.Exit(1)
-				}
-
-				f.Close()
+		if *chatOutput != "" {
+			f, err := os.OpenFile(*chatOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				return fmt.Errorf("could not create output file: %w", err)
+			}
+			_, err = f.WriteString(returnedContent)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("could not write to output file: %w", err)
 			}
 		}
 
@@ -276,5 +237,41 @@ func chat(args []string) {
 		}
 	}
 
-	db.SetSession(currentSessionName, currentSession)
+	return nil
+}
+
+// Returns how long replies are cached: the --cache-ttl flag, else the
+// configured one; 0 if caching is disabled
+func responseCacheTTL(cmd *cobra.Command) (time.Duration, error) {
+	if *noCache {
+		return 0, nil
+	}
+
+	if cmd.Flags().Changed("cache-ttl") {
+		return *cacheTTL, nil
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Cache.TTL, nil
+}
+
+// Returns a patcher asking for confirmation before running commands which are
+// not allowed
+func newPatcher(allowed []string) (*asoai_chat.Patcher, error) {
+	httpClient, err := newFetchClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &asoai_chat.Patcher{
+		HTTPClient:      httpClient,
+		AllowedCommands: allowed,
+		Confirm: func(command string) bool {
+			return confirm(fmt.Sprintf("run command `%s`?", command))
+		},
+	}, nil
 }
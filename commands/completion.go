@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/database"
+)
+
+// Returns completions of an argument or flag
+type completionFunc func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)
+
+// Completes the first argument with fn; later ones are not completed
+func completeFirstArg(fn completionFunc) completionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return fn(cmd, args, toComplete)
+	}
+}
+
+// Opens the database for completion, without creating, migrating it nor
+// asking for a passphrase. Databases of other versions give no completions.
+func openCompletionDatabase() (database.Store, bool) {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return nil, false
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		return nil, false
+	}
+
+	db, err := database.OpenReadOnly(filePath)
+	if err != nil {
+		return nil, false
+	}
+
+	return db, true
+}
+
+// Completes session names, with their description
+func completeSession(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	db, ok := openCompletionDatabase()
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer db.Close()
+
+	// Descriptions of encrypted databases are left out, as no passphrase is
+	// asked
+	encrypted, err := database.IsEncrypted(db)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	infos, err := db.ListSessionInfo()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	completions := []string{}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name, toComplete) {
+			continue
+		}
+
+		if info.Description != "" && !encrypted {
+			completions = append(completions, info.Name+"\t"+info.Description)
+		} else {
+			completions = append(completions, info.Name)
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// Completes index names
+func completeIndex(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	db, ok := openCompletionDatabase()
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer db.Close()
+
+	names, err := db.ListIndexes()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	return filterPrefix(names, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// Completes ids of batches submitted to the Batch API, with their status
+func completeBatch(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	db, ok := openCompletionDatabase()
+	if !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	defer db.Close()
+
+	jobs, err := db.ListBatchJobs()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	completions := []string{}
+	for _, job := range jobs {
+		if strings.HasPrefix(job.ID, toComplete) {
+			completions = append(completions, job.ID+"\t"+job.Status)
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// Completes profile names of the configuration
+func completeProfile(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	c, err := loadConfig()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	names := []string{}
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return filterPrefix(names, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// Returns values starting with prefix
+func filterPrefix(values []string, prefix string) []string {
+	filtered := []string{}
+	for _, value := range values {
+		if strings.HasPrefix(value, prefix) {
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered
+}
@@ -1,30 +1,342 @@
 package commands
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
 	"git.mkz.me/mycroft/asoai/internal/database"
 	"github.com/spf13/cobra"
 )
 
+var (
+	migrateTo  *string
+	restoreYes *bool
+	checkFix   *bool
+	statsTop   *int
+)
+
 func NewDatabaseCommand() *cobra.Command {
 	databaseCommand := cobra.Command{
 		Use:   "database",
 		Short: "database management functions",
-		Run: func(cmd *cobra.Command, args []string) {
-			cmd.Usage()
-		},
+		RunE:  showUsage,
 	}
 
 	databaseShrinkCommand := cobra.Command{
 		Use:   "shrink",
 		Short: "shrink/compact database",
-		Run: func(cmd *cobra.Command, args []string) {
-			db := database.OpenDatabase(*dbPath)
-			db.Shrink()
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openRawDatabase()
+			if err != nil {
+				return err
+			}
 			defer db.Close()
+
+			return db.Shrink()
 		},
 	}
 
 	databaseCommand.AddCommand(&databaseShrinkCommand)
 
+	databaseMigrateCommand := cobra.Command{
+		Use:   "migrate",
+		Short: "convert database to another storage format",
+		Long:  "convert database to another storage format (sqlite, buntdb); the original file is kept with a .bak suffix",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DatabaseMigrate(*migrateTo)
+		},
+	}
+
+	migrateTo = databaseMigrateCommand.Flags().String("to", database.FormatSQLite, "Target format (sqlite, buntdb)")
+	databaseCommand.AddCommand(&databaseMigrateCommand)
+
+	databaseCommand.AddCommand(&cobra.Command{
+		Use:   "backup <file>",
+		Short: "write a snapshot of the database to file",
+		Args:  usageArgs(cobra.ExactArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			db, err := openRawDatabase()
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			return db.Backup(args[0])
+		},
+	})
+
+	databaseRestoreCommand := cobra.Command{
+		Use:   "restore <file>",
+		Short: "replace the database with a backup",
+		Long:  "replace the database with a backup; the replaced database is kept with a .bak suffix",
+		Args:  usageArgs(cobra.ExactArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DatabaseRestore(args[0])
+		},
+	}
+
+	restoreYes = databaseRestoreCommand.Flags().Bool("yes", false, "Do not ask for confirmation")
+	databaseCommand.AddCommand(&databaseRestoreCommand)
+
+	databaseCheckCommand := cobra.Command{
+		Use:   "check",
+		Short: "check database integrity",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DatabaseCheck(*checkFix)
+		},
+	}
+
+	checkFix = databaseCheckCommand.Flags().Bool("fix", false, "Repair fixable issues; deleted sessions are kept in a .bak copy of the database")
+	databaseCommand.AddCommand(&databaseCheckCommand)
+
+	databaseStatsCommand := cobra.Command{
+		Use:   "stats",
+		Short: "show database statistics",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DatabaseStats(*statsTop)
+		},
+	}
+
+	statsTop = databaseStatsCommand.Flags().Int("top", 5, "Number of largest sessions to show")
+	databaseCommand.AddCommand(&databaseStatsCommand)
+
+	databaseCommand.AddCommand(&cobra.Command{
+		Use:   "encrypt",
+		Short: "encrypt sessions and indexed documents",
+		Long:  "encrypt sessions and indexed documents with a passphrase given by --db-key-file, ASOAI_DB_PASSPHRASE, ASOAI_DB_KEY_FILE or asked on the terminal",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DatabaseEncrypt()
+		},
+	})
+
+	databaseCommand.AddCommand(&cobra.Command{
+		Use:   "decrypt",
+		Short: "decrypt an encrypted database",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DatabaseDecrypt()
+		},
+	})
+
 	return &databaseCommand
 }
+
+func DatabaseMigrate(format string) error {
+	if format != database.FormatSQLite && format != database.FormatBuntDB {
+		return errUsage("unknown format %s: expected sqlite or buntdb", format)
+	}
+
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	backupPath, err := database.Migrate(filePath, format)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("migrated %s to %s, previous database saved as %s\n", filePath, format, backupPath)
+
+	return nil
+}
+
+func DatabaseRestore(backupFile string) error {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	if !*restoreYes && !confirm(fmt.Sprintf("replace %s with %s?", filePath, backupFile)) {
+		return errUsage("restore not confirmed")
+	}
+
+	backupPath, err := database.Restore(filePath, backupFile)
+	if err != nil {
+		return err
+	}
+
+	if backupPath != "" {
+		fmt.Printf("restored %s, previous database saved as %s\n", filePath, backupPath)
+	} else {
+		fmt.Printf("restored %s\n", filePath)
+	}
+
+	return nil
+}
+
+func DatabaseCheck(fix bool) error {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Sessions deleted by fixes are kept in a backup
+	backupPath := fmt.Sprintf("%s.check-%s.bak", filePath, time.Now().Format("20060102-150405"))
+
+	issues, err := database.Check(db, fix, backupPath)
+	if err != nil {
+		return err
+	}
+
+	remaining := 0
+	for _, issue := range issues {
+		fmt.Println(issue)
+
+		if !issue.Fixed {
+			remaining++
+		}
+	}
+
+	if remaining > 0 {
+		return fmt.Errorf("%d issue(s) found", remaining)
+	}
+
+	if len(issues) == 0 {
+		fmt.Println("no issue found")
+	}
+
+	return nil
+}
+
+func DatabaseStats(top int) error {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	format, err := database.DetectFormat(filePath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := database.GetStats(db, top)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("File: %s (%s, %d bytes)\n", filePath, format, info.Size())
+	fmt.Printf("Schema version: %d\n", stats.SchemaVersion)
+	fmt.Printf("Sessions: %d\n", stats.Sessions)
+	fmt.Printf("Messages: %d\n", stats.Messages)
+	fmt.Printf("Embeddings: %d\n", stats.Embeddings)
+	fmt.Printf("Indexes: %d (%d files, %d chunks)\n", stats.Indexes, stats.IndexFiles, stats.IndexChunks)
+
+	if len(stats.Largest) > 0 {
+		fmt.Println()
+		fmt.Println("Largest sessions:")
+
+		for _, size := range stats.Largest {
+			fmt.Printf("  %s: %d messages, %d bytes\n", size.Name, size.Messages, size.Bytes)
+		}
+	}
+
+	return nil
+}
+
+func DatabaseEncrypt() error {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(filePath)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := database.IsEncrypted(db)
+	db.Close()
+	if err != nil {
+		return err
+	} else if encrypted {
+		return errUsage("database is already encrypted")
+	}
+
+	passphrase, err := newDBPassphrase()
+	if err != nil {
+		return err
+	}
+
+	backupPath, err := database.Encrypt(filePath, passphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("encrypted %s, previous database saved as %s\n", filePath, backupPath)
+
+	fmt.Fprintln(os.Stderr, "warning: session names, models, times and tags, embedding vectors, indexed file paths and batch jobs are not encrypted")
+
+	// Backups are copies of the file made before encrypting it, including
+	// the one just made
+	backups, _ := filepath.Glob(filePath + ".*.bak")
+	for _, backup := range backups {
+		fmt.Fprintf(os.Stderr, "warning: backup %s is not encrypted: delete it if not needed\n", backup)
+	}
+
+	return nil
+}
+
+func DatabaseDecrypt() error {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(filePath)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := database.IsEncrypted(db)
+	db.Close()
+	if err != nil {
+		return err
+	} else if !encrypted {
+		return errUsage("database is not encrypted")
+	}
+
+	backupPath, err := database.Decrypt(filePath, dbPassphrase)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("decrypted %s, previous database saved as %s\n", filePath, backupPath)
+
+	return nil
+}
+
+// Opens the database without decrypting its values, for maintenance
+// commands which don't need them
+func openRawDatabase() (database.Store, error) {
+	filePath, err := database.ResolvePath(*dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return database.Open(filePath)
+}
@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+)
+
+var (
+	embedModel *string
+	embedFiles *[]string
+)
+
+type embedResult struct {
+	Source    string    `json:"source"`
+	Model     string    `json:"model"`
+	Embedding []float32 `json:"embedding"`
+}
+
+func NewEmbedCommand() *cobra.Command {
+	embedCommand := cobra.Command{
+		Use:   "embed",
+		Short: "compute embeddings",
+		Long:  "compute embeddings of given text, files or stdin and print vectors as JSON",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return embed(args)
+		},
+	}
+
+	embedModel = embedCommand.Flags().String("model", embedding.DefaultModel, "Embedding model")
+	embedFiles = embedCommand.Flags().StringArray("file", nil, "Embed given file content (can be repeated)")
+
+	return &embedCommand
+}
+
+func embed(args []string) error {
+	sources := []string{}
+	inputs := []string{}
+
+	if len(args) > 0 {
+		sources = append(sources, "text")
+		inputs = append(inputs, strings.Join(args, " "))
+	}
+
+	for _, file := range *embedFiles {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("could not read file %s: %w", file, err)
+		}
+
+		sources = append(sources, file)
+		inputs = append(inputs, string(content))
+	}
+
+	stdinData, err := readStdin()
+	if err != nil {
+		return fmt.Errorf("could not read stdin: %w", err)
+	}
+
+	if len(stdinData) > 0 {
+		sources = append(sources, "stdin")
+		inputs = append(inputs, stdinData)
+	}
+
+	if len(inputs) == 0 {
+		return errUsage("no input")
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	vectors, err := client.Embed(context.Background(), *embedModel, inputs)
+	if err != nil {
+		return err
+	}
+
+	results := []embedResult{}
+	for i, vector := range vectors {
+		results = append(results, embedResult{
+			Source:    sources[i],
+			Model:     *embedModel,
+			Embedding: vector,
+		})
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(results); err != nil {
+		return fmt.Errorf("could not encode embeddings: %w", err)
+	}
+
+	return nil
+}
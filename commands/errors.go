@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+// Exit codes, by kind of failure
+const (
+	ExitError   = 1
+	ExitUsage   = 2
+	ExitAuth    = 3
+	ExitNetwork = 4
+	ExitAPI     = 5
+	ExitStorage = 6
+)
+
+// usageError is returned when the command line is invalid
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e usageError) Unwrap() error {
+	return e.err
+}
+
+// Returns a usage error with given message
+func errUsage(format string, args ...any) error {
+	return usageError{fmt.Errorf(format, args...)}
+}
+
+// Wraps positional arguments validation so failures are usage errors
+func usageArgs(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := validate(cmd, args); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+// Prints usage of commands only grouping subcommands
+func showUsage(cmd *cobra.Command, args []string) error {
+	return cmd.Usage()
+}
+
+// Returns the process exit code matching the error
+func ExitCode(err error) int {
+	var usageErr usageError
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+	var storageErr *asoai.StorageError
+	var urlErr *url.Error
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &usageErr),
+		errors.Is(err, asoai.ErrSessionNotFound),
+		errors.Is(err, asoai.ErrSessionExists),
+		errors.Is(err, asoai.ErrNoCurrentSession),
+		errors.Is(err, asoai.ErrIndexNotFound),
+		errors.Is(err, asoai.ErrBatchNotFound):
+		return ExitUsage
+	case errors.Is(err, asoai.ErrMissingAPIKey),
+		errors.Is(err, asoai.ErrEncrypted),
+		errors.Is(err, asoai.ErrWrongPassphrase):
+		return ExitAuth
+	case errors.As(err, &apiErr):
+		if isAuthStatus(apiErr.HTTPStatusCode) {
+			return ExitAuth
+		}
+		return ExitAPI
+	case errors.As(err, &requestErr):
+		if isAuthStatus(requestErr.HTTPStatusCode) {
+			return ExitAuth
+		}
+		return ExitAPI
+	case errors.As(err, &storageErr):
+		return ExitStorage
+	case errors.As(err, &urlErr), errors.As(err, &netErr), errors.Is(err, context.DeadlineExceeded):
+		return ExitNetwork
+	default:
+		return ExitError
+	}
+}
+
+func isAuthStatus(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
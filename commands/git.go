@@ -0,0 +1,240 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/git"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+const commitMessagePrompt = `You write git commit messages following the Conventional Commits specification.
+Given a diff, answer with the commit message only: a "type(scope): summary" subject line of at most 72 characters, a blank line, and a short body explaining what changed and why when it is not obvious.
+Do not wrap the message in a code block.`
+
+const reviewPrompt = `You are a thorough code reviewer.
+Given the diff of a single file, answer with concise review comments as a markdown list. Each comment refers to the line it is about and explains the issue: bugs, edge cases, error handling, naming, readability.
+If there is nothing worth commenting, answer "LGTM".`
+
+// The part of the client used by git commands
+type completer interface {
+	Complete(ctx context.Context, model string, messages []asoai.Message, opts ...asoai.SendOption) (asoai.Reply, error)
+}
+
+var (
+	gitModel       *string
+	gitWrite       *bool
+	gitMessageFile *string
+	gitInstallHook *bool
+	gitForceHook   *bool
+)
+
+func NewGitCommand() *cobra.Command {
+	gitCommand := cobra.Command{
+		Use:   "git",
+		Short: "git helpers",
+		Long:  "write commit messages and review changes of the current git repository",
+		RunE:  showUsage,
+	}
+
+	gitModel = gitCommand.PersistentFlags().String("model", "gpt-3.5-turbo", "Model (gpt-3.5-turbo, gpt-4-turbo, gpt-4o)")
+	gitCommand.RegisterFlagCompletionFunc("model", completeModel)
+
+	commitMsgCommand := cobra.Command{
+		Use:   "commit-msg",
+		Short: "write a commit message for staged changes",
+		Long:  "write a conventional commit message for staged changes, or for the diff given on stdin",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return GitCommitMessage()
+		},
+	}
+
+	gitWrite = commitMsgCommand.Flags().Bool("write", false, "Write message to .git/COMMIT_EDITMSG")
+	gitMessageFile = commitMsgCommand.Flags().String("message-file", "", "Prepend message to given file (used by the prepare-commit-msg hook)")
+	gitInstallHook = commitMsgCommand.Flags().Bool("install-hook", false, "Install a prepare-commit-msg hook writing messages on git commit")
+	gitForceHook = commitMsgCommand.Flags().Bool("force", false, "Replace an existing prepare-commit-msg hook")
+
+	gitCommand.AddCommand(&commitMsgCommand)
+
+	gitCommand.AddCommand(&cobra.Command{
+		Use:   "review [<range>]",
+		Short: "review changes file by file",
+		Long:  "review changes of given range (uncommitted changes if not set), or the diff given on stdin, file by file",
+		Args:  usageArgs(cobra.MaximumNArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return GitReview(args)
+		},
+	})
+
+	return &gitCommand
+}
+
+func GitCommitMessage() error {
+	if *gitInstallHook {
+		path, err := git.InstallHook("", *gitForceHook)
+		if err != nil {
+			return fmt.Errorf("could not install hook: %w", err)
+		}
+
+		fmt.Printf("installed %s\n", path)
+		return nil
+	}
+
+	diff, err := readStdin()
+	if err != nil {
+		return fmt.Errorf("could not read stdin: %w", err)
+	}
+
+	if diff == "" {
+		if diff, err = git.Run("", "diff", "--staged"); err != nil {
+			return fmt.Errorf("could not get staged changes: %w", err)
+		}
+	}
+
+	if strings.TrimSpace(diff) == "" {
+		return errUsage("no staged changes")
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	message, err := commitMessage(context.Background(), client, *gitModel, diff)
+	if err != nil {
+		return fmt.Errorf("could not write commit message: %w", err)
+	}
+
+	if *gitMessageFile != "" {
+		// The hook's file holds the status comments written by git
+		return saveCommitMessage(*gitMessageFile, message, true)
+	}
+
+	if *gitWrite {
+		// COMMIT_EDITMSG holds the message of the previous commit
+		messageFile, err := git.GitPath("", "COMMIT_EDITMSG")
+		if err != nil {
+			return err
+		}
+
+		return saveCommitMessage(messageFile, message, false)
+	}
+
+	fmt.Println(message)
+	return nil
+}
+
+// Writes message to messageFile, before its existing content if keep is set
+func saveCommitMessage(messageFile, message string, keep bool) error {
+	content := message + "\n"
+
+	if keep {
+		existing, err := os.ReadFile(messageFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not read %s: %w", messageFile, err)
+		}
+		content += string(existing)
+	}
+
+	if err := os.WriteFile(messageFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("could not write %s: %w", messageFile, err)
+	}
+
+	return nil
+}
+
+func GitReview(args []string) error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	rangeSpec := "HEAD"
+	if len(args) > 0 {
+		rangeSpec = args[0]
+	}
+
+	stdinData, err := readStdin()
+	if err != nil {
+		return fmt.Errorf("could not read stdin: %w", err)
+	}
+
+	return reviewChanges(context.Background(), client, *gitModel, "", rangeSpec, stdinData, os.Stdout)
+}
+
+// Reviews diff file by file, or changes of rangeSpec in the repository of dir
+// if it is empty, and writes comments to w
+func reviewChanges(ctx context.Context, api completer, model, dir, rangeSpec, diff string, w io.Writer) error {
+	var err error
+
+	files := []string{}
+	diffs := map[string]string{}
+
+	if diff != "" {
+		files, diffs = git.SplitDiff(diff)
+	} else {
+		files, err = git.ChangedFiles(dir, rangeSpec)
+		if err != nil {
+			return fmt.Errorf("could not list changed files: %w", err)
+		}
+	}
+
+	if len(files) == 0 {
+		return errUsage("no changes")
+	}
+
+	for _, file := range files {
+		diff, ok := diffs[file]
+		if !ok {
+			// git is run without a shell, so file names are passed as is
+			diff, err = git.Run(dir, "diff", rangeSpec, "--", file)
+			if err != nil {
+				return fmt.Errorf("could not get changes of %s: %w", file, err)
+			}
+		}
+
+		comments, err := review(ctx, api, model, file, diff)
+		if err != nil {
+			return fmt.Errorf("could not review %s: %w", file, err)
+		}
+
+		fmt.Fprintf(w, "== %s\n%s\n\n", file, comments)
+	}
+
+	return nil
+}
+
+func commitMessage(ctx context.Context, api completer, model, diff string) (string, error) {
+	return complete(ctx, api, model, commitMessagePrompt, formatDiff(diff))
+}
+
+func review(ctx context.Context, api completer, model, file, diff string) (string, error) {
+	return complete(ctx, api, model, reviewPrompt, fmt.Sprintf("Diff of %s:\n%s", file, formatDiff(diff)))
+}
+
+// Returns diff in a code block
+func formatDiff(diff string) string {
+	return "```diff\n" + strings.TrimRight(diff, "\n") + "\n```"
+}
+
+// Sends a one-off request, not saved in any session
+func complete(ctx context.Context, api completer, model, prompt, input string) (string, error) {
+	reply, err := api.Complete(ctx, model, []asoai.Message{
+		{Role: openai.ChatMessageRoleSystem, Content: prompt},
+		{Role: openai.ChatMessageRoleUser, Content: input},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(reply.Content), nil
+}
@@ -0,0 +1,191 @@
+package commands
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mkz.me/mycroft/asoai/internal/git"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+// Records requests and answers with a fixed reply
+type fakeCompleter struct {
+	reply    string
+	requests [][]asoai.Message
+}
+
+func (f *fakeCompleter) Complete(ctx context.Context, model string, messages []asoai.Message, opts ...asoai.SendOption) (asoai.Reply, error) {
+	f.requests = append(f.requests, messages)
+	return asoai.Reply{Content: f.reply}, nil
+}
+
+// Creates a repository with a commit, and returns its path
+func testRepository(t *testing.T, files ...string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		if _, err := git.Run(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q")
+	run("config", "user.email", "test@example.com")
+	run("config", "user.name", "test")
+
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("first\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("add", ".")
+	run("commit", "-q", "-m", "initial commit")
+
+	return dir
+}
+
+func TestReviewFileNames(t *testing.T) {
+	files := []string{"a]b.txt", "$(touch pwned).txt", "x;y.txt", "it's.txt", "café\nmenu.txt"}
+	dir := testRepository(t, files...)
+
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("second\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changed, err := git.ChangedFiles(dir, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != len(files) {
+		t.Fatalf("changed files: %q", changed)
+	}
+
+	api := &fakeCompleter{reply: " LGTM\n"}
+
+	var out strings.Builder
+	if err := reviewChanges(context.Background(), api, "gpt-4o", dir, "HEAD", "", &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.requests) != len(files) {
+		t.Fatalf("%d files reviewed out of %d", len(api.requests), len(files))
+	}
+
+	for i, file := range changed {
+		if !strings.Contains(out.String(), "== "+file+"\nLGTM\n") {
+			t.Errorf("comments on %s not written: %q", file, out.String())
+		}
+
+		input := api.requests[i][1].Content
+		if !strings.Contains(input, "+second") || !strings.Contains(input, file) {
+			t.Errorf("diff of %s not sent: %q", file, input)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+		t.Error("a file name was run by a shell")
+	}
+
+	// Failures of git are reported
+	if err := reviewChanges(context.Background(), api, "gpt-4o", dir, "no-such-revision", "", &out); err == nil {
+		t.Error("no error for an unknown revision")
+	}
+}
+
+func TestReviewDiff(t *testing.T) {
+	diff := "diff --git a/my file.txt b/my file.txt\n--- a/my file.txt\n+++ b/my file.txt\n@@ -1 +1 @@\n-first\n+second\n"
+
+	api := &fakeCompleter{reply: "LGTM"}
+
+	var out strings.Builder
+	if err := reviewChanges(context.Background(), api, "gpt-4o", t.TempDir(), "HEAD", diff, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "== my file.txt\nLGTM\n\n" {
+		t.Errorf("got %q", out.String())
+	}
+	if len(api.requests) != 1 || !strings.Contains(api.requests[0][1].Content, "Diff of my file.txt:") {
+		t.Errorf("unexpected requests %+v", api.requests)
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	dir := testRepository(t, "main.go")
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.Run(dir, "add", "main.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := git.Run(dir, "diff", "--staged")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeCompleter{reply: "feat: add main package\n"}
+	message, err := commitMessage(context.Background(), api, "gpt-4o", diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if message != "feat: add main package" {
+		t.Errorf("got message %q", message)
+	}
+	if input := api.requests[0][1].Content; !strings.HasPrefix(input, "```diff\n") || !strings.Contains(input, "+package main") {
+		t.Errorf("unexpected input %q", input)
+	}
+
+	messageFile, err := git.GitPath(dir, "COMMIT_EDITMSG")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		existing string
+		keep     bool
+		expected string
+	}{
+		{"write", "initial commit\n", false, message + "\n"},
+		{"hook", "\n# Please enter the commit message\n", true, message + "\n\n# Please enter the commit message\n"},
+		{"hook without file", "", true, message + "\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(messageFile)
+			if test.existing != "" {
+				if err := os.WriteFile(messageFile, []byte(test.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := saveCommitMessage(messageFile, message, test.keep); err != nil {
+				t.Fatal(err)
+			}
+
+			content, err := os.ReadFile(messageFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("got %q, expected %q", content, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+)
+
+var (
+	indexName  *string
+	indexModel *string
+)
+
+func NewIndexCommand() *cobra.Command {
+	indexCommand := cobra.Command{
+		Use:   "index",
+		Short: "manage local document indexes",
+		Long:  "indexes hold embeddings of local documents, used by chat --rag to retrieve relevant excerpts",
+		RunE:  showUsage,
+	}
+
+	addCommand := cobra.Command{
+		Use:   "add",
+		Short: "index or re-index a directory",
+		Args:  usageArgs(cobra.ExactArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return IndexAdd(args[0])
+		},
+	}
+
+	indexName = addCommand.Flags().String("name", "", "Index name (defaults to the directory name)")
+	indexModel = addCommand.Flags().String("model", embedding.DefaultModel, "Embedding model")
+	indexCommand.AddCommand(&addCommand)
+
+	indexCommand.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "list indexes",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return IndexList()
+		},
+	})
+
+	indexCommand.AddCommand(&cobra.Command{
+		Use:               "rm",
+		Short:             "remove an index",
+		Args:              usageArgs(cobra.ExactArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeIndex),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return IndexRemove(args[0])
+		},
+	})
+
+	return &indexCommand
+}
+
+func IndexAdd(dir string) error {
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", dir, err)
+	}
+
+	name := *indexName
+	if name == "" {
+		name = filepath.Base(root)
+	}
+
+	if strings.Contains(name, ":") {
+		return errUsage("invalid index name %s: must not contain ':'", name)
+	}
+
+	client, err := newOpenAIClient()
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	stats, err := rag.Update(context.Background(), db, client, name, root, *indexModel)
+	if err != nil {
+		return err
+	}
+
+	err = db.SetIndex(name, rag.Index{
+		Root:    root,
+		Model:   *indexModel,
+		Updated: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d files indexed (%d chunks), %d unchanged, %d removed\n", name, stats.Indexed, stats.Chunks, stats.Unchanged, stats.Removed)
+
+	return nil
+}
+
+func IndexList() error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	indexes, err := db.ListIndexes()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range indexes {
+		index, err := db.GetIndex(name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s - %s (%s, updated %s)\n", name, index.Root, index.Model, index.Updated.Format(time.DateTime))
+	}
+
+	return nil
+}
+
+func IndexRemove(name string) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.DeleteIndex(name)
+}
@@ -0,0 +1,21 @@
+package commands
+
+import (
+	"io"
+	"os"
+)
+
+// Returns data piped on stdin, or an empty string if stdin is a terminal
+func readStdin() (string, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil || (stat.Mode()&os.ModeCharDevice) != 0 {
+		return "", nil
+	}
+
+	content, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
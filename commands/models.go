@@ -2,51 +2,293 @@ package commands
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
-	"sort"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/sashabaranov/go-openai"
 	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/models"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+var (
+	modelsFilter       *string
+	modelsCapabilities *[]string
+	modelsJSON         *bool
 )
 
+// Matches ![file ...] directives including images
+var imageFileRe = regexp.MustCompile(`(?i)!\[file\s+[^\]]+\.(png|jpe?g|gif|webp)\s*\]`)
+
 func NewModelsCommand() *cobra.Command {
 	modelsCommand := cobra.Command{
 		Use:   "models",
 		Short: "list models",
-		Long:  "list all available models exposed by the API",
-		Run: func(cmd *cobra.Command, args []string) {
-			listModels()
+		Long:  "list all available models exposed by the API, with metadata known by asoai: context window, capabilities, pricing and deprecation",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listModels(*modelsFilter, *modelsCapabilities, *modelsJSON)
 		},
 	}
 
+	modelsFilter = modelsCommand.Flags().String("filter", "", "Only list models of a type (chat, embedding, image, audio, moderation, completion) or whose id contains the text")
+	modelsCapabilities = modelsCommand.Flags().StringSlice("capability", nil, "Only list models having a capability (vision, tools, json; can be repeated)")
+	modelsJSON = modelsCommand.Flags().Bool("json", false, "Print models and their metadata as JSON")
+
+	modelsCommand.AddCommand(&cobra.Command{
+		Use:               "info <id>",
+		Short:             "show metadata of a model",
+		Args:              usageArgs(cobra.ExactArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeModel),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return modelInfo(args[0])
+		},
+	})
+
 	return &modelsCommand
 }
 
-func listModels() {
-	envVar := os.Getenv("OPENAI_API_KEY")
-	if envVar == "" {
-		fmt.Printf("could not find OPENAI_API_KEY")
-		os.Exit(1)
+func listModels(filter string, capabilities []string, asJSON bool) error {
+	for _, capability := range capabilities {
+		if !slices.Contains([]string{models.CapabilityVision, models.CapabilityTools, models.CapabilityJSON}, capability) {
+			return errUsage("unknown capability %s (vision, tools or json)", capability)
+		}
 	}
 
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 
-	models, err := client.ListModels(context.Background())
+	catalog, err := client.ModelCatalog(context.Background())
 	if err != nil {
-		fmt.Printf("could not list models: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+
+	ids := []string{}
+	for _, model := range catalog {
+		ids = append(ids, model.ID)
+	}
+	cacheModels(ids)
+
+	catalog = models.Filter(catalog, filter, capabilities)
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(catalog)
+	}
+
+	for _, model := range catalog {
+		fmt.Println(model.ID)
 	}
 
-	modelsList := []string{}
+	return nil
+}
+
+func modelInfo(id string) error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 
-	for _, model := range models.Models {
-		modelsList = append(modelsList, model.ID)
+	model, err := client.Model(context.Background(), id)
+	if err != nil {
+		return err
 	}
 
-	sort.Strings(modelsList)
+	fmt.Printf("Model: %s\n", model.ID)
+	if model.OwnedBy != "" {
+		fmt.Printf("Owned by: %s\n", model.OwnedBy)
+	}
+	if !model.Created.IsZero() {
+		fmt.Printf("Created: %s\n", model.Created.Format(time.DateOnly))
+	}
 
-	for _, model := range modelsList {
-		fmt.Println(model)
+	if !model.Known {
+		fmt.Println("No metadata is known for this model")
+		return nil
 	}
+
+	fmt.Printf("Type: %s\n", model.Type)
+
+	if model.ContextWindow > 0 {
+		fmt.Printf("Context window: %d tokens\n", model.ContextWindow)
+	}
+	if model.MaxOutput > 0 {
+		fmt.Printf("Max output: %d tokens\n", model.MaxOutput)
+	}
+	if len(model.Capabilities) > 0 {
+		fmt.Printf("Capabilities: %s\n", strings.Join(model.Capabilities, ", "))
+	}
+	if model.OutputPrice > 0 {
+		fmt.Printf("Price: $%.2f input, $%.2f output per million tokens\n", model.InputPrice, model.OutputPrice)
+	} else if model.InputPrice > 0 {
+		fmt.Printf("Price: $%.2f per million tokens\n", model.InputPrice)
+	}
+	if model.Deprecated() {
+		fmt.Printf("Deprecation: %s\n", model.Deprecation)
+	}
+
+	return nil
+}
+
+// Warns on stderr if the model is deprecated
+func warnDeprecatedModel(id string) {
+	model, ok := asoai.LookupModel(id)
+	if !ok || !model.Deprecated() {
+		return
+	}
+
+	if model.ShutDown(time.Now()) {
+		fmt.Fprintf(os.Stderr, "warning: model %s is deprecated and was shut down on %s\n", id, model.Deprecation)
+	} else {
+		fmt.Fprintf(os.Stderr, "warning: model %s is deprecated and will be shut down on %s\n", id, model.Deprecation)
+	}
+}
+
+// Warns on stderr if input attaches images which the model can't handle
+func warnUnsupportedImages(id, input string) {
+	if !imageFileRe.MatchString(input) {
+		return
+	}
+
+	if model, ok := asoai.LookupModel(id); ok && !model.Has(models.CapabilityVision) {
+		fmt.Fprintf(os.Stderr, "warning: model %s can't handle images\n", id)
+	}
+}
+
+// Returns the model an alias stands for. With models.validate set in the
+// configuration, the model must also be exposed by the API.
+func checkModel(client *asoai.Client, model string) (string, error) {
+	model = client.ResolveModel(model)
+
+	if err := validateModel(client, model); err != nil {
+		return "", err
+	}
+
+	return model, nil
+}
+
+// Returns an error suggesting close names if models.validate is set and the
+// API doesn't expose the resolved model
+func validateModel(client *asoai.Client, model string) error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if !c.Models.Validate {
+		return nil
+	}
+
+	// The cached list is refreshed once, in case the model is new
+	ids, err := availableModels(client, false)
+	if err == nil && !slices.Contains(ids, model) {
+		ids, err = availableModels(client, true)
+	}
+
+	// Models can't be checked; the API reports unknown ones anyway
+	if err != nil || slices.Contains(ids, model) {
+		return nil
+	}
+
+	candidates := slices.Clone(ids)
+	for alias := range c.Models.Aliases {
+		candidates = append(candidates, alias)
+	}
+
+	if suggestions := models.Suggest(model, candidates); len(suggestions) > 0 {
+		return errUsage("unknown model %s; did you mean %s?", model, strings.Join(suggestions, ", "))
+	}
+
+	return errUsage("unknown model %s; run asoai models to list them", model)
+}
+
+// Returns ids of models exposed by the API, from the cache unless it is
+// outdated or refresh is set
+func availableModels(client *asoai.Client, refresh bool) ([]string, error) {
+	if !refresh {
+		if ids, ok := cachedModels(); ok {
+			return ids, nil
+		}
+	}
+
+	ids, err := client.Models(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	cacheModels(ids)
+
+	return ids, nil
+}
+
+// Returns the cached list of models of the API in use, if recent enough
+func cachedModels() ([]string, bool) {
+	filePath, err := modelsCachePath()
+	if err != nil {
+		return nil, false
+	}
+
+	ids, fetched, err := models.ReadCache(filePath)
+	if err != nil || time.Since(fetched) > models.CacheMaxAge {
+		return nil, false
+	}
+
+	return ids, true
+}
+
+// Caches the list of models of the API in use; failures are ignored as the
+// list is fetched again when needed
+func cacheModels(ids []string) {
+	if filePath, err := modelsCachePath(); err == nil {
+		models.WriteCache(filePath, ids)
+	}
+}
+
+func modelsCachePath() (string, error) {
+	profile, err := loadProfile()
+	if err != nil {
+		return "", err
+	}
+
+	return models.CachePath(profile.BaseURL)
+}
+
+// Completes --model flags with aliases, and models of the cached list or
+// known ones; the API is not called
+func completeModel(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	completions := []string{}
+
+	if c, err := loadConfig(); err == nil {
+		for alias, model := range c.Models.Aliases {
+			if strings.HasPrefix(alias, toComplete) {
+				completions = append(completions, alias+"\t"+model)
+			}
+		}
+		slices.Sort(completions)
+	}
+
+	ids := models.Known()
+	if filePath, err := modelsCachePath(); err == nil {
+		if cached, _, err := models.ReadCache(filePath); err == nil {
+			ids = cached
+		}
+	}
+
+	for _, id := range ids {
+		if strings.HasPrefix(id, toComplete) {
+			completions = append(completions, id)
+		}
+	}
+
+	return completions, cobra.ShellCompDirectiveNoFileComp
 }
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"git.mkz.me/mycroft/asoai/internal/database"
+)
+
+// Asks a yes/no question on the terminal, even when stdin is piped. Returns
+// false if there is no terminal to ask on.
+func confirm(question string) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "%s [y/N] ", question)
+
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// Reads a secret on the terminal, without echoing it
+func readSecret(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	secret, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+
+	return string(secret), err
+}
+
+// Returns the database passphrase from --db-key-file, the environment, or
+// asks for it on the terminal
+func dbPassphrase() (string, error) {
+	if *dbKeyFile != "" {
+		return database.SecretFromFile(*dbKeyFile)
+	}
+
+	passphrase, err := database.SecretFromEnv()
+	if err != nil || passphrase != "" {
+		return passphrase, err
+	}
+
+	passphrase, err = readSecret("Database passphrase: ")
+	if err != nil {
+		// No terminal to ask on
+		return "", nil
+	}
+
+	return passphrase, nil
+}
+
+// Returns a new database passphrase, asked twice when read on the terminal
+func newDBPassphrase() (string, error) {
+	if *dbKeyFile != "" {
+		return database.SecretFromFile(*dbKeyFile)
+	}
+
+	passphrase, err := database.SecretFromEnv()
+	if err != nil || passphrase != "" {
+		return passphrase, err
+	}
+
+	passphrase, err = readSecret("New database passphrase: ")
+	if err != nil {
+		return "", errUsage("no passphrase: set --db-key-file, ASOAI_DB_PASSPHRASE or ASOAI_DB_KEY_FILE")
+	}
+
+	confirmation, err := readSecret("Confirm passphrase: ")
+	if err != nil {
+		return "", err
+	}
+
+	if passphrase != confirmation {
+		return "", errors.New("passphrases do not match")
+	}
+
+	if passphrase == "" {
+		return "", errUsage("empty passphrase")
+	}
+
+	return passphrase, nil
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/proxy"
+)
+
+var (
+	proxyListen *string
+	proxyToken  *string
+)
+
+func NewProxyCommand() *cobra.Command {
+	proxyCommand := cobra.Command{
+		Use:   "proxy",
+		Short: "run an OpenAI compatible proxy recording sessions",
+		Long: "forward OpenAI API requests to the configured backend and record chat completions as sessions; " +
+			"the session is named by the " + proxy.SessionHeader + " header, or derived from the conversation",
+		Args: usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Proxy(*proxyListen, *proxyToken)
+		},
+	}
+
+	proxyListen = proxyCommand.Flags().String("listen", "127.0.0.1:8081", "address to listen on")
+	proxyToken = proxyCommand.Flags().String("token", "", "API key required from clients (default ASOAI_PROXY_TOKEN)")
+
+	return &proxyCommand
+}
+
+func Proxy(listen, token string) error {
+	if token == "" {
+		token = os.Getenv("ASOAI_PROXY_TOKEN")
+	}
+
+	if err := checkListen(listen, token, "ASOAI_PROXY_TOKEN"); err != nil {
+		return err
+	}
+
+	profile, err := loadProfile()
+	if err != nil {
+		return err
+	}
+
+	httpClient, err := newHTTPClient(profile)
+	if err != nil {
+		return err
+	}
+
+	// Resolved once, rather than running a key command on each request
+	key, err := apiKey()
+	if err != nil {
+		return err
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return listenAndServe(listen, proxy.New(client, proxy.Options{
+		BaseURL:    profile.BaseURL,
+		APIKey:     key,
+		HTTPClient: httpClient,
+		Token:      token,
+	}))
+}
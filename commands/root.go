@@ -1,22 +1,43 @@
 package commands
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
 
+	"github.com/sashabaranov/go-openai"
 	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/config"
+	"git.mkz.me/mycroft/asoai/internal/credentials"
+	"git.mkz.me/mycroft/asoai/internal/database"
+	"git.mkz.me/mycroft/asoai/internal/httpclient"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
 )
 
 var (
-	dbPath *string
+	dbPath      *string
+	dbKeyFile   *string
+	configPath  *string
+	apiKeyFlag  *string
+	profileName *string
+
+	// Configuration, loaded once
+	loadedConfig *config.Config
 )
 
 var RootCmd = &cobra.Command{
 	Use:   "asoai",
 	Short: "asoai is another stupid OpenAI client",
-	Run: func(cmd *cobra.Command, args []string) {
+	Args:  usageArgs(cobra.NoArgs),
+	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.Usage()
-		os.Exit(1)
+		return errUsage("no command given")
 	},
+	// Errors are printed by main, which also picks the exit code
+	SilenceErrors: true,
+	SilenceUsage:  true,
 }
 
 // Builds the cobra argument parsing state
@@ -25,6 +46,186 @@ func InitCommands() {
 	RootCmd.AddCommand(NewSessionCommand())
 	RootCmd.AddCommand(NewModelsCommand())
 	RootCmd.AddCommand(NewDatabaseCommand())
+	RootCmd.AddCommand(NewEmbedCommand())
+	RootCmd.AddCommand(NewIndexCommand())
+	RootCmd.AddCommand(NewGitCommand())
+	RootCmd.AddCommand(NewAuthCommand())
+	RootCmd.AddCommand(NewServeCommand())
+	RootCmd.AddCommand(NewProxyCommand())
+	RootCmd.AddCommand(NewCacheCommand())
+	RootCmd.AddCommand(NewBatchCommand())
 
 	dbPath = RootCmd.PersistentFlags().String("db-path", "", "database file path")
+	dbKeyFile = RootCmd.PersistentFlags().String("db-key-file", "", "file holding the passphrase of an encrypted database")
+	configPath = RootCmd.PersistentFlags().String("config", "", "configuration file path")
+	apiKeyFlag = RootCmd.PersistentFlags().String("api-key", "", "OpenAI API key (prefer OPENAI_API_KEY or asoai auth login)")
+	profileName = RootCmd.PersistentFlags().String("profile", "", "network profile of the configuration file")
+	RootCmd.RegisterFlagCompletionFunc("profile", completeProfile)
+
+	RootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{err}
+	})
+}
+
+// Opens the database and returns a client
+func openClient() (*asoai.Client, error) {
+	profile, err := loadProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := newHTTPClient(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return asoai.New(asoai.Options{
+		DBPath:          *dbPath,
+		DBPassphrase:    dbPassphrase,
+		APIKeyFunc:      apiKey,
+		BaseURL:         profile.BaseURL,
+		HTTPClient:      httpClient,
+		CacheMaxEntries: c.Cache.MaxEntries,
+		ModelAliases:    c.Models.Aliases,
+	})
+}
+
+// Opens the database, decrypting its values if encrypted
+func openDatabase() (database.Store, error) {
+	return database.OpenDatabase(*dbPath, dbPassphrase)
+}
+
+// Returns an OpenAI client using the configured API key and profile
+func newOpenAIClient() (*openai.Client, error) {
+	profile, err := loadProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := apiKey()
+	if err != nil {
+		return nil, err
+	}
+
+	config := openai.DefaultConfig(key)
+	if profile.BaseURL != "" {
+		config.BaseURL = profile.BaseURL
+	}
+
+	if config.HTTPClient, err = newHTTPClient(profile); err != nil {
+		return nil, err
+	}
+
+	return openai.NewClientWithConfig(config), nil
+}
+
+// Returns the client used for API calls, using the network settings of the
+// profile and retrying calls as configured
+func newHTTPClient(profile config.Profile) (*http.Client, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := httpclient.NewTransport(httpclient.Options{
+		Proxy:    profile.Proxy,
+		CAFiles:  profile.CAFiles,
+		CertFile: profile.ClientCert,
+		KeyFile:  profile.ClientKey,
+		Timeout:  profile.Timeout,
+		Headers:  profile.Headers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile: %w", err)
+	}
+
+	timeout := c.Retry.Timeout
+	if timeout == 0 {
+		timeout = httpclient.DefaultTimeout
+	}
+
+	return &http.Client{
+		Transport: &httpclient.Retry{
+			Base:        transport,
+			MaxAttempts: c.Retry.MaxAttempts,
+			Timeout:     timeout,
+		},
+	}, nil
+}
+
+// Returns the client used to fetch urls. It goes through the proxy of the
+// profile and trusts its CAs, but the client certificate and headers, which
+// authenticate to the API, are not sent to other servers.
+func newFetchClient() (*http.Client, error) {
+	profile, err := loadProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := httpclient.NewTransport(httpclient.Options{
+		Proxy:   profile.Proxy,
+		CAFiles: profile.CAFiles,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid profile: %w", err)
+	}
+
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// Returns the configuration, loaded on first use
+func loadConfig() (config.Config, error) {
+	if loadedConfig != nil {
+		return *loadedConfig, nil
+	}
+
+	c, err := config.Load(*configPath)
+	if err != nil {
+		return c, err
+	}
+
+	loadedConfig = &c
+
+	return c, nil
+}
+
+// Returns the network settings of the profile given on the command line, or
+// of the default one
+func loadProfile() (config.Profile, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return config.Profile{}, err
+	}
+
+	return c.GetProfile(*profileName)
+}
+
+// Returns the API key from the first configured source holding one
+func apiKey() (string, error) {
+	key, _, err := resolveAPIKey()
+	return key, err
+}
+
+// Returns the API key and its source
+func resolveAPIKey() (string, string, error) {
+	c, err := loadConfig()
+	if err != nil {
+		return "", "", err
+	}
+
+	key, source, err := credentials.Resolve(credentials.Options{
+		Flag:       *apiKeyFlag,
+		KeyCommand: c.KeyCommand,
+		KeyFile:    c.KeyFile,
+	})
+	if errors.Is(err, credentials.ErrNotFound) {
+		return "", "", asoai.ErrMissingAPIKey
+	}
+
+	return key, source, err
 }
@@ -0,0 +1,121 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/internal/server"
+)
+
+var (
+	serveListen *string
+	serveToken  *string
+)
+
+func NewServeCommand() *cobra.Command {
+	serveCommand := cobra.Command{
+		Use:   "serve",
+		Short: "serve sessions over HTTP",
+		Long:  "expose sessions with a REST API; replies can be streamed as server-sent events",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return Serve(*serveListen, *serveToken)
+		},
+	}
+
+	serveListen = serveCommand.Flags().String("listen", "127.0.0.1:8080", "address to listen on")
+	serveToken = serveCommand.Flags().String("token", "", "bearer token required by requests (default ASOAI_SERVE_TOKEN)")
+
+	return &serveCommand
+}
+
+func Serve(listen, token string) error {
+	if token == "" {
+		token = os.Getenv("ASOAI_SERVE_TOKEN")
+	}
+
+	if err := checkListen(listen, token, "ASOAI_SERVE_TOKEN"); err != nil {
+		return err
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return listenAndServe(listen, server.New(client, token, func(model string) error {
+		return validateModel(client, model)
+	}))
+}
+
+// Serves handler on the address until interrupted
+func listenAndServe(listen string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "listening on %s\n", listener.Addr())
+
+	if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Checks a token is set if the address accepts remote connections; envVar
+// is the variable which can hold the token
+func checkListen(listen, token, envVar string) error {
+	loopback, err := isLoopback(listen)
+	if err != nil {
+		return errUsage("invalid listen address %s: %v", listen, err)
+	}
+
+	if !loopback && token == "" {
+		return errUsage("a token is required to listen on %s: use --token or %s", listen, envVar)
+	}
+
+	return nil
+}
+
+// Returns true if the address only accepts local connections
+func isLoopback(address string) (bool, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false, err
+	}
+
+	if host == "localhost" {
+		return true, nil
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback(), nil
+}
@@ -2,13 +2,14 @@ package commands
 
 import (
 	"fmt"
-	"os"
+	"slices"
+	"strings"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 
-	"git.mkz.me/mycroft/asoai/internal/database"
-	"git.mkz.me/mycroft/asoai/internal/session"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
 )
 
 var (
@@ -20,6 +21,12 @@ var (
 	configModel       *string
 	configPrompt      *string
 	configRename      *string
+	configTags        *[]string
+	configUntags      *[]string
+
+	searchSemantic *bool
+	searchLimit    *int
+	searchModel    *string
 )
 
 func NewSessionCommand() *cobra.Command {
@@ -27,229 +34,267 @@ func NewSessionCommand() *cobra.Command {
 		Use:   "session",
 		Short: "handle sessions",
 		Long:  "sessions are used to get context about chats with the AI",
-		Run: func(cmd *cobra.Command, args []string) {
-			cmd.Usage()
-		},
+		RunE:  showUsage,
 	}
 
 	newSessionCommand := cobra.Command{
 		Use:   "create",
 		Short: "create a new session",
-
-		Run: func(cmd *cobra.Command, args []string) {
-			sessionUuid, _, err := SessionCreate(nil, *createName, *createModel, *createPrompt, false)
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessionUuid, err := SessionCreate(*createName, *createModel, *createPrompt)
 			if err != nil {
-				fmt.Printf("could not create a new session: %s\n", err)
-				os.Exit(1)
+				return err
 			}
 
 			fmt.Println(sessionUuid)
+
+			return nil
 		},
 	}
 
 	createName = newSessionCommand.Flags().String("name", "", "Session's name")
 	createModel = newSessionCommand.Flags().String("model", "gpt-3.5-turbo", "Model (gpt-3.5-turbo, gpt-4-turbo, gpt-4o)")
+	newSessionCommand.RegisterFlagCompletionFunc("model", completeModel)
 	createPrompt = newSessionCommand.Flags().String("system-prompt", "", "Initial system prompt")
 	sessionCommand.AddCommand(&newSessionCommand)
 
 	sessionCommand.AddCommand(&cobra.Command{
-		Use:   "dump",
-		Short: "dump current session",
-		Run: func(cmd *cobra.Command, args []string) {
-			SessionDump()
+		Use:               "dump [<name>]",
+		Short:             "dump a session, the current one by default",
+		Args:              usageArgs(cobra.MaximumNArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeSession),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionDump(optionalArg(args))
 		},
 	})
 
-	sessionCommand.AddCommand(&cobra.Command{
-		Use:   "list",
-		Short: "list existing sessions",
-		Run: func(cmd *cobra.Command, args []string) {
-			SessionList()
-		},
-	})
+	sessionCommand.AddCommand(newSessionListCommand())
 
 	sessionCommand.AddCommand(&cobra.Command{
 		Use:   "get-current",
 		Short: "returns current session uuid",
-		Run: func(cmd *cobra.Command, args []string) {
-			SessionGetCurrent()
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionGetCurrent()
 		},
 	})
 
 	sessionCommand.AddCommand(&cobra.Command{
-		Use:   "set-current",
-		Short: "set current session uuid",
-		Args:  cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			SessionSetCurrent(args[0])
+		Use:               "set-current",
+		Short:             "set current session uuid",
+		Args:              usageArgs(cobra.ExactArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeSession),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionSetCurrent(args[0])
 		},
 	})
 
 	configCommand := cobra.Command{
-		Use:   "config",
-		Short: "configure the current session",
-		Run: func(cmd *cobra.Command, args []string) {
-			SessionConfigure()
+		Use:               "config [<name>]",
+		Short:             "configure a session, the current one by default",
+		Args:              usageArgs(cobra.MaximumNArgs(1)),
+		ValidArgsFunction: completeFirstArg(completeSession),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionConfigure(optionalArg(args))
 		},
 	}
 
 	configDescription = configCommand.Flags().String("description", "", "Set a description")
 	configPrompt = configCommand.Flags().String("prompt", "", "Set a prompt (gpt-3.5-turbo, gpt-4-turbo, gpt-4o)")
 	configModel = configCommand.Flags().String("model", "", "Set a model")
-	configRename = configCommand.Flags().String("rename", "", "Rename session")
+	configCommand.RegisterFlagCompletionFunc("model", completeModel)
+	configRename = configCommand.Flags().String("rename", "", "Rename session (same as session mv)")
+	configTags = configCommand.Flags().StringArray("tag", nil, "Add a tag (can be repeated)")
+	configUntags = configCommand.Flags().StringArray("untag", nil, "Remove a tag (can be repeated)")
 
 	sessionCommand.AddCommand(&configCommand)
 
-	return &sessionCommand
-}
-
-func SessionCreate(db *database.DB, name, model, prompt string, setDefaultSession bool) (string, session.Session, error) {
-	sessionName := uuid.New().String()
-	if name != "" {
-		sessionName = name
-	}
-
-	if db == nil {
-		db := database.OpenDatabase(*dbPath)
-		defer db.Close()
+	searchCommand := cobra.Command{
+		Use:   "search",
+		Short: "search messages in all sessions",
+		Args:  usageArgs(cobra.MinimumNArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionSearch(strings.Join(args, " "))
+		},
 	}
 
-	createdSession := session.NewSession(model, prompt)
+	searchSemantic = searchCommand.Flags().Bool("semantic", false, "Rank messages by semantic similarity using embeddings")
+	searchLimit = searchCommand.Flags().Int("limit", 10, "Maximum number of results")
+	searchModel = searchCommand.Flags().String("embedding-model", embedding.DefaultModel, "Embedding model used for semantic search")
 
-	if err := db.SetSession(sessionName, createdSession); err != nil {
-		return "", session.Session{}, err
-	}
+	sessionCommand.AddCommand(&searchCommand)
 
-	if setDefaultSession {
-		if err := db.SetCurrentSession(sessionName); err != nil {
-			return "", session.Session{}, err
-		}
-	}
+	addSessionLifecycleCommands(&sessionCommand)
 
-	return sessionName, createdSession, nil
+	return &sessionCommand
 }
 
-func SessionList() {
-	db := database.OpenDatabase(*dbPath)
-	defer db.Close()
-
-	sessions, err := db.ListSessions()
+func SessionCreate(name, model, prompt string) (string, error) {
+	client, err := openClient()
 	if err != nil {
-		fmt.Printf("could not list sessions: %v\n", err)
-		os.Exit(1)
+		return "", err
 	}
+	defer client.Close()
 
-	for _, name := range sessions {
-		session, err := db.GetSession(name)
-		if err != nil {
-			fmt.Printf("could not get session %s: %v\n", name, err)
-			os.Exit(1)
-		}
-
-		output := name
+	model, err = checkModel(client, model)
+	if err != nil {
+		return "", err
+	}
 
-		if session.Description != "" {
-			output = fmt.Sprintf("%s - %s", name, session.Description)
-		}
+	sessionName, _, err := client.CreateSession(name, model, prompt, false)
 
-		fmt.Println(output)
-	}
+	return sessionName, err
 }
 
-func SessionGetCurrent() {
-	db := database.OpenDatabase(*dbPath)
-	defer db.Close()
+func SessionGetCurrent() error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 
-	currentSessionName, err := db.GetCurrentSession()
+	currentSessionName, err := client.CurrentSession()
 	if err != nil {
-		fmt.Printf("could not get current session: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
 	fmt.Println(currentSessionName)
+
+	return nil
 }
 
-func SessionSetCurrent(session string) error {
-	db := database.OpenDatabase(*dbPath)
-	defer db.Close()
+func SessionSetCurrent(name string) error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 
-	return db.SetCurrentSession(session)
-}
+	// Only existing sessions can be set as current
+	if _, err := client.Session(name); err != nil {
+		return err
+	}
 
-func SessionDump() {
-	db := database.OpenDatabase(*dbPath)
-	defer db.Close()
+	return client.SetCurrentSession(name)
+}
 
-	currentSessionName, err := db.GetCurrentSession()
+func SessionDump(name string) error {
+	client, err := openClient()
 	if err != nil {
-		fmt.Printf("could not get current session: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	defer client.Close()
+
+	label := "Session"
+	if name == "" {
+		if name, err = client.CurrentSession(); err != nil {
+			return err
+		}
+		label = "Current session"
 	}
 
-	session, err := db.GetSession(currentSessionName)
+	session, err := client.Session(name)
 	if err != nil {
-		fmt.Printf("could not retrieve session details: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	fmt.Printf("Current session: %s\n", currentSessionName)
+	fmt.Printf("%s: %s\n", label, name)
 	fmt.Printf("Model: %s\n", session.Model)
 
 	if session.Description != "" {
 		fmt.Printf("Description: %s\n", session.Description)
 	}
 
+	if !session.Created.IsZero() {
+		fmt.Printf("Created: %s\n", session.Created.Format(time.DateTime))
+		fmt.Printf("Updated: %s\n", session.Updated.Format(time.DateTime))
+	}
+
+	if session.Archived {
+		fmt.Println("Archived: yes")
+	}
+
 	fmt.Println()
 
 	for _, message := range session.Messages {
 		fmt.Printf("%s> %s\n", message.Role, message.Content)
 	}
-}
 
-func SessionConfigure() error {
-	db := database.OpenDatabase(*dbPath)
-	defer db.Close()
+	return nil
+}
 
-	currentSessionName, err := db.GetCurrentSession()
+func SessionConfigure(name string) error {
+	client, err := openClient()
 	if err != nil {
-		fmt.Printf("could not get current session: %v\n", err)
-		os.Exit(1)
+		return err
 	}
+	defer client.Close()
 
-	session, err := db.GetSession(currentSessionName)
-	if err != nil {
-		fmt.Printf("could not retrieve session details: %v\n", err)
-		os.Exit(1)
+	if name == "" {
+		if name, err = client.CurrentSession(); err != nil {
+			return err
+		}
 	}
 
-	if *configDescription != "" {
-		session.Description = *configDescription
+	model := *configModel
+	if model != "" {
+		if model, err = checkModel(client, model); err != nil {
+			return err
+		}
 	}
 
-	if *configModel != "" {
-		session.Model = *configModel
+	for _, tag := range *configTags {
+		if tag == "" || strings.ContainsAny(tag, ", \t\n") {
+			return errUsage("invalid tag %q: tags can't be empty nor hold commas or spaces", tag)
+		}
 	}
 
-	if *configPrompt != "" {
-		session.Messages[0].Content = *configPrompt
-	}
+	err = client.UpdateSession(name, func(session *asoai.Session) error {
+		if *configDescription != "" {
+			session.Description = *configDescription
+		}
 
-	if *configRename != "" {
-		if err = db.DeleteSession(currentSessionName); err != nil {
-			fmt.Printf("could not rename session: %v\n", err)
-			os.Exit(1)
+		if model != "" {
+			session.Model = model
 		}
 
-		currentSessionName = *configRename
-	}
+		for _, tag := range *configTags {
+			if !session.HasTag(tag) {
+				session.Tags = append(session.Tags, tag)
+			}
+		}
+
+		session.Tags = slices.DeleteFunc(session.Tags, func(tag string) bool {
+			return slices.Contains(*configUntags, tag)
+		})
+
+		if *configPrompt != "" {
+			if len(session.Messages) == 0 {
+				return fmt.Errorf("session %s has no system prompt", name)
+			}
+			session.Messages[0].Content = *configPrompt
+		}
 
-	err = db.SetSession(currentSessionName, session)
+		return nil
+	})
 	if err != nil {
-		fmt.Printf("could not save session: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	db.SetCurrentSession(currentSessionName)
+	if *configRename != "" {
+		if err = client.RenameSession(name, *configRename); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// Returns the first argument, or an empty string if there is none
+func optionalArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
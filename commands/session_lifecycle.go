@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+var (
+	rmOlderThan *string
+	rmYes       *bool
+)
+
+// Adds commands removing, renaming, copying and archiving sessions
+func addSessionLifecycleCommands(sessionCommand *cobra.Command) {
+	rmCommand := cobra.Command{
+		Use:               "rm [<name>...]",
+		Short:             "remove sessions",
+		Args:              usageArgs(cobra.ArbitraryArgs),
+		ValidArgsFunction: completeSession,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionRemove(args, *rmOlderThan, *rmYes)
+		},
+	}
+
+	rmOlderThan = rmCommand.Flags().String("all-older-than", "", "Remove all sessions without messages for this long, e.g. 30d, 2w or 12h")
+	rmYes = rmCommand.Flags().Bool("yes", false, "Do not ask for confirmation")
+	sessionCommand.AddCommand(&rmCommand)
+
+	sessionCommand.AddCommand(&cobra.Command{
+		Use:               "mv <name> <new-name>",
+		Short:             "rename a session",
+		Args:              usageArgs(cobra.ExactArgs(2)),
+		ValidArgsFunction: completeFirstArg(completeSession),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionMove(args[0], args[1])
+		},
+	})
+
+	sessionCommand.AddCommand(&cobra.Command{
+		Use:               "cp <name> <new-name>",
+		Short:             "copy a session",
+		Args:              usageArgs(cobra.ExactArgs(2)),
+		ValidArgsFunction: completeFirstArg(completeSession),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionCopy(args[0], args[1])
+		},
+	})
+
+	sessionCommand.AddCommand(&cobra.Command{
+		Use:               "archive <name>...",
+		Short:             "hide sessions from session list",
+		Args:              usageArgs(cobra.MinimumNArgs(1)),
+		ValidArgsFunction: completeSession,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionArchive(args, true)
+		},
+	})
+
+	sessionCommand.AddCommand(&cobra.Command{
+		Use:               "unarchive <name>...",
+		Short:             "show archived sessions in session list again",
+		Args:              usageArgs(cobra.MinimumNArgs(1)),
+		ValidArgsFunction: completeSession,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionArchive(args, false)
+		},
+	})
+}
+
+func SessionRemove(names []string, olderThan string, yes bool) error {
+	if (len(names) == 0) == (olderThan == "") {
+		return errUsage("give either session names or --all-older-than")
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if olderThan != "" {
+		age, err := parseAge(olderThan)
+		if err != nil {
+			return errUsage("invalid --all-older-than: %v", err)
+		}
+
+		if names, err = sessionsOlderThan(client, time.Now().Add(-age)); err != nil {
+			return err
+		}
+
+		if len(names) == 0 {
+			fmt.Println("no session to remove")
+			return nil
+		}
+	} else {
+		// Sessions are checked first, so none is removed if a name is wrong
+		for _, name := range names {
+			if _, err := client.Session(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	question := fmt.Sprintf("remove session %s?", names[0])
+	if len(names) > 1 {
+		question = fmt.Sprintf("remove %d sessions (%s)?", len(names), strings.Join(names, ", "))
+	}
+
+	if !yes && !confirm(question) {
+		return errUsage("removal not confirmed")
+	}
+
+	for _, name := range names {
+		if err := client.DeleteSession(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns names of sessions whose last message is older than limit
+func sessionsOlderThan(client *asoai.Client, limit time.Time) ([]string, error) {
+	infos, err := client.SessionInfos()
+	if err != nil {
+		return nil, err
+	}
+
+	old := []string{}
+	for _, info := range infos {
+		if !info.Updated.IsZero() && info.Updated.Before(limit) {
+			old = append(old, info.Name)
+		}
+	}
+
+	return old, nil
+}
+
+// Parses a duration, also accepting days (30d) and weeks (2w)
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if count, ok := strings.CutSuffix(s, suffix); ok {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid duration %s", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	age, err := time.ParseDuration(s)
+	if err == nil && age < 0 {
+		return 0, errors.New("negative duration")
+	}
+
+	return age, err
+}
+
+func SessionMove(name, newName string) error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.RenameSession(name, newName)
+}
+
+func SessionCopy(name, newName string) error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.CopySession(name, newName)
+}
+
+func SessionArchive(names []string, archived bool) error {
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	for _, name := range names {
+		if err := client.SetArchived(name, archived); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+var (
+	listAll   *bool
+	listSort  *string
+	listModel *string
+	listSince *string
+	listLimit *int
+	listTags  *[]string
+	listJSON  *bool
+)
+
+func newSessionListCommand() *cobra.Command {
+	listCommand := cobra.Command{
+		Use:   "list",
+		Short: "list existing sessions",
+		Long:  "list sessions with their model, number of messages, estimated tokens and times; the current one is marked with *",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SessionList()
+		},
+	}
+
+	listAll = listCommand.Flags().Bool("all", false, "Also list archived sessions")
+	listSort = listCommand.Flags().String("sort", "updated", "Sort by updated (latest first), name or size (largest first)")
+	listModel = listCommand.Flags().String("model", "", "Only list sessions using this model")
+	listSince = listCommand.Flags().String("since", "", "Only list sessions updated since a date (2024-05-20) or for a duration (7d, 12h)")
+	listLimit = listCommand.Flags().Int("limit", 0, "Maximum number of sessions listed (0 for no limit)")
+	listTags = listCommand.Flags().StringArray("tag", nil, "Only list sessions having this tag (can be repeated)")
+	listJSON = listCommand.Flags().Bool("json", false, "Print sessions as JSON")
+
+	listCommand.RegisterFlagCompletionFunc("sort", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"updated", "name", "size"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	listCommand.RegisterFlagCompletionFunc("model", completeModel)
+
+	return &listCommand
+}
+
+// A listed session
+type sessionListItem struct {
+	asoai.SessionInfo
+	Tokens  int  `json:"tokens"`
+	Current bool `json:"current"`
+}
+
+func SessionList() error {
+	if !slices.Contains([]string{"updated", "name", "size"}, *listSort) {
+		return errUsage("invalid --sort %s (updated, name or size)", *listSort)
+	}
+
+	var since time.Time
+	if *listSince != "" {
+		var err error
+		if since, err = parseSince(*listSince); err != nil {
+			return errUsage("invalid --since: %v", err)
+		}
+	}
+
+	client, err := openClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	infos, err := client.SessionInfos()
+	if err != nil {
+		return err
+	}
+
+	current, err := client.CurrentSession()
+	if err != nil && !errors.Is(err, asoai.ErrNoCurrentSession) {
+		return err
+	}
+
+	model := ""
+	if *listModel != "" {
+		model = client.ResolveModel(*listModel)
+	}
+
+	items := listSessions(infos, current, sessionFilter{
+		all:   *listAll,
+		model: model,
+		since: since,
+		tags:  *listTags,
+		sort:  *listSort,
+		limit: *listLimit,
+	})
+
+	if *listJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(items)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tNAME\tMODEL\tMESSAGES\tTOKENS\tCREATED\tUPDATED\tTAGS\tDESCRIPTION")
+
+	for _, item := range items {
+		marker := ""
+		if item.Current {
+			marker = "*"
+		}
+
+		description := item.Description
+		if item.Archived {
+			description = strings.TrimSpace(description + " (archived)")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t~%d\t%s\t%s\t%s\t%s\n", marker, item.Name, item.Model, item.Messages, item.Tokens,
+			formatListTime(item.Created), formatListTime(item.Updated), strings.Join(item.Tags, ","), description)
+	}
+
+	return w.Flush()
+}
+
+// Sessions listed, and their order
+type sessionFilter struct {
+	// Also list archived sessions
+	all bool
+	// Only list sessions of this model, and updated since this time, if set
+	model string
+	since time.Time
+	// Only list sessions having all these tags
+	tags []string
+	// updated, name or size
+	sort string
+	// Maximum number of sessions listed; no limit if 0
+	limit int
+}
+
+// Returns the items of sessions listed by name, filtered and sorted
+func listSessions(infos []asoai.SessionInfo, current string, filter sessionFilter) []sessionListItem {
+	items := []sessionListItem{}
+	for _, info := range infos {
+		if info.Archived && !filter.all {
+			continue
+		}
+
+		if filter.model != "" && info.Model != filter.model {
+			continue
+		}
+
+		if !filter.since.IsZero() && info.Updated.Before(filter.since) {
+			continue
+		}
+
+		if slices.ContainsFunc(filter.tags, func(tag string) bool { return !info.HasTag(tag) }) {
+			continue
+		}
+
+		items = append(items, sessionListItem{
+			SessionInfo: info,
+			Tokens:      info.Tokens(),
+			Current:     info.Name == current,
+		})
+	}
+
+	// Sessions are listed by name, so sorting is stable on it
+	switch filter.sort {
+	case "updated":
+		slices.SortStableFunc(items, func(a, b sessionListItem) int {
+			return b.Updated.Compare(a.Updated)
+		})
+	case "size":
+		slices.SortStableFunc(items, func(a, b sessionListItem) int {
+			return b.Size - a.Size
+		})
+	}
+
+	if filter.limit > 0 && len(items) > filter.limit {
+		items = items[:filter.limit]
+	}
+
+	return items
+}
+
+// Returns the time a --since value stands for: a date, or a duration before
+// now
+func parseSince(s string) (time.Time, error) {
+	if date, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return date, nil
+	}
+
+	age, err := parseAge(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Now().Add(-age), nil
+}
+
+func formatListTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+func TestListSessions(t *testing.T) {
+	now := time.Date(2024, 5, 20, 12, 0, 0, 0, time.UTC)
+
+	// Listed by name, as by the database
+	infos := []asoai.SessionInfo{
+		{Name: "alpha", Model: "gpt-4o", Updated: now.Add(-48 * time.Hour), Size: 400, Tags: []string{"work", "go"}},
+		{Name: "beta", Model: "gpt-4o-mini", Updated: now, Size: 40, Tags: []string{"work"}},
+		{Name: "delta", Model: "gpt-4o", Updated: now.Add(-time.Hour), Size: 4000},
+		{Name: "gamma", Model: "gpt-4o", Updated: now.Add(-time.Hour), Size: 400, Archived: true, Tags: []string{"go"}},
+	}
+
+	tests := []struct {
+		name     string
+		filter   sessionFilter
+		expected []string
+	}{
+		{"by name", sessionFilter{sort: "name"}, []string{"alpha", "beta", "delta"}},
+		{"archived", sessionFilter{sort: "name", all: true}, []string{"alpha", "beta", "delta", "gamma"}},
+		{"by update", sessionFilter{sort: "updated", all: true}, []string{"beta", "delta", "gamma", "alpha"}},
+		{"by size", sessionFilter{sort: "size", all: true}, []string{"delta", "alpha", "gamma", "beta"}},
+		{"model", sessionFilter{sort: "name", model: "gpt-4o"}, []string{"alpha", "delta"}},
+		{"since", sessionFilter{sort: "name", since: now.Add(-2 * time.Hour)}, []string{"beta", "delta"}},
+		{"since included", sessionFilter{sort: "name", since: now}, []string{"beta"}},
+		{"tag", sessionFilter{sort: "name", tags: []string{"work"}}, []string{"alpha", "beta"}},
+		{"tags", sessionFilter{sort: "name", tags: []string{"work", "go"}}, []string{"alpha"}},
+		{"archived tag", sessionFilter{sort: "name", all: true, tags: []string{"go"}}, []string{"alpha", "gamma"}},
+		{"unknown tag", sessionFilter{sort: "name", tags: []string{"home"}}, []string{}},
+		{"limit", sessionFilter{sort: "updated", limit: 2}, []string{"beta", "delta"}},
+		{"limit above count", sessionFilter{sort: "name", limit: 10}, []string{"alpha", "beta", "delta"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			names := []string{}
+			for _, item := range listSessions(infos, "beta", test.filter) {
+				names = append(names, item.Name)
+
+				if item.Current != (item.Name == "beta") {
+					t.Errorf("%s: got current %v", item.Name, item.Current)
+				}
+				if item.Tokens != item.Size/4 {
+					t.Errorf("%s: got %d tokens", item.Name, item.Tokens)
+				}
+			}
+
+			if !slices.Equal(names, test.expected) {
+				t.Errorf("got %v, expected %v", names, test.expected)
+			}
+		})
+	}
+}
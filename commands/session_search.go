@@ -0,0 +1,271 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+
+	"git.mkz.me/mycroft/asoai/internal/database"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+// Number of characters of a message displayed in search results
+const snippetLength = 100
+
+type searchResult struct {
+	session string
+	index   int
+	message session.Message
+	score   float64
+}
+
+// A message waiting to be embedded
+type pendingEmbedding struct {
+	session string
+	index   int
+	content string
+}
+
+func SessionSearch(query string) error {
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var results []searchResult
+
+	if *searchSemantic {
+		results, err = semanticSearch(db, query)
+	} else {
+		results, err = keywordSearch(db, query)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *searchLimit > 0 && len(results) > *searchLimit {
+		results = results[:*searchLimit]
+	}
+
+	for _, result := range results {
+		if *searchSemantic {
+			fmt.Printf("%s #%d %s (%.3f): %s\n", result.session, result.index, result.message.Role, result.score, snippet(result.message.Content, ""))
+		} else {
+			fmt.Printf("%s #%d %s: %s\n", result.session, result.index, result.message.Role, snippet(result.message.Content, query))
+		}
+	}
+
+	return nil
+}
+
+// Returns messages containing the query, ignoring case, in session order
+func keywordSearch(db database.Store, query string) ([]searchResult, error) {
+	results := []searchResult{}
+	needle := strings.ToLower(query)
+
+	err := forEachSession(db, func(name string, s session.Session) error {
+		for index, message := range s.Messages {
+			if isSearchable(message) && strings.Contains(strings.ToLower(message.Content), needle) {
+				results = append(results, searchResult{
+					session: name,
+					index:   index,
+					message: message,
+				})
+			}
+		}
+
+		return nil
+	})
+
+	return results, err
+}
+
+// Returns messages ranked by cosine similarity with the query. Embeddings of
+// messages are cached in the database; only new or modified messages are
+// sent to the API.
+func semanticSearch(db database.Store, query string) ([]searchResult, error) {
+	client, err := newOpenAIClient()
+	if err != nil {
+		return nil, err
+	}
+	model := *searchModel
+
+	sessions := map[string]session.Session{}
+	cached := map[string]map[int]embedding.Embedding{}
+	pending := []pendingEmbedding{}
+
+	err = forEachSession(db, func(name string, s session.Session) error {
+		embeddings, err := db.GetEmbeddings(name)
+		if err != nil {
+			return err
+		}
+
+		sessions[name] = s
+		cached[name] = embeddings
+
+		for index, message := range s.Messages {
+			if !isSearchable(message) {
+				continue
+			}
+
+			if e, ok := embeddings[index]; ok && e.Matches(model, message.Content) {
+				continue
+			}
+
+			pending = append(pending, pendingEmbedding{
+				session: name,
+				index:   index,
+				content: message.Content,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := []string{query}
+	for _, p := range pending {
+		inputs = append(inputs, p.content)
+	}
+
+	vectors, err := embedding.Create(context.Background(), client, model, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	queryVector := vectors[0]
+
+	updated := map[string]map[int]embedding.Embedding{}
+	for i, p := range pending {
+		e := embedding.Embedding{
+			Model:  model,
+			Hash:   embedding.Hash(p.content),
+			Vector: vectors[i+1],
+		}
+
+		if updated[p.session] == nil {
+			updated[p.session] = map[int]embedding.Embedding{}
+		}
+		updated[p.session][p.index] = e
+		cached[p.session][p.index] = e
+	}
+
+	for name, embeddings := range updated {
+		if err := db.SetEmbeddings(name, embeddings); err != nil {
+			return nil, err
+		}
+	}
+
+	results := []searchResult{}
+	for name, s := range sessions {
+		for index, message := range s.Messages {
+			e, ok := cached[name][index]
+			if !isSearchable(message) || !ok || !e.Matches(model, message.Content) {
+				continue
+			}
+
+			results = append(results, searchResult{
+				session: name,
+				index:   index,
+				message: message,
+				score:   embedding.CosineSimilarity(queryVector, e.Vector),
+			})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].score > results[j].score
+	})
+
+	return results, nil
+}
+
+// Calls fn for every session stored in database, stopping on first error
+func forEachSession(db database.Store, fn func(name string, s session.Session) error) error {
+	names, err := db.ListSessions()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		s, err := db.GetSession(name)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(name, s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// System prompts are not part of conversations and are not searched
+func isSearchable(message session.Message) bool {
+	return message.Role != openai.ChatMessageRoleSystem && strings.TrimSpace(message.Content) != ""
+}
+
+// Returns a single line extract of content, centered on the first occurrence
+// of needle if given
+func snippet(content, needle string) string {
+	content = strings.Join(strings.Fields(content), " ")
+
+	start := 0
+	if needle != "" {
+		if pos := indexFold(content, needle); pos > snippetLength/2 {
+			start = pos - snippetLength/2
+		}
+	}
+
+	for start > 0 && !utf8.RuneStart(content[start]) {
+		start--
+	}
+
+	runes := []rune(content[start:])
+	if len(runes) <= snippetLength {
+		return prefixEllipsis(start) + string(runes)
+	}
+
+	return prefixEllipsis(start) + string(runes[:snippetLength]) + "..."
+}
+
+// Returns the byte index in s of the first match of needle ignoring case, or
+// -1. Lower-casing s could change its length, so runes are compared instead.
+func indexFold(s, needle string) int {
+	for i := range s {
+		rest := s[i:]
+		matched := true
+
+		for _, r := range needle {
+			c, size := utf8.DecodeRuneInString(rest)
+			if size == 0 || (c != r && unicode.ToLower(c) != unicode.ToLower(r) && unicode.ToUpper(c) != unicode.ToUpper(r)) {
+				matched = false
+				break
+			}
+			rest = rest[size:]
+		}
+
+		if matched {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func prefixEllipsis(start int) string {
+	if start > 0 {
+		return "..."
+	}
+	return ""
+}
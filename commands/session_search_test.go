@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSnippet(t *testing.T) {
+	long := strings.Repeat("a ", 60)
+
+	tests := []struct {
+		name, content, needle, expected string
+	}{
+		{"short", "Hello  world", "world", "Hello world"},
+		{"no match", long + "end", "zzz", strings.TrimSpace(strings.Repeat("a ", 50)) + " ..."},
+		{"match far", long + "Needle", "needle", "..." + strings.Repeat("a ", 25) + "Needle"},
+		// Lower-cased, "İ" is longer
+		{"longer lower case", strings.Repeat("İ", 60) + " needle", "NEEDLE", "..." + strings.Repeat("İ", 25) + " needle"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := snippet(test.content, test.needle); got != test.expected {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestIndexFold(t *testing.T) {
+	for _, test := range []struct {
+		s, needle string
+		expected  int
+	}{
+		{"Hello World", "world", 6},
+		{"Hello World", "WORLD", 6},
+		{"İİ needle", "NEEDLE", 5},
+		{"straße", "STRASSE", -1},
+		{"abc", "abcd", -1},
+		{"abc", "", 0},
+	} {
+		if got := indexFold(test.s, test.needle); got != test.expected {
+			t.Errorf("indexFold(%q, %q): got %d, expected %d", test.s, test.needle, got, test.expected)
+		}
+	}
+}
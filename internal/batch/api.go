@@ -0,0 +1,372 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Job is a batch submitted to the Batch API, as tracked locally
+type Job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Local file the prompts were read from
+	Input        string    `json:"input"`
+	InputFileID  string    `json:"input_file_id"`
+	OutputFileID string    `json:"output_file_id,omitempty"`
+	ErrorFileID  string    `json:"error_file_id,omitempty"`
+	Created      time.Time `json:"created"`
+	Total        int       `json:"total"`
+	Completed    int       `json:"completed"`
+	Failed       int       `json:"failed"`
+}
+
+// Returns true once the batch won't change anymore
+func (j Job) Done() bool {
+	switch j.Status {
+	case "completed", "failed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+// Request is a line of a batch input file
+type Request struct {
+	CustomID string                       `json:"custom_id"`
+	Method   string                       `json:"method"`
+	URL      string                       `json:"url"`
+	Body     openai.ChatCompletionRequest `json:"body"`
+}
+
+// API is a client of the files and batches endpoints
+type API struct {
+	// Base URL of the API, e.g. https://api.openai.com/v1
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// Batch as returned by the API
+type apiBatch struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	InputFileID   string `json:"input_file_id"`
+	OutputFileID  string `json:"output_file_id"`
+	ErrorFileID   string `json:"error_file_id"`
+	CreatedAt     int64  `json:"created_at"`
+	RequestCounts struct {
+		Total     int `json:"total"`
+		Completed int `json:"completed"`
+		Failed    int `json:"failed"`
+	} `json:"request_counts"`
+}
+
+func (b apiBatch) job() Job {
+	return Job{
+		ID:           b.ID,
+		Status:       b.Status,
+		InputFileID:  b.InputFileID,
+		OutputFileID: b.OutputFileID,
+		ErrorFileID:  b.ErrorFileID,
+		Created:      time.Unix(b.CreatedAt, 0),
+		Total:        b.RequestCounts.Total,
+		Completed:    b.RequestCounts.Completed,
+		Failed:       b.RequestCounts.Failed,
+	}
+}
+
+// Uploads the requests as a batch input file and creates the batch
+func (a *API) Submit(ctx context.Context, requests []Request) (Job, error) {
+	var content bytes.Buffer
+
+	encoder := json.NewEncoder(&content)
+	for _, request := range requests {
+		if err := encoder.Encode(request); err != nil {
+			return Job{}, err
+		}
+	}
+
+	fileID, err := a.uploadFile(ctx, "batch.jsonl", content.Bytes())
+	if err != nil {
+		return Job{}, err
+	}
+
+	var created apiBatch
+
+	err = a.do(ctx, http.MethodPost, "/batches", map[string]string{
+		"input_file_id":     fileID,
+		"endpoint":          "/v1/chat/completions",
+		"completion_window": "24h",
+	}, &created)
+	if err != nil {
+		return Job{}, fmt.Errorf("could not create batch: %w", err)
+	}
+
+	return created.job(), nil
+}
+
+// Returns the current state of the batch
+func (a *API) Get(ctx context.Context, id string) (Job, error) {
+	var found apiBatch
+
+	if err := a.do(ctx, http.MethodGet, "/batches/"+id, nil, &found); err != nil {
+		return Job{}, fmt.Errorf("could not get batch %s: %w", id, err)
+	}
+
+	return found.job(), nil
+}
+
+// Returns results of a done batch, from its output and error files
+func (a *API) Results(ctx context.Context, job Job) ([]Result, error) {
+	results := []Result{}
+
+	for _, fileID := range []string{job.OutputFileID, job.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+
+		content, err := a.fileContent(ctx, fileID)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed, err := parseResults(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid results file %s: %w", fileID, err)
+		}
+
+		results = append(results, parsed...)
+	}
+
+	return results, nil
+}
+
+// Returns results in the order of items; results of unknown ids come last
+func SortResults(results []Result, items []Item) []Result {
+	order := map[string]int{}
+	for index, item := range items {
+		order[item.ID] = index
+	}
+
+	sorted := slices.Clone(results)
+	slices.SortStableFunc(sorted, func(a, b Result) int {
+		ia, ok := order[a.ID]
+		if !ok {
+			ia = len(items)
+		}
+		ib, ok := order[b.ID]
+		if !ok {
+			ib = len(items)
+		}
+		return ia - ib
+	})
+
+	return sorted
+}
+
+// Line of batch output and error files
+type apiResult struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int             `json:"status_code"`
+		Body       json.RawMessage `json:"body"`
+	} `json:"response"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func parseResults(content []byte) ([]Result, error) {
+	results := []Result{}
+
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var r apiResult
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, err
+		}
+
+		result := Result{ID: r.CustomID}
+
+		switch {
+		case r.Error != nil:
+			result.Error = r.Error.Message
+		case r.Response == nil:
+			result.Error = "no response"
+		case r.Response.StatusCode != http.StatusOK:
+			var body struct {
+				Error struct {
+					Message string `json:"message"`
+				} `json:"error"`
+			}
+			json.Unmarshal(r.Response.Body, &body)
+			result.Error = fmt.Sprintf("status code %d: %s", r.Response.StatusCode, body.Error.Message)
+		default:
+			var resp openai.ChatCompletionResponse
+			if err := json.Unmarshal(r.Response.Body, &resp); err != nil {
+				return nil, err
+			}
+
+			result.Model = resp.Model
+			result.Usage = &Usage{
+				PromptTokens:     resp.Usage.PromptTokens,
+				CompletionTokens: resp.Usage.CompletionTokens,
+				TotalTokens:      resp.Usage.TotalTokens,
+			}
+
+			if len(resp.Choices) > 0 {
+				result.Content = resp.Choices[0].Message.Content
+			} else {
+				result.Error = "empty response"
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (a *API) uploadFile(ctx context.Context, name string, content []byte) (string, error) {
+	var body bytes.Buffer
+
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "batch")
+
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		return "", err
+	}
+	part.Write(content)
+
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := a.newRequest(ctx, http.MethodPost, "/files", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	var file struct {
+		ID string `json:"id"`
+	}
+
+	if err := a.send(req, &file); err != nil {
+		return "", fmt.Errorf("could not upload batch file: %w", err)
+	}
+
+	return file.ID, nil
+}
+
+func (a *API) fileContent(ctx context.Context, fileID string) ([]byte, error) {
+	req, err := a.newRequest(ctx, http.MethodGet, "/files/"+fileID+"/content", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not download file %s: %w", fileID, err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("could not download file %s: %w", fileID, err)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// Sends a JSON request and decodes the JSON response into v
+func (a *API) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+
+	req, err := a.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	return a.send(req, out)
+}
+
+func (a *API) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	baseURL := a.BaseURL
+	if baseURL == "" {
+		baseURL = openai.DefaultConfig("").BaseURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(baseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.APIKey)
+
+	return req, nil
+}
+
+func (a *API) send(req *http.Request, out any) error {
+	resp, err := a.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (a *API) httpClient() *http.Client {
+	if a.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return a.HTTPClient
+}
+
+// Returns an *openai.APIError if the response is an error
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	var body struct {
+		Error *openai.APIError `json:"error"`
+	}
+
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body) != nil || body.Error == nil {
+		return &openai.APIError{HTTPStatusCode: resp.StatusCode, Message: resp.Status}
+	}
+
+	body.Error.HTTPStatusCode = resp.StatusCode
+
+	return body.Error
+}
@@ -0,0 +1,177 @@
+package batch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Returns a fake Batch API, whose batch b1 is completed, and the requests of
+// the input file it received
+func newTestAPI(t *testing.T) (*API, *[]Request) {
+	t.Helper()
+
+	received := []Request{}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /files", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("purpose") != "batch" {
+			http.Error(w, "invalid purpose", http.StatusBadRequest)
+			return
+		}
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		decoder := json.NewDecoder(file)
+		for decoder.More() {
+			var request Request
+			if err := decoder.Decode(&request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			received = append(received, request)
+		}
+
+		fmt.Fprint(w, `{"id":"file-in"}`)
+	})
+
+	mux.HandleFunc("POST /batches", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body["input_file_id"] != "file-in" || body["endpoint"] != "/v1/chat/completions" {
+			http.Error(w, "invalid batch", http.StatusBadRequest)
+			return
+		}
+
+		fmt.Fprintf(w, `{"id":"b1","status":"validating","input_file_id":"file-in","created_at":1700000000,"request_counts":{"total":%d}}`, len(received))
+	})
+
+	mux.HandleFunc("GET /batches/b1", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"b1","status":"completed","input_file_id":"file-in","output_file_id":"file-out","error_file_id":"file-err",`+
+			`"created_at":1700000000,"request_counts":{"total":3,"completed":2,"failed":1}}`)
+	})
+
+	mux.HandleFunc("GET /batches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"message":"No batch found","type":"invalid_request_error"}}`)
+	})
+
+	mux.HandleFunc("GET /files/file-out/content", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"custom_id":"b","response":{"status_code":200,"body":{"model":"gpt-4o","choices":[{"message":{"role":"assistant","content":"reply b"}}],"usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}}}`)
+		fmt.Fprintln(w, `{"custom_id":"a","response":{"status_code":429,"body":{"error":{"message":"rate limited"}}}}`)
+	})
+
+	mux.HandleFunc("GET /files/file-err/content", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"custom_id":"c","error":{"code":"invalid","message":"invalid request"}}`)
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":{"message":"invalid key"}}`)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return &API{BaseURL: server.URL, APIKey: "sk-test", HTTPClient: server.Client()}, &received
+}
+
+func TestSubmit(t *testing.T) {
+	api, received := newTestAPI(t)
+
+	requests := []Request{}
+	for _, id := range []string{"a", "b"} {
+		requests = append(requests, Request{
+			CustomID: id,
+			Method:   "POST",
+			URL:      "/v1/chat/completions",
+			Body: openai.ChatCompletionRequest{
+				Model:    "gpt-4o",
+				Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "prompt " + id}},
+			},
+		})
+	}
+
+	job, err := api.Submit(context.Background(), requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.ID != "b1" || job.Status != "validating" || job.InputFileID != "file-in" || job.Total != 2 || job.Created.Unix() != 1700000000 {
+		t.Errorf("unexpected job %+v", job)
+	}
+
+	if len(*received) != 2 || (*received)[1].CustomID != "b" || (*received)[1].Body.Messages[0].Content != "prompt b" {
+		t.Errorf("unexpected input file %+v", *received)
+	}
+}
+
+func TestGet(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	job, err := api.Get(context.Background(), "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !job.Done() || job.OutputFileID != "file-out" || job.ErrorFileID != "file-err" || job.Completed != 2 || job.Failed != 1 {
+		t.Errorf("unexpected job %+v", job)
+	}
+
+	var apiErr *openai.APIError
+	if _, err := api.Get(context.Background(), "missing"); !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusNotFound || apiErr.Message != "No batch found" {
+		t.Errorf("got error %v", err)
+	}
+
+	api.APIKey = "sk-wrong"
+	if _, err := api.Get(context.Background(), "b1"); !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusUnauthorized {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestResults(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	job, err := api.Get(context.Background(), "b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := api.Results(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := []Item{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+	results = SortResults(results, items)
+
+	encoded := []string{}
+	for _, result := range results {
+		line, _ := json.Marshal(result)
+		encoded = append(encoded, string(line))
+	}
+
+	expected := []string{
+		`{"id":"a","error":"status code 429: rate limited"}`,
+		`{"id":"b","model":"gpt-4o","content":"reply b","usage":{"prompt_tokens":1,"completion_tokens":2,"total_tokens":3}}`,
+		`{"id":"c","error":"invalid request"}`,
+	}
+
+	if strings.Join(encoded, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got results\n%s\nexpected\n%s", strings.Join(encoded, "\n"), strings.Join(expected, "\n"))
+	}
+}
@@ -0,0 +1,256 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Item is a prompt of the input file
+type Item struct {
+	// Identifier of the item; its line number if not set
+	ID           string            `json:"id"`
+	Prompt       string            `json:"prompt"`
+	SystemPrompt string            `json:"system_prompt,omitempty"`
+	Model        string            `json:"model,omitempty"`
+	Vars         map[string]string `json:"vars,omitempty"`
+}
+
+// Returns the prompt, with {{name}} placeholders replaced by variables
+func (i Item) Text() string {
+	if len(i.Vars) == 0 {
+		return i.Prompt
+	}
+
+	replacements := []string{}
+	for name, value := range i.Vars {
+		replacements = append(replacements, "{{"+name+"}}", value)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(i.Prompt)
+}
+
+// Result is a line of the output file
+type Result struct {
+	ID      string `json:"id"`
+	Model   string `json:"model,omitempty"`
+	Content string `json:"content,omitempty"`
+	Usage   *Usage `json:"usage,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Usage is the number of tokens used by a prompt
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Reads items, one JSON object by line; blank lines are skipped
+func ReadItems(r io.Reader) ([]Item, error) {
+	items := []Item{}
+	ids := map[string]bool{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var item Item
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if item.ID == "" {
+			item.ID = strconv.Itoa(line)
+		}
+
+		if item.Prompt == "" {
+			return nil, fmt.Errorf("line %d: no prompt", line)
+		}
+
+		if ids[item.ID] {
+			return nil, fmt.Errorf("line %d: duplicate id %s", line, item.ID)
+		}
+		ids[item.ID] = true
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// Returns ids of items completed in a previous run of the output file. The
+// file is rewritten without failed or truncated lines, so they are run
+// again.
+func Completed(filePath string) (map[string]bool, error) {
+	completed := map[string]bool{}
+
+	content, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return completed, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read output: %w", err)
+	}
+
+	var kept bytes.Buffer
+
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var result Result
+		if json.Unmarshal(line, &result) != nil || result.ID == "" || result.Error != "" {
+			continue
+		}
+
+		completed[result.ID] = true
+		kept.Write(line)
+		kept.WriteByte('\n')
+	}
+
+	if kept.Len() == len(content) {
+		return completed, nil
+	}
+
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, kept.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("could not rewrite output: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return nil, fmt.Errorf("could not rewrite output: %w", err)
+	}
+
+	return completed, nil
+}
+
+// Options configure a run
+type Options struct {
+	// Number of items processed at once
+	Concurrency int
+	// Maximum number of items started by minute; 0 means no limit
+	RequestsPerMinute int
+}
+
+// Processes items concurrently and writes their results to w, one JSON line
+// by item, in the order of items. Once ctx is canceled, no more item is
+// started; results of items which completed are still written, but not
+// failures, as interrupted items fail.
+func Run(ctx context.Context, items []Item, opts Options, process func(ctx context.Context, item Item) Result, w io.Writer) error {
+	concurrency := max(opts.Concurrency, 1)
+
+	var limiter <-chan time.Time
+	if opts.RequestsPerMinute > 0 {
+		ticker := time.NewTicker(time.Minute / time.Duration(opts.RequestsPerMinute))
+		defer ticker.Stop()
+		limiter = ticker.C
+	}
+
+	type indexed struct {
+		index  int
+		result Result
+	}
+
+	jobs := make(chan int)
+	results := make(chan indexed)
+
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				result := process(ctx, items[index])
+				results <- indexed{index, result}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for index := range items {
+			if limiter != nil && index > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-limiter:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case jobs <- index:
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results completed out of order wait for the previous ones
+	pending := map[int]Result{}
+	next := 0
+	var writeErr error
+
+	write := func(result Result) {
+		if writeErr != nil || (ctx.Err() != nil && result.Error != "") {
+			return
+		}
+
+		encoded, err := json.Marshal(result)
+		if err == nil {
+			_, err = w.Write(append(encoded, '\n'))
+		}
+		if err != nil {
+			writeErr = fmt.Errorf("could not write output: %w", err)
+		}
+	}
+
+	for r := range results {
+		pending[r.index] = r.result
+
+		for {
+			result, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			write(result)
+		}
+	}
+
+	// Once interrupted, items which were not started leave gaps: results
+	// following them are left
+	indexes := []int{}
+	for index := range pending {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	for _, index := range indexes {
+		write(pending[index])
+	}
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return ctx.Err()
+}
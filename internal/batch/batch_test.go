@@ -0,0 +1,201 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		ids   []string
+		err   string
+	}{
+		{"ids", `{"id":"a","prompt":"p"}` + "\n\n" + `{"prompt":"q"}` + "\n", []string{"a", "3"}, ""},
+		{"empty", "\n  \n", []string{}, ""},
+		{"no prompt", `{"id":"a"}`, nil, "line 1: no prompt"},
+		{"duplicate", `{"id":"a","prompt":"p"}` + "\n" + `{"id":"a","prompt":"q"}`, nil, "line 2: duplicate id a"},
+		{"invalid", `{"prompt":"p"}` + "\n" + `{"prompt":`, nil, "line 2:"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, err := ReadItems(strings.NewReader(test.input))
+
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Errorf("got error %v, expected %q", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			ids := []string{}
+			for _, item := range items {
+				ids = append(ids, item.ID)
+			}
+
+			if strings.Join(ids, ",") != strings.Join(test.ids, ",") {
+				t.Errorf("got ids %v, expected %v", ids, test.ids)
+			}
+		})
+	}
+}
+
+func TestItemText(t *testing.T) {
+	item := Item{Prompt: "{{a}} and {{b}}, not {{c}}", Vars: map[string]string{"a": "x", "b": "{{a}}"}}
+
+	if text := item.Text(); text != "x and {{a}}, not {{c}}" {
+		t.Errorf("got %q", text)
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		completed []string
+		rewritten string
+	}{
+		{"complete", `{"id":"a","content":"x"}` + "\n", []string{"a"}, `{"id":"a","content":"x"}` + "\n"},
+		{
+			"failed",
+			`{"id":"a","content":"x"}` + "\n" + `{"id":"b","error":"e"}` + "\n" + `{"id":"c","content":"y"}` + "\n",
+			[]string{"a", "c"},
+			`{"id":"a","content":"x"}` + "\n" + `{"id":"c","content":"y"}` + "\n",
+		},
+		{"truncated", `{"id":"a","content":"x"}` + "\n" + `{"id":"b","con`, []string{"a"}, `{"id":"a","content":"x"}` + "\n"},
+		{"no new line", `{"id":"a","content":"x"}`, []string{"a"}, `{"id":"a","content":"x"}` + "\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), "output.jsonl")
+			if err := os.WriteFile(filePath, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			completed, err := Completed(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(completed) != len(test.completed) {
+				t.Errorf("got %v, expected %v", completed, test.completed)
+			}
+			for _, id := range test.completed {
+				if !completed[id] {
+					t.Errorf("%s not completed", id)
+				}
+			}
+
+			if content, err := os.ReadFile(filePath); err != nil {
+				t.Fatal(err)
+			} else if string(content) != test.rewritten {
+				t.Errorf("got output %q, expected %q", content, test.rewritten)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		completed, err := Completed(filepath.Join(t.TempDir(), "output.jsonl"))
+		if err != nil || len(completed) != 0 {
+			t.Errorf("got %v (%v)", completed, err)
+		}
+	})
+}
+
+// Returns ids of the results written to the output
+func resultIDs(t *testing.T, output []byte) []string {
+	t.Helper()
+
+	ids := []string{}
+	for _, line := range bytes.Split(bytes.TrimSpace(output), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		var result Result
+		if err := json.Unmarshal(line, &result); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, result.ID)
+	}
+
+	return ids
+}
+
+func TestRunOrder(t *testing.T) {
+	items, err := ReadItems(strings.NewReader(strings.Repeat(`{"prompt":"p"}`+"\n", 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+
+	// Later items complete first
+	err = Run(context.Background(), items, Options{Concurrency: 5}, func(ctx context.Context, item Item) Result {
+		line, _ := strconv.Atoi(item.ID)
+		time.Sleep(time.Duration(len(items)-line) * time.Millisecond)
+		return Result{ID: item.ID, Content: "done"}
+	}, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := resultIDs(t, output.Bytes())
+	expected := []string{}
+	for _, item := range items {
+		expected = append(expected, item.ID)
+	}
+
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("got results %v, expected %v", ids, expected)
+	}
+}
+
+func TestRunInterrupted(t *testing.T) {
+	items, err := ReadItems(strings.NewReader(strings.Repeat(`{"prompt":"p"}`+"\n", 5)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var output bytes.Buffer
+
+	err = Run(ctx, items, Options{Concurrency: 2}, func(ctx context.Context, item Item) Result {
+		switch {
+		case ctx.Err() != nil:
+			return Result{ID: item.ID, Error: ctx.Err().Error()}
+		case item.ID == "1":
+			// Interrupted
+			<-ctx.Done()
+			return Result{ID: item.ID, Error: ctx.Err().Error()}
+		case item.ID == "2":
+			// Completes as the run is interrupted
+			cancel()
+			return Result{ID: item.ID, Content: "done"}
+		}
+		return Result{ID: item.ID, Content: "done"}
+	}, &output)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v", err)
+	}
+
+	if ids := resultIDs(t, output.Bytes()); len(ids) != 1 || ids[0] != "2" {
+		t.Errorf("got results %v, expected the completed one", ids)
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Number of entries kept when no limit is configured
+const DefaultMaxEntries = 1000
+
+// Entry is a reply cached for a request
+type Entry struct {
+	Role    string    `json:"role"`
+	Content string    `json:"content"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Returns true if the entry expired at given time
+func (e Entry) Expired(now time.Time) bool {
+	return !now.Before(e.Expires)
+}
+
+// Stats describe the content of the cache
+type Stats struct {
+	Entries int
+	Expired int
+	// Size of cached replies, in bytes
+	Size   int64
+	Oldest time.Time
+	Newest time.Time
+}
+
+// Adds an entry to the stats
+func (s *Stats) Add(e Entry, now time.Time) {
+	s.Entries++
+	s.Size += int64(len(e.Content))
+
+	if e.Expired(now) {
+		s.Expired++
+	}
+
+	if s.Oldest.IsZero() || e.Created.Before(s.Oldest) {
+		s.Oldest = e.Created
+	}
+
+	if e.Created.After(s.Newest) {
+		s.Newest = e.Created
+	}
+}
+
+// Returns the key of a request: a hash of the request, ignoring whether the
+// reply is streamed. Requests with the same model, messages and sampling
+// parameters share a key.
+func Key(req openai.ChatCompletionRequest) (string, error) {
+	req.Stream = false
+	req.StreamOptions = nil
+
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(encoded)
+
+	return hex.EncodeToString(hash[:]), nil
+}
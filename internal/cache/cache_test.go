@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestKey(t *testing.T) {
+	request := func(update func(req *openai.ChatCompletionRequest)) openai.ChatCompletionRequest {
+		req := openai.ChatCompletionRequest{
+			Model:    "gpt-4o",
+			Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}},
+		}
+		update(&req)
+		return req
+	}
+
+	base, err := Key(request(func(req *openai.ChatCompletionRequest) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		update func(req *openai.ChatCompletionRequest)
+		same   bool
+	}{
+		{"stream", func(req *openai.ChatCompletionRequest) { req.Stream = true }, true},
+		{"stream options", func(req *openai.ChatCompletionRequest) {
+			req.Stream = true
+			req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+		}, true},
+		{"model", func(req *openai.ChatCompletionRequest) { req.Model = "gpt-4o-mini" }, false},
+		{"message", func(req *openai.ChatCompletionRequest) { req.Messages[0].Content = "hello" }, false},
+		{"temperature", func(req *openai.ChatCompletionRequest) { req.Temperature = 0.5 }, false},
+		{"max tokens", func(req *openai.ChatCompletionRequest) { req.MaxTokens = 100 }, false},
+	}
+
+	for _, test := range tests {
+		key, err := Key(request(test.update))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (key == base) != test.same {
+			t.Errorf("%s: got key %s for %s, expected same key: %v", test.name, key, base, test.same)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	now := time.Now()
+
+	entries := []Entry{
+		{Content: "hello", Created: now.Add(-time.Hour), Expires: now},
+		{Content: "hi", Created: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)},
+		{Content: "hey", Created: now.Add(-time.Minute), Expires: now.Add(-time.Second)},
+	}
+
+	var stats Stats
+	for _, e := range entries {
+		stats.Add(e, now)
+	}
+
+	// Entries expire at their expiration time
+	if stats.Entries != 3 || stats.Expired != 2 || stats.Size != 10 {
+		t.Errorf("got %d entries, %d expired, %d bytes", stats.Entries, stats.Expired, stats.Size)
+	}
+
+	if !stats.Oldest.Equal(now.Add(-2*time.Hour)) || !stats.Newest.Equal(now.Add(-time.Minute)) {
+		t.Errorf("got oldest %v and newest %v", stats.Oldest, stats.Newest)
+	}
+}
@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Characters letting a shell run more than the command it was given
+const shellMetaChars = ";&|`$()<>\n"
+
+// Handles ![cmd <command>]
+func (p *Patcher) includeCommand(command string) (string, error) {
+	if !p.isAllowed(command) && (p.Confirm == nil || !p.Confirm(command)) {
+		return "", fmt.Errorf("command was not allowed to run: %s", command)
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	exitCode := 0
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return "", fmt.Errorf("error running command %s: %w", command, err)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	output := stdout.Bytes()
+	if isBinary(output) {
+		return fmt.Sprintf("\nOutput of command `%s` (exit code %d) was not included: binary content.", command, exitCode), nil
+	}
+
+	output, note := truncate(output, len(output))
+
+	return fmt.Sprintf("\nOutput of command `%s` (exit code %d) is:\n```\n%s\n```%s", command, exitCode, strings.TrimRight(string(output), "\n"), note), nil
+}
+
+// Returns true if the command starts with one of the allowed commands and
+// can't run anything else
+func (p *Patcher) isAllowed(command string) bool {
+	if strings.ContainsAny(command, shellMetaChars) {
+		return false
+	}
+
+	words := strings.Fields(command)
+
+	for _, allowed := range p.AllowedCommands {
+		prefix := strings.Fields(allowed)
+		if len(prefix) == 0 || len(prefix) > len(words) {
+			continue
+		}
+
+		matched := true
+		for i := range prefix {
+			if prefix[i] != words[i] {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,56 +1,332 @@
 package chat
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
-func PatchInput(input string) (string, error) {
-	// Regular expression to match ![file <filename>]
-	re := regexp.MustCompile(`!\[file\s+([^\]]+)\]`)
+const (
+	// Maximum number of bytes inlined for a single file; larger files are
+	// truncated
+	MaxFileSize = 100 * 1024
+	// Maximum number of bytes inlined for all files of a directory or a
+	// pattern; other files are only listed
+	MaxDirSize = 500 * 1024
+	// Number of bytes inspected to find out if a file is binary
+	binarySniffLength = 8000
+)
+
+// Code fence language tags, by file extension
+var languages = map[string]string{
+	".go": "go", ".py": "python", ".rb": "ruby", ".rs": "rust", ".java": "java",
+	".kt": "kotlin", ".scala": "scala", ".c": "c", ".h": "c", ".cc": "cpp",
+	".cpp": "cpp", ".hpp": "cpp", ".cs": "csharp", ".swift": "swift",
+	".js": "javascript", ".jsx": "jsx", ".ts": "typescript", ".tsx": "tsx",
+	".php": "php", ".lua": "lua", ".pl": "perl", ".sh": "sh", ".bash": "bash",
+	".zsh": "zsh", ".fish": "fish", ".ps1": "powershell", ".sql": "sql",
+	".html": "html", ".css": "css", ".scss": "scss", ".json": "json",
+	".yaml": "yaml", ".yml": "yaml", ".toml": "toml", ".ini": "ini",
+	".xml": "xml", ".md": "markdown", ".proto": "protobuf", ".tf": "hcl",
+	".nix": "nix", ".vue": "vue", ".dockerfile": "dockerfile",
+}
+
+// Code fence language tags, by file name
+var languagesByName = map[string]string{
+	"Dockerfile": "dockerfile",
+	"Makefile":   "makefile",
+	"go.mod":     "go-module",
+}
+
+// Regular expression to match a line range at the end of a path, as in
+// main.go:10-40, main.go:10- or main.go:10
+var lineRangeRe = regexp.MustCompile(`^(.+):(\d+)(?:-(\d*))?$`)
+
+// Handles ![file <path>]
+func includeFiles(arg string) (string, error) {
+	filename := arg
+	startLine, endLine := 0, 0
+
+	// A file actually named with a colon wins over a line range
+	if _, err := os.Stat(arg); err != nil {
+		if m := lineRangeRe.FindStringSubmatch(arg); m != nil {
+			filename = m[1]
+			startLine, _ = strconv.Atoi(m[2])
+			endLine = startLine
+
+			if strings.HasSuffix(arg, "-") {
+				endLine = 0
+			} else if m[3] != "" {
+				endLine, _ = strconv.Atoi(m[3])
+			}
+
+			if startLine == 0 || (endLine != 0 && endLine < startLine) {
+				return "", fmt.Errorf("invalid line range in %s", arg)
+			}
+		}
+	}
+
+	if !hasMeta(filename) {
+		part, err := readFile(filename, startLine, endLine)
+		if err != nil {
+			return "", fmt.Errorf("error reading file %s: %w", filename, err)
+		}
+
+		return formatFile(filename, part, startLine, endLine), nil
+	}
+
+	if startLine != 0 {
+		return "", fmt.Errorf("line ranges can't be used with patterns: %s", arg)
+	}
+
+	filenames, err := expandGlob(filename)
+	if err != nil {
+		return "", fmt.Errorf("error expanding pattern %s: %w", filename, err)
+	}
+
+	if len(filenames) == 0 {
+		return "", fmt.Errorf("no file matches pattern %s", filename)
+	}
+
+	var sb strings.Builder
+	if err := writeFiles(&sb, filenames); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+// Handles ![dir <path>]
+func includeDir(arg string) (string, error) {
+	root := filepath.Clean(arg)
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return "", fmt.Errorf("error reading directory %s: %w", root, err)
+	}
+
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", root)
+	}
+
+	ignore := &gitignore{}
+	tree := []string{root + "/"}
+	files := []string{}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if relPath == "." {
+			return ignore.load(path, "")
+		}
+
+		if d.Name() == ".git" || ignore.ignored(relPath, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		depth := strings.Count(relPath, "/") + 1
+		indent := strings.Repeat("  ", depth)
+
+		if d.IsDir() {
+			tree = append(tree, indent+d.Name()+"/")
+			return ignore.load(path, relPath)
+		}
+
+		tree = append(tree, indent+d.Name())
+
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error walking directory %s: %w", root, err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\nTree of directory '%s' is:\n```\n%s\n```", root, strings.Join(tree, "\n"))
 
-	// Keep track of replacement positions to avoid modifying the string
-	// while we're iterating over matches
-	type replacement struct {
-		start, end int
-		content    string
+	if err := writeFiles(&sb, files); err != nil {
+		return "", err
 	}
 
-	var replacements []replacement
+	return sb.String(), nil
+}
+
+// Writes files in code blocks until their content exceeds MaxDirSize; other
+// files are only listed
+func writeFiles(sb *strings.Builder, filenames []string) error {
+	total := 0
+	for _, filename := range filenames {
+		if total >= MaxDirSize {
+			fmt.Fprintf(sb, "\nFile '%s' was not included: content of included files exceeds %d bytes.", filename, MaxDirSize)
+			continue
+		}
+
+		part, err := readFile(filename, 0, 0)
+		if err != nil {
+			return fmt.Errorf("error reading file %s: %w", filename, err)
+		}
+
+		total += min(part.size, MaxFileSize)
+		sb.WriteString(formatFile(filename, part, 0, 0))
+	}
+
+	return nil
+}
+
+// Lines of a file read for inclusion
+type filePart struct {
+	// Content of the lines, up to MaxFileSize+1 bytes so truncation can be
+	// told, and its whole size
+	content []byte
+	size    int
+	// Number of lines read: all lines of the file, unless reading stopped
+	// at the end of the range
+	lines  int
+	binary bool
+}
 
-	// Find all matches
-	matches := re.FindAllStringSubmatchIndex(input, -1)
-	for _, match := range matches {
-		if len(match) >= 4 {
-			// Extract the filename
-			filenameStart, filenameEnd := match[2], match[3]
-			filename := strings.TrimSpace(input[filenameStart:filenameEnd])
+// Reads lines startLine to endLine of a file, or all of it if startLine is 0;
+// endLine 0 means up to the end of file. At most MaxFileSize+1 bytes are kept
+// in memory.
+func readFile(filename string, startLine, endLine int) (filePart, error) {
+	var part filePart
 
-			// Read the file content
-			content, err := os.ReadFile(filename)
-			if err != nil {
-				return "", fmt.Errorf("error reading file %s: %w", filename, err)
+	f, err := os.Open(filename)
+	if err != nil {
+		return part, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	head := []byte{}
+	line := 1
+	partial := false
+
+	for {
+		data, err := r.ReadSlice('\n')
+
+		if len(head) < binarySniffLength {
+			head = append(head, data[:min(len(data), binarySniffLength-len(head))]...)
+		}
+
+		if startLine == 0 || line >= startLine {
+			part.size += len(data)
+			if len(part.content) <= MaxFileSize {
+				part.content = append(part.content, data[:min(len(data), MaxFileSize+1-len(part.content))]...)
 			}
+		}
+
+		// The line is longer than the buffer: read the rest of it
+		if err == bufio.ErrBufferFull {
+			partial = true
+			continue
+		}
+
+		if err == io.EOF {
+			if len(data) > 0 || partial {
+				part.lines = line
+			}
+			break
+		} else if err != nil {
+			return part, err
+		}
 
-			strContent := fmt.Sprintf("\nContent of file '%s' is:\n```%s\n```", filename, string(content))
+		part.lines = line
+		partial = false
 
-			// Store the replacement information
-			replacements = append(replacements, replacement{
-				start:   match[0],
-				end:     match[1],
-				content: strContent,
-			})
+		if endLine != 0 && line == endLine {
+			break
 		}
+		line++
 	}
 
-	// Apply replacements from last to first to avoid position shifts
-	result := input
-	for i := len(replacements) - 1; i >= 0; i-- {
-		r := replacements[i]
-		result = result[:r.start] + r.content + result[r.end:]
+	part.binary = isBinary(head)
+
+	return part, nil
+}
+
+// Formats file content in a code block, read for the given line range if
+// startLine is not 0. Binary files are refused and large files truncated,
+// with a message saying so.
+func formatFile(filename string, part filePart, startLine, endLine int) string {
+	if part.binary {
+		return fmt.Sprintf("\nFile '%s' was not included: binary content.", filename)
 	}
 
-	return result, nil
+	header := fmt.Sprintf("Content of file '%s' is", filename)
+
+	if startLine != 0 {
+		if startLine > part.lines {
+			return fmt.Sprintf("\nFile '%s' has only %d lines; line %d was not included.", filename, part.lines, startLine)
+		}
+
+		if endLine == 0 || endLine > part.lines {
+			endLine = part.lines
+		}
+
+		header = fmt.Sprintf("Lines %d to %d of file '%s' are", startLine, endLine, filename)
+	}
+
+	content, note := truncate(part.content, part.size)
+
+	return fmt.Sprintf("\n%s:\n```%s\n%s\n```%s", header, languageTag(filename), strings.TrimRight(string(content), "\n"), note)
+}
+
+// Truncates content larger than MaxFileSize at the last line ending, and
+// returns a note telling so; size is the size of the whole content, which
+// may have been read partially
+func truncate(content []byte, size int) ([]byte, string) {
+	if len(content) <= MaxFileSize {
+		return content, ""
+	}
+
+	// Cut at the last line ending, without splitting a character
+	cut := bytes.LastIndexByte(content[:MaxFileSize], '\n')
+	if cut <= 0 {
+		cut = MaxFileSize
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+	}
+
+	content = content[:cut]
+
+	return content, fmt.Sprintf("\n(truncated: content is %d bytes, only the first %d are included)", size, len(content))
+}
+
+// Returns the code fence language tag for the file, or an empty string
+func languageTag(filename string) string {
+	base := filepath.Base(filename)
+	if lang, ok := languagesByName[base]; ok {
+		return lang
+	}
+
+	return languages[strings.ToLower(filepath.Ext(base))]
+}
+
+// Files with a NUL byte in their first bytes are considered as binary
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), binarySniffLength)], 0) != -1
 }
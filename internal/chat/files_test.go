@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "big.txt")
+
+	var sb strings.Builder
+	for i := 1; i <= 100000; i++ {
+		fmt.Fprintf(&sb, "line %d\n", i)
+	}
+	writeTestFile(t, path, sb.String())
+
+	tests := []struct {
+		start, end int
+		size       int
+		lines      int
+		prefix     string
+	}{
+		{0, 0, sb.Len(), 100000, "line 1\n"},
+		{90000, 90002, len("line 90000\nline 90001\nline 90002\n"), 90002, "line 90000\n"},
+		{99999, 0, len("line 99999\nline 100000\n"), 100000, "line 99999\n"},
+		{200000, 0, 0, 100000, ""},
+	}
+
+	for _, test := range tests {
+		part, err := readFile(path, test.start, test.end)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(part.content) > MaxFileSize+1 {
+			t.Errorf("lines %d-%d: %d bytes kept in memory", test.start, test.end, len(part.content))
+		}
+		if part.size != test.size || part.lines != test.lines || !strings.HasPrefix(string(part.content), test.prefix) {
+			t.Errorf("lines %d-%d: got size %d, %d lines, content %.12q", test.start, test.end, part.size, part.lines, part.content)
+		}
+	}
+
+	// A single line longer than the read buffer
+	writeTestFile(t, path, strings.Repeat("x", 3*MaxFileSize))
+	part, err := readFile(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part.size != 3*MaxFileSize || part.lines != 1 || len(part.content) != MaxFileSize+1 {
+		t.Errorf("long line: got size %d, %d lines, %d bytes kept", part.size, part.lines, len(part.content))
+	}
+}
+
+func TestIncludeFilesPatternSize(t *testing.T) {
+	dir := t.TempDir()
+
+	count := 2 * MaxDirSize / MaxFileSize
+	for i := 0; i < count; i++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("file%02d.txt", i)), strings.Repeat("some text\n", MaxFileSize/5))
+	}
+
+	content, err := includeFiles(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	included := strings.Count(content, "Content of file")
+	skipped := strings.Count(content, "was not included")
+	if included != MaxDirSize/MaxFileSize || included+skipped != count {
+		t.Errorf("%d files included and %d skipped out of %d", included, skipped, count)
+	}
+
+	if len(content) > MaxDirSize+count*200 {
+		t.Errorf("pattern inlined %d bytes", len(content))
+	}
+}
@@ -0,0 +1,101 @@
+package chat
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A single pattern of a .gitignore file
+type ignoreRule struct {
+	// Directory containing the .gitignore file, relative to the walked root
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// Rules of all .gitignore files found while walking a directory. Later rules
+// take precedence, so nested files override their parents.
+type gitignore struct {
+	rules []ignoreRule
+}
+
+// Loads the .gitignore file of given directory, if any. relDir is the
+// directory path relative to the walked root, using '/' as separator.
+func (g *gitignore) load(dir, relDir string) error {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule := ignoreRule{base: relDir}
+
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+
+		// A pattern containing a slash is relative to the .gitignore location
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		rule.pattern = line
+		g.rules = append(g.rules, rule)
+	}
+
+	return scanner.Err()
+}
+
+// Returns true if given path, relative to the walked root and using '/' as
+// separator, is ignored
+func (g *gitignore) ignored(relPath string, isDir bool) bool {
+	ignored := false
+
+	for _, rule := range g.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		name := relPath
+		if rule.base != "" {
+			if !strings.HasPrefix(relPath, rule.base+"/") {
+				continue
+			}
+			name = strings.TrimPrefix(relPath, rule.base+"/")
+		}
+
+		var matched bool
+		if rule.anchored {
+			matched = matchPath(rule.pattern, name)
+		} else {
+			matched, _ = path.Match(rule.pattern, path.Base(name))
+		}
+
+		if matched {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
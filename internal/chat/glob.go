@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Maximum number of files a pattern can match
+const maxGlobMatches = 1000
+
+// Returns true if the string contains glob meta characters
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// Returns true if name matches pattern. Both use '/' as separator; '**'
+// matches any number of path segments, other segments are matched using
+// path.Match.
+func matchPath(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return true
+			}
+
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+			return false
+		}
+
+		pattern, segments = pattern[1:], segments[1:]
+	}
+
+	return len(segments) == 0
+}
+
+// Returns true if files under the directory can match the pattern: its
+// segments match those of the pattern before any '**', and without '**' it
+// is less deep than the pattern
+func matchDir(pattern, segments []string) bool {
+	for i, segment := range segments {
+		if i >= len(pattern) {
+			return false
+		}
+
+		if pattern[i] == "**" {
+			return true
+		}
+
+		if ok, err := path.Match(pattern[i], segment); err != nil || !ok {
+			return false
+		}
+	}
+
+	return len(segments) < len(pattern)
+}
+
+// Returns files matching pattern, sorted, or an error if more than
+// maxGlobMatches match. Directories named .git or which can't hold matches are
+// not walked.
+func expandGlob(pattern string) ([]string, error) {
+	pattern = path.Clean(filepath.ToSlash(pattern))
+
+	// Only walk from the longest leading part of the pattern without meta
+	// characters
+	segments := strings.Split(pattern, "/")
+	base := []string{}
+	for _, segment := range segments[:len(segments)-1] {
+		if hasMeta(segment) {
+			break
+		}
+		base = append(base, segment)
+	}
+
+	root := strings.Join(base, "/")
+	if root == "" && strings.HasPrefix(pattern, "/") {
+		root = "/"
+	} else if root == "" {
+		root = "."
+	}
+
+	matches := []string{}
+
+	err := filepath.WalkDir(filepath.FromSlash(root), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p == filepath.FromSlash(root) {
+				return nil
+			}
+			if d.Name() == ".git" || !matchDir(segments, strings.Split(filepath.ToSlash(p), "/")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if matchPath(pattern, filepath.ToSlash(p)) {
+			if len(matches) == maxGlobMatches {
+				return fmt.Errorf("more than %d files match", maxGlobMatches)
+			}
+			matches = append(matches, p)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+
+	return matches, nil
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandGlob(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"a.go", "b.txt", "sub/c.go", "sub/deep/d.go", ".git/e.go"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, path, "content")
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.go", []string{"a.go"}},
+		{"*/*.go", []string{"sub/c.go"}},
+		{"sub/*/*.go", []string{"sub/deep/d.go"}},
+		{"**/*.go", []string{"a.go", "sub/c.go", "sub/deep/d.go"}},
+		{"sub/**", []string{"sub/c.go", "sub/deep/d.go"}},
+		{"*.md", []string{}},
+	}
+
+	for _, test := range tests {
+		got, err := expandGlob(filepath.Join(dir, test.pattern))
+		if err != nil {
+			t.Fatalf("%s: %v", test.pattern, err)
+		}
+
+		for i := range got {
+			rel, err := filepath.Rel(dir, got[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[i] = filepath.ToSlash(rel)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestMatchDir(t *testing.T) {
+	tests := []struct {
+		pattern string
+		dir     string
+		want    bool
+	}{
+		{"*.go", "sub", false},
+		{"*/*.go", "sub", true},
+		{"*/*.go", "sub/deep", false},
+		{"sub/*.go", "other", false},
+		{"**/*.go", "sub/deep/deeper", true},
+		{"sub/**/*.go", "sub/deep", true},
+		{"sub/**/*.go", "other/deep", false},
+		{"/home/*.go", "/home/user", false},
+		{"/home/*/*.go", "/home/user", true},
+	}
+
+	for _, test := range tests {
+		got := matchDir(strings.Split(test.pattern, "/"), strings.Split(test.dir, "/"))
+		if got != test.want {
+			t.Errorf("matchDir(%q, %q) = %v, want %v", test.pattern, test.dir, got, test.want)
+		}
+	}
+}
+
+func TestExpandGlobMatches(t *testing.T) {
+	dir := t.TempDir()
+
+	for i := 0; i <= maxGlobMatches; i++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("file%04d.txt", i)), "")
+	}
+
+	if _, err := expandGlob(filepath.Join(dir, "*.txt")); err == nil {
+		t.Errorf("expanded more than %d files", maxGlobMatches)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "file0000.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	matches, err := expandGlob(filepath.Join(dir, "*.txt"))
+	if err != nil || len(matches) != maxGlobMatches {
+		t.Errorf("got %d matches, %v", len(matches), err)
+	}
+}
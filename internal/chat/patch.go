@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Regular expression to match ![<directive> <argument>]
+var directiveRe = regexp.MustCompile(`!\[(file|dir|cmd|url)\s+([^\]]+)\]`)
+
+// Patcher replaces directives found in user input by the content they refer
+// to:
+//   - ![file <path>] inlines a file; path can be a glob (src/**/*.go) or
+//     end with a line range (main.go:10-40)
+//   - ![dir <path>] inlines a directory tree and its files, honoring .gitignore
+//   - ![cmd <command>] runs a command and inlines its output and exit code
+//   - ![url <url>] fetches a page and inlines it as readable text
+type Patcher struct {
+	// Client used to fetch urls; http.DefaultClient is used if nil
+	HTTPClient *http.Client
+	// Commands run without confirmation. A command is allowed if its words
+	// start with the words of one of them: "git diff" allows "git diff --staged".
+	AllowedCommands []string
+	// Asked before running a command which is not allowed. Such commands are
+	// refused if nil.
+	Confirm func(command string) bool
+}
+
+// Keep track of replacement positions to avoid modifying the string
+// while we're iterating over matches
+type replacement struct {
+	start, end int
+	content    string
+}
+
+// Patches input using a default Patcher, which fetches urls with
+// http.DefaultClient and refuses to run commands
+func PatchInput(input string) (string, error) {
+	return (&Patcher{}).Patch(input)
+}
+
+// Returns input with all directives replaced
+func (p *Patcher) Patch(input string) (string, error) {
+	var replacements []replacement
+
+	// Find all matches
+	matches := directiveRe.FindAllStringSubmatchIndex(input, -1)
+	for _, match := range matches {
+		if len(match) >= 6 {
+			directive := input[match[2]:match[3]]
+			arg := strings.TrimSpace(input[match[4]:match[5]])
+
+			content, err := p.handle(directive, arg)
+			if err != nil {
+				return "", err
+			}
+
+			// Store the replacement information
+			replacements = append(replacements, replacement{
+				start:   match[0],
+				end:     match[1],
+				content: content,
+			})
+		}
+	}
+
+	// Apply replacements from last to first to avoid position shifts
+	result := input
+	for i := len(replacements) - 1; i >= 0; i-- {
+		r := replacements[i]
+		result = result[:r.start] + r.content + result[r.end:]
+	}
+
+	return result, nil
+}
+
+func (p *Patcher) handle(directive, arg string) (string, error) {
+	switch directive {
+	case "file":
+		return includeFiles(arg)
+	case "dir":
+		return includeDir(arg)
+	case "cmd":
+		return p.includeCommand(arg)
+	default:
+		return p.includeURL(arg)
+	}
+}
@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Maximum number of bytes read from a page before conversion to text
+const maxPageSize = 5 * MaxFileSize
+
+// Elements whose content is not readable text
+var skippedElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "iframe": true,
+}
+
+// Skipped elements whose content is read as raw text up to their end tag,
+// even when written as self-closing
+var rawTextElements = map[string]bool{
+	"script": true, "style": true, "noscript": true, "iframe": true,
+}
+
+// Elements rendered on their own lines
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "hr": true, "tr": true, "table": true,
+	"section": true, "article": true, "header": true, "footer": true,
+	"nav": true, "aside": true, "main": true, "blockquote": true, "pre": true,
+	"ul": true, "ol": true, "dl": true, "dt": true, "dd": true, "form": true,
+	"figure": true, "figcaption": true, "title": true,
+}
+
+var (
+	trailingSpacesRe = regexp.MustCompile(`[ \t]+\n`)
+	blankLinesRe     = regexp.MustCompile(`\n{3,}`)
+)
+
+// Handles ![url <url>]
+func (p *Patcher) includeURL(url string) (string, error) {
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("error fetching %s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", url, err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		text, err := htmlToText(string(body))
+		if err != nil {
+			return "", fmt.Errorf("error parsing %s: %w", url, err)
+		}
+		body = []byte(text)
+	case isBinary(body):
+		return fmt.Sprintf("\nContent of %s was not included: binary content.", url), nil
+	}
+
+	body, note := truncate(body, len(body))
+
+	return fmt.Sprintf("\nContent of %s is:\n```\n%s\n```%s", url, strings.TrimSpace(string(body)), note), nil
+}
+
+// Converts an HTML document to readable text: scripts and styles are dropped,
+// block elements are put on their own lines and headings and list items keep
+// a markdown-like prefix.
+func htmlToText(document string) (string, error) {
+	var sb strings.Builder
+
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	skipped := 0
+	preformatted := 0
+
+	for {
+		switch token := tokenizer.Next(); token {
+		case html.ErrorToken:
+			if tokenizer.Err() == io.EOF {
+				text := trailingSpacesRe.ReplaceAllString(sb.String(), "\n")
+				text = blankLinesRe.ReplaceAllString(text, "\n\n")
+				return strings.TrimSpace(text), nil
+			}
+			return "", tokenizer.Err()
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+
+			// Self-closing elements, as <svg/>, have no content to skip,
+			// unless their content is raw text read up to their end tag
+			if skippedElements[tag] {
+				if token == html.StartTagToken || rawTextElements[tag] {
+					skipped++
+				}
+				continue
+			}
+
+			switch {
+			case tag == "li":
+				sb.WriteString("\n- ")
+			case len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6':
+				sb.WriteString("\n\n" + strings.Repeat("#", int(tag[1]-'0')) + " ")
+			case tag == "pre":
+				preformatted++
+				sb.WriteString("\n")
+			case blockElements[tag]:
+				sb.WriteString("\n")
+			case tag == "td" || tag == "th":
+				sb.WriteString(" ")
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+
+			if skippedElements[tag] {
+				skipped = max(skipped-1, 0)
+				continue
+			}
+
+			if tag == "pre" {
+				preformatted = max(preformatted-1, 0)
+			}
+
+			if blockElements[tag] || (len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6') {
+				sb.WriteString("\n")
+			}
+
+		case html.TextToken:
+			if skipped > 0 {
+				continue
+			}
+
+			text := string(tokenizer.Text())
+			if preformatted == 0 {
+				text = strings.Join(strings.Fields(text), " ")
+				if text == "" {
+					continue
+				}
+				text += " "
+			}
+
+			sb.WriteString(text)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		expected string
+	}{
+		{
+			"blocks",
+			"<html><head><title>Title</title></head><body><h2>Heading</h2><p>Some <b>bold</b> text.</p><ul><li>one</li><li>two</li></ul></body></html>",
+			"Title\n\n## Heading\n\nSome bold text.\n\n- one\n- two",
+		},
+		{
+			"skipped elements",
+			"<p>before</p><script>var a = 1;</script><style>p {}</style><svg><path d='M0'/></svg><p>after</p>",
+			"before\n\nafter",
+		},
+		{
+			"self-closing skipped elements",
+			"<p><svg/>icon</p><template/><p>text after</p><iframe src='x'/>fallback</iframe><p>end</p>",
+			"icon\n\ntext after\n\nend",
+		},
+		{
+			"preformatted",
+			"<pre>func main() {\n    fmt.Println()\n}</pre>",
+			"func main() {\n    fmt.Println()\n}",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, err := htmlToText(test.document)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if text != test.expected {
+				t.Errorf("got %q, expected %q", text, test.expected)
+			}
+		})
+	}
+}
+
+func TestIncludeURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body><svg/><p>Hello <em>world</em></p></body></html>"))
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("line\n", maxPageSize)))
+	})
+	mux.HandleFunc("/binary", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte{0x7f, 'E', 'L', 'F', 0, 0})
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	p := &Patcher{HTTPClient: server.Client()}
+
+	tests := []struct {
+		path     string
+		contains string
+		err      bool
+	}{
+		{"/page", "Hello world", false},
+		{"/text", "(truncated: content is", false},
+		{"/binary", "binary content", false},
+		{"/missing", "404", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			content, err := p.includeURL(server.URL + test.path)
+			if test.err {
+				if err == nil || !strings.Contains(err.Error(), test.contains) {
+					t.Fatalf("got error %v, expected one containing %q", err, test.contains)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.Contains(content, test.contains) {
+				t.Errorf("got %.200q, expected it to contain %q", content, test.contains)
+			}
+			if len(content) > MaxFileSize+200 {
+				t.Errorf("included %d bytes", len(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/adrg/xdg"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds user settings, read from a YAML file
+type Config struct {
+	// Command printing the API key, e.g. "pass show openai"
+	KeyCommand string `yaml:"key_command"`
+	// File holding the API key, instead of the default one
+	KeyFile string `yaml:"key_file"`
+	// Retries of failed API calls
+	Retry Retry `yaml:"retry"`
+	// Response cache
+	Cache Cache `yaml:"cache"`
+	// Model aliases and validation
+	Models Models `yaml:"models"`
+	// Profile used when none is given on the command line
+	Profile string `yaml:"profile"`
+	// Network settings, by profile name
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Cache tells how replies are cached; caching is disabled unless TTL is set
+type Cache struct {
+	// Time replies are served from the cache, e.g. "24h"
+	TTL time.Duration `yaml:"ttl"`
+	// Maximum number of cached replies
+	MaxEntries int `yaml:"max_entries"`
+}
+
+// Models holds model aliases and tells whether models are checked
+type Models struct {
+	// Models by alias, e.g. fast: gpt-4o-mini
+	Aliases map[string]string `yaml:"aliases"`
+	// Check models given on the command line against the list exposed by
+	// the API, cached for a day
+	Validate bool `yaml:"validate"`
+}
+
+// Profile holds the network settings used to reach the API
+type Profile struct {
+	// Base URL of the API, e.g. of a gateway
+	BaseURL string `yaml:"base_url"`
+	// Proxy URL, instead of the one set in HTTPS_PROXY
+	Proxy string `yaml:"proxy"`
+	// PEM files holding CAs trusted along with the system ones
+	CAFiles []string `yaml:"ca_files"`
+	// Client certificate and key PEM files, for mutual TLS
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	// Time to wait for the API to answer, e.g. "30s"
+	Timeout time.Duration `yaml:"timeout"`
+	// Headers added to every API request
+	Headers map[string]string `yaml:"headers"`
+}
+
+// Retry tells how API calls failing on transient errors are retried
+type Retry struct {
+	// Maximum number of attempts, including the first one
+	MaxAttempts int `yaml:"max_attempts"`
+	// Time after which attempts are abandoned, e.g. "2m"
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Returns the default configuration file path, in the XDG config directory
+func DefaultPath() (string, error) {
+	filePath, err := xdg.ConfigFile("asoai/config.yaml")
+	if err != nil {
+		return "", fmt.Errorf("could not find a suitable location for configuration: %w", err)
+	}
+
+	return filePath, nil
+}
+
+// Loads the configuration file at given path, or at the default location if
+// the path is empty. A missing file gives an empty configuration.
+func Load(filePath string) (Config, error) {
+	var config Config
+
+	if filePath == "" {
+		var err error
+		if filePath, err = DefaultPath(); err != nil {
+			return config, err
+		}
+	}
+
+	content, err := os.ReadFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	} else if err != nil {
+		return config, fmt.Errorf("could not read configuration: %w", err)
+	}
+
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("could not parse configuration %s: %w", filePath, err)
+	}
+
+	return config, nil
+}
+
+// Returns the profile with given name, or the default one if the name is
+// empty. Without profile, default network settings are used.
+func (c Config) GetProfile(name string) (Profile, error) {
+	if name == "" {
+		name = c.Profile
+	}
+
+	if name == "" {
+		return Profile{}, nil
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return profile, fmt.Errorf("unknown profile %s", name)
+	}
+
+	return profile, nil
+}
@@ -0,0 +1,219 @@
+package credentials
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"github.com/zalando/go-keyring"
+)
+
+// Sources of the API key
+const (
+	SourceFlag       = "flag"
+	SourceEnv        = "environment"
+	SourceKeyCommand = "key command"
+	SourceKeyFile    = "key file"
+	SourceKeyring    = "keyring"
+)
+
+const (
+	keyringService = "asoai"
+	keyringUser    = "openai"
+)
+
+var ErrNotFound = errors.New("no API key found")
+
+// Options tell where to look for the API key
+type Options struct {
+	// Key given on the command line
+	Flag string
+	// Command printing the key
+	KeyCommand string
+	// Key file; the default one is used if empty
+	KeyFile string
+}
+
+// Returns the API key and where it was found. Sources are checked in order:
+// flag, OPENAI_API_KEY, key command, key file and keyring. Returns
+// ErrNotFound if none holds a key.
+func Resolve(opts Options) (string, string, error) {
+	if opts.Flag != "" {
+		return opts.Flag, SourceFlag, nil
+	}
+
+	if key := os.Getenv("OPENAI_API_KEY"); key != "" {
+		return key, SourceEnv, nil
+	}
+
+	if opts.KeyCommand != "" {
+		key, err := runKeyCommand(opts.KeyCommand)
+		return key, SourceKeyCommand, err
+	}
+
+	keyFile, err := keyFilePath(opts.KeyFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	key, err := readKeyFile(keyFile)
+	if err != nil || key != "" {
+		return key, SourceKeyFile, err
+	}
+
+	if keyringAvailable() {
+		key, err := keyring.Get(keyringService, keyringUser)
+		if err == nil && key != "" {
+			return key, SourceKeyring, nil
+		}
+	}
+
+	return "", "", ErrNotFound
+}
+
+// Saves the key in the keyring if available and toFile is not set, else in
+// the key file. Returns where the key was saved.
+func Save(key, keyFile string, toFile bool) (string, error) {
+	if !toFile && keyringAvailable() {
+		if err := keyring.Set(keyringService, keyringUser, key); err == nil {
+			return SourceKeyring, nil
+		}
+	}
+
+	keyFile, err := keyFilePath(keyFile)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return "", fmt.Errorf("could not create key file directory: %w", err)
+	}
+
+	// Write then rename, so the key never sits in a file readable by others
+	tmpFile := keyFile + ".tmp"
+	if err := os.WriteFile(tmpFile, []byte(key+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("could not write key file: %w", err)
+	}
+
+	if err := os.Rename(tmpFile, keyFile); err != nil {
+		os.Remove(tmpFile)
+		return "", fmt.Errorf("could not write key file: %w", err)
+	}
+
+	return SourceKeyFile, nil
+}
+
+// Removes the key from the keyring and the key file. Returns the sources the
+// key was removed from.
+func Delete(keyFile string) ([]string, error) {
+	removed := []string{}
+
+	if keyringAvailable() {
+		if err := keyring.Delete(keyringService, keyringUser); err == nil {
+			removed = append(removed, SourceKeyring)
+		}
+	}
+
+	keyFile, err := keyFilePath(keyFile)
+	if err != nil {
+		return removed, err
+	}
+
+	if err := os.Remove(keyFile); err == nil {
+		removed = append(removed, SourceKeyFile)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return removed, fmt.Errorf("could not remove key file: %w", err)
+	}
+
+	return removed, nil
+}
+
+// Returns the key with only its first 3 and last 4 characters shown
+func Mask(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+// Returns given key file, or the default one in the XDG config directory
+func keyFilePath(keyFile string) (string, error) {
+	if keyFile != "" {
+		return keyFile, nil
+	}
+
+	keyFile, err := xdg.ConfigFile("asoai/api_key")
+	if err != nil {
+		return "", fmt.Errorf("could not find a suitable location for key file: %w", err)
+	}
+
+	return keyFile, nil
+}
+
+// Returns the key held in the file, or an empty string if there is none. Files
+// readable by other users are refused.
+func readKeyFile(keyFile string) (string, error) {
+	info, err := os.Stat(keyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not read key file: %w", err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("key file %s is accessible by other users: run chmod 600 %s", keyFile, keyFile)
+	}
+
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read key file: %w", err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Runs the command and returns its output. The output is never included in
+// errors, as it may hold the key.
+func runKeyCommand(command string) (string, error) {
+	var stdout bytes.Buffer
+
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("key command failed: %w", err)
+	}
+
+	// Tools like pass print the secret on the first line
+	key, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+	if key == "" {
+		return "", errors.New("key command printed no key")
+	}
+
+	return strings.TrimSpace(key), nil
+}
+
+// The Secret Service is only used on Linux when a D-Bus session is running,
+// as connecting may otherwise try to launch one
+func keyringAvailable() bool {
+	switch runtime.GOOS {
+	case "darwin", "windows":
+		return true
+	case "linux", "freebsd", "openbsd", "netbsd", "dragonfly":
+		return os.Getenv("DBUS_SESSION_BUS_ADDRESS") != ""
+	}
+
+	return false
+}
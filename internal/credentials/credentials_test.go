@@ -0,0 +1,163 @@
+package credentials
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+// Uses an in-memory keyring holding key, if not empty
+func mockKeyring(t *testing.T, key string) {
+	t.Helper()
+
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path=/nonexistent")
+	keyring.MockInit()
+
+	if key != "" {
+		if err := keyring.Set(keyringService, keyringUser, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeKeyFile(t *testing.T, path, key string, perm os.FileMode) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(key+"\n"), perm); err != nil {
+		t.Fatal(err)
+	}
+	// The umask may have removed permissions
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveOrder(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("key commands are run with sh")
+	}
+
+	tests := []struct {
+		name       string
+		flag       string
+		env        string
+		keyCommand string
+		keyFile    string
+		keyring    string
+		key        string
+		source     string
+	}{
+		{"flag", "flag-key", "env-key", "echo command-key", "file-key", "keyring-key", "flag-key", SourceFlag},
+		{"environment", "", "env-key", "echo command-key", "file-key", "keyring-key", "env-key", SourceEnv},
+		{"key command", "", "", "echo command-key", "file-key", "keyring-key", "command-key", SourceKeyCommand},
+		{"key file", "", "", "", "file-key", "keyring-key", "file-key", SourceKeyFile},
+		{"keyring", "", "", "", "", "keyring-key", "keyring-key", SourceKeyring},
+		{"none", "", "", "", "", "", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("OPENAI_API_KEY", test.env)
+			mockKeyring(t, test.keyring)
+
+			keyFile := filepath.Join(t.TempDir(), "api_key")
+			if test.keyFile != "" {
+				writeKeyFile(t, keyFile, test.keyFile, 0o600)
+			}
+
+			key, source, err := Resolve(Options{Flag: test.flag, KeyCommand: test.keyCommand, KeyFile: keyFile})
+			if test.key == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("got %q from %q (%v), expected no key", key, source, err)
+				}
+				return
+			}
+
+			if err != nil || key != test.key || source != test.source {
+				t.Errorf("got %q from %q (%v), expected %q from %q", key, source, err, test.key, test.source)
+			}
+		})
+	}
+}
+
+func TestKeyFilePermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permissions are not checked on Windows")
+	}
+
+	t.Setenv("OPENAI_API_KEY", "")
+	mockKeyring(t, "keyring-key")
+
+	tests := []struct {
+		perm    os.FileMode
+		refused bool
+	}{
+		{0o600, false},
+		{0o400, false},
+		{0o640, true},
+		{0o644, true},
+		{0o606, true},
+	}
+
+	for _, test := range tests {
+		keyFile := filepath.Join(t.TempDir(), "api_key")
+		writeKeyFile(t, keyFile, "file-key", test.perm)
+
+		key, source, err := Resolve(Options{KeyFile: keyFile})
+		if test.refused {
+			// The keyring is not used in place of a key file left readable
+			if err == nil || !strings.Contains(err.Error(), "chmod 600") || key != "" {
+				t.Errorf("mode %o: got %q from %q (%v), expected an error", test.perm, key, source, err)
+			}
+		} else if err != nil || key != "file-key" || source != SourceKeyFile {
+			t.Errorf("mode %o: got %q from %q (%v)", test.perm, key, source, err)
+		}
+	}
+}
+
+func TestKeyCommandFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("key commands are run with sh")
+	}
+
+	t.Setenv("OPENAI_API_KEY", "")
+	mockKeyring(t, "keyring-key")
+
+	for _, command := range []string{"echo secret-key; exit 1", "true"} {
+		key, _, err := Resolve(Options{KeyCommand: command, KeyFile: filepath.Join(t.TempDir(), "api_key")})
+		if err == nil || key != "" {
+			t.Errorf("%s: got %q (%v), expected an error", command, key, err)
+		} else if strings.Contains(err.Error(), "secret-key") {
+			t.Errorf("%s: error shows the key: %v", command, err)
+		}
+	}
+}
+
+func TestSaveKeyFile(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "")
+	mockKeyring(t, "")
+
+	keyFile := filepath.Join(t.TempDir(), "asoai", "api_key")
+
+	source, err := Save("saved-key", keyFile, true)
+	if err != nil || source != SourceKeyFile {
+		t.Fatalf("saved in %q (%v)", source, err)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+		t.Errorf("key file has mode %o", info.Mode().Perm())
+	}
+
+	if key, source, err := Resolve(Options{KeyFile: keyFile}); err != nil || key != "saved-key" || source != SourceKeyFile {
+		t.Errorf("got %q from %q (%v)", key, source, err)
+	}
+}
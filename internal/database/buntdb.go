@@ -0,0 +1,1127 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+
+	"git.mkz.me/mycroft/asoai/internal/batch"
+	"git.mkz.me/mycroft/asoai/internal/cache"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+// BuntDB stores data as JSON values in a buntdb file, which is entirely
+// loaded in memory when opened. Accesses are synchronized with other
+// processes using a lock file, and data is reloaded when another process
+// changed the file.
+type BuntDB struct {
+	filePath string
+	handle   *buntdb.DB
+	lock     *os.File
+	// Details of the file when it was last loaded or written
+	loaded os.FileInfo
+	// Serializes accesses within the process, as file locks are per process
+	mu sync.Mutex
+}
+
+// Opens the buntdb database located in the given file path
+func OpenBuntDB(filePath string) (*BuntDB, error) {
+	lock, err := os.OpenFile(filePath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, wrap("open database", err)
+	}
+
+	db := &BuntDB{
+		filePath: filePath,
+		lock:     lock,
+	}
+
+	if err := db.withLock(false, func() error { return nil }); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Runs fn holding the lock file, after reloading the database if it was
+// changed by another process
+func (db *BuntDB) withLock(exclusive bool, fn func() error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := lockFile(db.lock, exclusive); err != nil {
+		return wrap("lock database", err)
+	}
+	defer unlockFile(db.lock)
+
+	if err := db.reload(); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	if exclusive {
+		info, err := os.Stat(db.filePath)
+		if err != nil {
+			return wrap("open database", err)
+		}
+		db.loaded = info
+	}
+
+	return nil
+}
+
+// Loads the database, unless already loaded and unchanged since
+func (db *BuntDB) reload() error {
+	info, err := os.Stat(db.filePath)
+	if err == nil && db.handle != nil && os.SameFile(info, db.loaded) &&
+		info.Size() == db.loaded.Size() && info.ModTime().Equal(db.loaded.ModTime()) {
+		return nil
+	}
+
+	if db.handle != nil {
+		db.handle.Close()
+		db.handle = nil
+	}
+
+	handle, err := buntdb.Open(db.filePath)
+	if err != nil {
+		return wrap("open database", err)
+	}
+
+	// Shrinking replaces the file, which other processes may still be using:
+	// it's only done on request, holding the lock
+	var config buntdb.Config
+	if err := handle.ReadConfig(&config); err != nil {
+		handle.Close()
+		return wrap("open database", err)
+	}
+
+	config.AutoShrinkDisabled = true
+	if err := handle.SetConfig(config); err != nil {
+		handle.Close()
+		return wrap("open database", err)
+	}
+
+	if err := handle.CreateIndex("sessions", "session:*", buntdb.IndexString); err != nil {
+		handle.Close()
+		return wrap("create index", err)
+	}
+
+	if err := handle.CreateIndex("embeddings", "embedding:*", buntdb.IndexString); err != nil {
+		handle.Close()
+		return wrap("create index", err)
+	}
+
+	if db.loaded, err = os.Stat(db.filePath); err != nil {
+		handle.Close()
+		return wrap("open database", err)
+	}
+
+	db.handle = handle
+
+	return nil
+}
+
+// Runs a read-only transaction
+func (db *BuntDB) view(fn func(tx *buntdb.Tx) error) error {
+	return db.withLock(false, func() error {
+		return db.handle.View(fn)
+	})
+}
+
+// Runs a read/write transaction
+func (db *BuntDB) update(fn func(tx *buntdb.Tx) error) error {
+	return db.withLock(true, func() error {
+		return db.handle.Update(fn)
+	})
+}
+
+func (db *BuntDB) schemaVersion() (int, error) {
+	var version int
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+		version, err = buntdbSchemaVersion(tx)
+		return err
+	})
+
+	return version, wrap("get schema version", err)
+}
+
+func buntdbSchemaVersion(tx *buntdb.Tx) (int, error) {
+	val, err := tx.Get("schema_version")
+	if err == nil {
+		return strconv.Atoi(val)
+	} else if err != buntdb.ErrNotFound {
+		return 0, err
+	}
+
+	empty := true
+	err = tx.AscendKeys("*", func(key, val string) bool {
+		empty = false
+		return false
+	})
+	if err != nil || empty {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+func (db *BuntDB) migrate(backup func(version int) error) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		from, err := buntdbSchemaVersion(tx)
+		if err != nil {
+			return wrap("get schema version", err)
+		}
+
+		if upToDate, err := checkVersion(from); upToDate || err != nil {
+			return err
+		}
+
+		if err := backup(from); err != nil {
+			return err
+		}
+
+		for _, migration := range pendingMigrations(from) {
+			if migration.buntdb == nil {
+				continue
+			}
+
+			if err := migration.buntdb(tx); err != nil {
+				return fmt.Errorf("migration to version %d (%s): %w", migration.version, migration.description, err)
+			}
+		}
+
+		_, _, err = tx.Set("schema_version", strconv.Itoa(SchemaVersion), nil)
+		return err
+	})
+
+	return wrapMigration(err)
+}
+
+// Get a metadata value; returns an empty string if not set
+func (db *BuntDB) GetMeta(key string) (string, error) {
+	var val string
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+		val, err = tx.Get(fmt.Sprintf("meta:%s", key))
+		return err
+	})
+
+	if err == buntdb.ErrNotFound {
+		return "", nil
+	}
+
+	return val, wrap("get metadata", err)
+}
+
+// Set a metadata value; an empty value deletes it
+func (db *BuntDB) SetMeta(key, value string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		if value == "" {
+			_, err := tx.Delete(fmt.Sprintf("meta:%s", key))
+			if err == buntdb.ErrNotFound {
+				return nil
+			}
+			return err
+		}
+
+		_, _, err := tx.Set(fmt.Sprintf("meta:%s", key), value, nil)
+		return err
+	})
+
+	return wrap("set metadata", err)
+}
+
+// Save session in database
+func (db *BuntDB) SetSession(name string, session session.Session) error {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return wrap("marshal session", err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		_, _, err = tx.Set(fmt.Sprintf("session:%s", name), string(encoded), nil)
+		return err
+	})
+
+	return wrap("save session", err)
+}
+
+// Save a new session, unless name is used
+func (db *BuntDB) CreateSession(name string, session session.Session) error {
+	encoded, err := json.Marshal(session)
+	if err != nil {
+		return wrap("marshal session", err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		key := fmt.Sprintf("session:%s", name)
+
+		if _, err := tx.Get(key); err == nil {
+			return fmt.Errorf("%w: %s", ErrSessionExists, name)
+		} else if err != buntdb.ErrNotFound {
+			return err
+		}
+
+		_, _, err := tx.Set(key, string(encoded), nil)
+		return err
+	})
+
+	if errors.Is(err, ErrSessionExists) {
+		return err
+	}
+
+	return wrap("create session", err)
+}
+
+// Update session atomically: fn is given the latest saved session, which is
+// saved unless fn returns an error
+func (db *BuntDB) UpdateSession(name string, fn func(s *session.Session) error) error {
+	var fnErr error
+
+	err := db.update(func(tx *buntdb.Tx) error {
+		var s session.Session
+
+		val, err := tx.Get(fmt.Sprintf("session:%s", name))
+		if err == buntdb.ErrNotFound {
+			return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+		} else if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(val), &s); err != nil {
+			return wrap("unmarshal session", err)
+		}
+
+		if fnErr = fn(&s); fnErr != nil {
+			return fnErr
+		}
+
+		encoded, err := json.Marshal(s)
+		if err != nil {
+			return wrap("marshal session", err)
+		}
+
+		_, _, err = tx.Set(fmt.Sprintf("session:%s", name), string(encoded), nil)
+		return err
+	})
+
+	if fnErr != nil || errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+
+	return wrap("update session", err)
+}
+
+// Retrieve session from database
+func (db *BuntDB) GetSession(name string) (session.Session, error) {
+	var session session.Session
+	var val string
+	var err error
+
+	err = db.view(func(tx *buntdb.Tx) error {
+		val, err = tx.Get(fmt.Sprintf("session:%s", name))
+		return err
+	})
+
+	if err == buntdb.ErrNotFound {
+		return session, fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+	} else if err != nil {
+		return session, wrap("retrieve session", err)
+	}
+
+	err = json.Unmarshal([]byte(val), &session)
+	if err != nil {
+		return session, wrap("unmarshal session", err)
+	}
+
+	return session, nil
+}
+
+// List sessions from database and returns an array of strings
+func (db *BuntDB) ListSessions() ([]string, error) {
+	var sessions []string
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		tx.Ascend("sessions", func(key, val string) bool {
+			sessions = append(sessions, strings.TrimPrefix(key, "session:"))
+			return true
+		})
+		return nil
+	})
+
+	return sessions, wrap("list sessions", err)
+}
+
+// Rename session atomically, along with its cached embeddings and the
+// current session
+func (db *BuntDB) RenameSession(name, newName string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		val, err := tx.Delete(fmt.Sprintf("session:%s", name))
+		if err == buntdb.ErrNotFound {
+			return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := tx.Get(fmt.Sprintf("session:%s", newName)); err == nil {
+			return fmt.Errorf("%w: %s", ErrSessionExists, newName)
+		} else if err != buntdb.ErrNotFound {
+			return err
+		}
+
+		if _, _, err := tx.Set(fmt.Sprintf("session:%s", newName), val, nil); err != nil {
+			return err
+		}
+
+		keys, err := positionKeys(tx, fmt.Sprintf("embedding:%s:", name))
+		if err != nil {
+			return err
+		}
+
+		for key, index := range keys {
+			val, err := tx.Delete(key)
+			if err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(fmt.Sprintf("embedding:%s:%d", newName, index), val, nil); err != nil {
+				return err
+			}
+		}
+
+		if current, err := tx.Get("current"); err == nil && current == fmt.Sprintf("session:%s", name) {
+			_, _, err = tx.Set("current", fmt.Sprintf("session:%s", newName), nil)
+			return err
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExists) {
+		return err
+	}
+
+	return wrap("rename session", err)
+}
+
+func (db *BuntDB) CopySession(name, newName string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		val, err := tx.Get(fmt.Sprintf("session:%s", name))
+		if err == buntdb.ErrNotFound {
+			return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := tx.Get(fmt.Sprintf("session:%s", newName)); err == nil {
+			return fmt.Errorf("%w: %s", ErrSessionExists, newName)
+		} else if err != buntdb.ErrNotFound {
+			return err
+		}
+
+		var s session.Session
+		if err := json.Unmarshal([]byte(val), &s); err != nil {
+			return wrap("unmarshal session", err)
+		}
+
+		s.Created = time.Now()
+		s.Archived = false
+
+		encoded, err := json.Marshal(s)
+		if err != nil {
+			return wrap("marshal session", err)
+		}
+
+		if _, _, err := tx.Set(fmt.Sprintf("session:%s", newName), string(encoded), nil); err != nil {
+			return err
+		}
+
+		keys, err := positionKeys(tx, fmt.Sprintf("embedding:%s:", name))
+		if err != nil {
+			return err
+		}
+
+		for key, index := range keys {
+			val, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(fmt.Sprintf("embedding:%s:%d", newName, index), val, nil); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	var storageErr *Error
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExists) || errors.As(err, &storageErr) {
+		return err
+	}
+
+	return wrap("copy session", err)
+}
+
+// List metadata of sessions, by name
+func (db *BuntDB) ListSessionInfo() ([]session.Info, error) {
+	infos := []session.Info{}
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+
+		tx.AscendKeys("session:*", func(key, val string) bool {
+			var s session.Session
+			if err = json.Unmarshal([]byte(val), &s); err != nil {
+				return false
+			}
+
+			info := session.Info{
+				Name:        strings.TrimPrefix(key, "session:"),
+				Description: s.Description,
+				Model:       s.Model,
+				Created:     s.Created,
+				Updated:     s.Updated,
+				Archived:    s.Archived,
+				Tags:        s.Tags,
+				Messages:    len(s.Messages),
+			}
+			for _, message := range s.Messages {
+				info.Size += len(message.Content)
+			}
+
+			infos = append(infos, info)
+			return true
+		})
+
+		return err
+	})
+
+	return infos, wrap("list sessions", err)
+}
+
+// Set current session in database
+func (db *BuntDB) SetCurrentSession(name string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("current", fmt.Sprintf("session:%s", name), nil)
+		return err
+	})
+
+	return wrap("set current session", err)
+}
+
+// Get current session from database; returns ErrNoCurrentSession if none is
+// set
+func (db *BuntDB) GetCurrentSession() (string, error) {
+	var name string
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+		name, err = tx.Get("current")
+		return err
+	})
+
+	if err == buntdb.ErrNotFound || (err == nil && name == "") {
+		return "", ErrNoCurrentSession
+	} else if err != nil {
+		return "", wrap("get current session", err)
+	}
+
+	// Not having "session:" has a prefix should not be possible
+	if !strings.HasPrefix(name, "session:") {
+		return name, nil
+	}
+
+	// An empty name is set to unset the current session
+	name = strings.TrimPrefix(name, "session:")
+	if name == "" {
+		return "", ErrNoCurrentSession
+	}
+
+	return name, nil
+}
+
+// Delete given session in database, along with its cached embeddings
+func (db *BuntDB) DeleteSession(name string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(fmt.Sprintf("session:%s", name))
+		if err != nil {
+			return err
+		}
+
+		keys, err := positionKeys(tx, fmt.Sprintf("embedding:%s:", name))
+		if err != nil {
+			return err
+		}
+
+		for key := range keys {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err == buntdb.ErrNotFound {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+	}
+
+	return wrap("delete session", err)
+}
+
+// Save embeddings of session messages, indexed by message position
+func (db *BuntDB) SetEmbeddings(name string, embeddings map[int]embedding.Embedding) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		for index, e := range embeddings {
+			encoded, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			_, _, err = tx.Set(fmt.Sprintf("embedding:%s:%d", name, index), string(encoded), nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return wrap("save embeddings", err)
+}
+
+// Retrieve cached embeddings of session messages, indexed by message position
+func (db *BuntDB) GetEmbeddings(name string) (map[int]embedding.Embedding, error) {
+	embeddings := map[int]embedding.Embedding{}
+	prefix := fmt.Sprintf("embedding:%s:", name)
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+
+		ascendPrefix(tx, prefix, func(key, val string) bool {
+			var index int
+			var e embedding.Embedding
+
+			index, err = strconv.Atoi(strings.TrimPrefix(key, prefix))
+			if err != nil {
+				// key belongs to another session sharing the same prefix
+				err = nil
+				return true
+			}
+
+			if err = json.Unmarshal([]byte(val), &e); err != nil {
+				return false
+			}
+
+			embeddings[index] = e
+			return true
+		})
+
+		return err
+	})
+
+	if err != nil {
+		return nil, wrap("retrieve embeddings", err)
+	}
+
+	return embeddings, nil
+}
+
+// Save index details
+func (db *BuntDB) SetIndex(name string, index rag.Index) error {
+	encoded, err := json.Marshal(index)
+	if err != nil {
+		return wrap("marshal index", err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		_, _, err = tx.Set(fmt.Sprintf("index:%s", name), string(encoded), nil)
+		return err
+	})
+
+	return wrap("save index", err)
+}
+
+// Retrieve index details
+func (db *BuntDB) GetIndex(name string) (rag.Index, error) {
+	var index rag.Index
+	var val string
+	var err error
+
+	err = db.view(func(tx *buntdb.Tx) error {
+		val, err = tx.Get(fmt.Sprintf("index:%s", name))
+		return err
+	})
+
+	if err == buntdb.ErrNotFound {
+		return index, fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	} else if err != nil {
+		return index, wrap("retrieve index", err)
+	}
+
+	err = json.Unmarshal([]byte(val), &index)
+	if err != nil {
+		return index, wrap("unmarshal index", err)
+	}
+
+	return index, nil
+}
+
+// List indexes names from database
+func (db *BuntDB) ListIndexes() ([]string, error) {
+	var indexes []string
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("index:*", func(key, val string) bool {
+			indexes = append(indexes, strings.TrimPrefix(key, "index:"))
+			return true
+		})
+	})
+
+	return indexes, wrap("list indexes", err)
+}
+
+// Delete given index, along with its files and chunks
+func (db *BuntDB) DeleteIndex(name string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Delete(fmt.Sprintf("index:%s", name)); err != nil {
+			return err
+		}
+
+		if err := deleteKeys(tx, fmt.Sprintf("indexfile:%s:", name)); err != nil {
+			return err
+		}
+
+		return deleteKeys(tx, fmt.Sprintf("indexchunk:%s:", name))
+	})
+
+	if err == buntdb.ErrNotFound {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+
+	return wrap("delete index", err)
+}
+
+// Retrieve files of an index, by path
+func (db *BuntDB) GetIndexFiles(name string) (map[string]rag.File, error) {
+	files := map[string]rag.File{}
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+
+		ascendPrefix(tx, fmt.Sprintf("indexfile:%s:", name), func(key, val string) bool {
+			var file rag.File
+
+			if err = json.Unmarshal([]byte(val), &file); err != nil {
+				return false
+			}
+
+			files[file.Path] = file
+			return true
+		})
+
+		return err
+	})
+
+	if err != nil {
+		return nil, wrap("retrieve index files", err)
+	}
+
+	return files, nil
+}
+
+// Save an indexed file; chunks replace existing ones for this file unless nil
+func (db *BuntDB) SetIndexFile(name string, file rag.File, chunks []rag.Chunk) error {
+	encoded, err := json.Marshal(file)
+	if err != nil {
+		return wrap("marshal index file", err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf("indexfile:%s:%s", name, file.Path), string(encoded), nil)
+		if err != nil || chunks == nil {
+			return err
+		}
+
+		if err := deleteChunks(tx, name, file.Path); err != nil {
+			return err
+		}
+
+		for i, chunk := range chunks {
+			encoded, err := json.Marshal(chunk)
+			if err != nil {
+				return err
+			}
+
+			_, _, err = tx.Set(fmt.Sprintf("indexchunk:%s:%s:%d", name, file.Path, i), string(encoded), nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return wrap("save index file", err)
+}
+
+// Delete an indexed file and its chunks
+func (db *BuntDB) DeleteIndexFile(name, path string) error {
+	err := db.update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Delete(fmt.Sprintf("indexfile:%s:%s", name, path)); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+
+		return deleteChunks(tx, name, path)
+	})
+
+	return wrap("delete index file", err)
+}
+
+// Retrieve all chunks of an index
+func (db *BuntDB) GetIndexChunks(name string) ([]rag.Chunk, error) {
+	chunks := []rag.Chunk{}
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+
+		ascendPrefix(tx, fmt.Sprintf("indexchunk:%s:", name), func(key, val string) bool {
+			var chunk rag.Chunk
+
+			if err = json.Unmarshal([]byte(val), &chunk); err != nil {
+				return false
+			}
+
+			chunks = append(chunks, chunk)
+			return true
+		})
+
+		return err
+	})
+
+	if err != nil {
+		return nil, wrap("retrieve index chunks", err)
+	}
+
+	return chunks, nil
+}
+
+// Save a job submitted to the Batch API
+func (db *BuntDB) SetBatchJob(job batch.Job) error {
+	encoded, err := json.Marshal(job)
+	if err != nil {
+		return wrap("marshal batch", err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(fmt.Sprintf("batch:%s", job.ID), string(encoded), nil)
+		return err
+	})
+
+	return wrap("save batch", err)
+}
+
+// Retrieve a job submitted to the Batch API
+func (db *BuntDB) GetBatchJob(id string) (batch.Job, error) {
+	var job batch.Job
+	var val string
+	var err error
+
+	err = db.view(func(tx *buntdb.Tx) error {
+		val, err = tx.Get(fmt.Sprintf("batch:%s", id))
+		return err
+	})
+
+	if err == buntdb.ErrNotFound {
+		return job, fmt.Errorf("%w: %s", ErrBatchNotFound, id)
+	} else if err != nil {
+		return job, wrap("retrieve batch", err)
+	}
+
+	if err := json.Unmarshal([]byte(val), &job); err != nil {
+		return job, wrap("unmarshal batch", err)
+	}
+
+	return job, nil
+}
+
+// List jobs submitted to the Batch API, by creation time
+func (db *BuntDB) ListBatchJobs() ([]batch.Job, error) {
+	jobs := []batch.Job{}
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+
+		tx.AscendKeys("batch:*", func(key, val string) bool {
+			var job batch.Job
+			if err = json.Unmarshal([]byte(val), &job); err != nil {
+				return false
+			}
+
+			jobs = append(jobs, job)
+			return true
+		})
+
+		return err
+	})
+
+	if err != nil {
+		return nil, wrap("list batches", err)
+	}
+
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].Created.Before(jobs[j].Created) })
+
+	return jobs, nil
+}
+
+// Retrieve a cached reply; expired entries are not returned
+func (db *BuntDB) GetCacheEntry(key string) (cache.Entry, bool, error) {
+	var entry cache.Entry
+	var val string
+	var err error
+
+	err = db.view(func(tx *buntdb.Tx) error {
+		val, err = tx.Get(fmt.Sprintf("cache:%s", key))
+		return err
+	})
+
+	if err == buntdb.ErrNotFound {
+		return entry, false, nil
+	} else if err != nil {
+		return entry, false, wrap("retrieve cache entry", err)
+	}
+
+	if err := json.Unmarshal([]byte(val), &entry); err != nil {
+		return entry, false, wrap("unmarshal cache entry", err)
+	}
+
+	return entry, !entry.Expired(time.Now()), nil
+}
+
+// Save a cached reply, then remove expired entries and the oldest ones
+// beyond maxEntries
+func (db *BuntDB) SetCacheEntry(key string, entry cache.Entry, maxEntries int) error {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return wrap("marshal cache entry", err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		if _, _, err := tx.Set(fmt.Sprintf("cache:%s", key), string(encoded), nil); err != nil {
+			return err
+		}
+
+		type cached struct {
+			key     string
+			created time.Time
+		}
+
+		now := time.Now()
+		kept := []cached{}
+		removed := []string{}
+
+		tx.AscendKeys("cache:*", func(key, val string) bool {
+			var entry cache.Entry
+			if json.Unmarshal([]byte(val), &entry) != nil || entry.Expired(now) {
+				removed = append(removed, key)
+			} else {
+				kept = append(kept, cached{key, entry.Created})
+			}
+			return true
+		})
+
+		if len(kept) > maxEntries {
+			sort.Slice(kept, func(i, j int) bool { return kept[i].created.After(kept[j].created) })
+			for _, c := range kept[maxEntries:] {
+				removed = append(removed, c.key)
+			}
+		}
+
+		for _, key := range removed {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return wrap("save cache entry", err)
+}
+
+// Describe the content of the response cache
+func (db *BuntDB) GetCacheStats() (cache.Stats, error) {
+	var stats cache.Stats
+
+	now := time.Now()
+
+	err := db.view(func(tx *buntdb.Tx) error {
+		var err error
+
+		tx.AscendKeys("cache:*", func(key, val string) bool {
+			var entry cache.Entry
+			if err = json.Unmarshal([]byte(val), &entry); err != nil {
+				return false
+			}
+
+			stats.Add(entry, now)
+			return true
+		})
+
+		return err
+	})
+
+	return stats, wrap("get cache stats", err)
+}
+
+// Remove entries of the response cache, or only expired ones; returns the
+// number of entries removed
+func (db *BuntDB) ClearCache(expiredOnly bool) (int, error) {
+	removed := 0
+	now := time.Now()
+
+	err := db.update(func(tx *buntdb.Tx) error {
+		keys := []string{}
+
+		tx.AscendKeys("cache:*", func(key, val string) bool {
+			var entry cache.Entry
+			if !expiredOnly || json.Unmarshal([]byte(val), &entry) != nil || entry.Expired(now) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+
+		for _, key := range keys {
+			if _, err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		removed = len(keys)
+
+		return nil
+	})
+
+	return removed, wrap("clear cache", err)
+}
+
+// Iterates over keys starting with prefix. Unlike AscendKeys patterns, glob
+// characters of names in prefix are matched literally.
+func ascendPrefix(tx *buntdb.Tx, prefix string, iter func(key, val string) bool) error {
+	return tx.AscendGreaterOrEqual("", prefix, func(key, val string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		return iter(key, val)
+	})
+}
+
+// Returns keys made of prefix and a position, along with the position. Keys
+// of another name starting with the same one and a colon are skipped.
+func positionKeys(tx *buntdb.Tx, prefix string) (map[string]int, error) {
+	keys := map[string]int{}
+
+	err := ascendPrefix(tx, prefix, func(key, val string) bool {
+		if index, err := strconv.Atoi(strings.TrimPrefix(key, prefix)); err == nil {
+			keys[key] = index
+		}
+		return true
+	})
+
+	return keys, err
+}
+
+// Deletes chunks of an indexed file
+func deleteChunks(tx *buntdb.Tx, name, path string) error {
+	keys, err := positionKeys(tx, fmt.Sprintf("indexchunk:%s:%s:", name, path))
+	if err != nil {
+		return err
+	}
+
+	for key := range keys {
+		if _, err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Deletes keys starting with prefix
+func deleteKeys(tx *buntdb.Tx, prefix string) error {
+	var keys []string
+
+	err := ascendPrefix(tx, prefix, func(key, val string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Shrink/compact database
+func (db *BuntDB) Shrink() error {
+	err := db.withLock(true, func() error {
+		return db.handle.Shrink()
+	})
+
+	return wrap("shrink database", err)
+}
+
+// Write a consistent snapshot of the database to a new file
+func (db *BuntDB) Backup(filePath string) error {
+	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return wrap("back up database", err)
+	}
+
+	err = db.withLock(false, func() error {
+		return db.handle.Save(f)
+	})
+	if err != nil {
+		f.Close()
+		os.Remove(filePath)
+		return wrap("back up database", err)
+	}
+
+	return wrap("back up database", f.Close())
+}
+
+// Close the database handle
+func (db *BuntDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.lock.Close()
+
+	if db.handle == nil {
+		return nil
+	}
+
+	return wrap("close database", db.handle.Close())
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Roles a message can have
+var validRoles = map[string]bool{
+	openai.ChatMessageRoleSystem:    true,
+	openai.ChatMessageRoleUser:      true,
+	openai.ChatMessageRoleAssistant: true,
+	openai.ChatMessageRoleFunction:  true,
+	openai.ChatMessageRoleTool:      true,
+}
+
+// Issue is a problem found in the database
+type Issue struct {
+	Session     string
+	Description string
+	// Fixable issues are repaired by Check when asked to
+	Fixable bool
+	Fixed   bool
+}
+
+func (i Issue) String() string {
+	status := ""
+	if i.Fixed {
+		status = " (fixed)"
+	} else if i.Fixable {
+		status = " (fixable)"
+	}
+
+	if i.Session == "" {
+		return i.Description + status
+	}
+
+	return fmt.Sprintf("session %s: %s%s", i.Session, i.Description, status)
+}
+
+// Checks that sessions can be read, that their messages have valid roles and
+// that the current session exists. If fix is set, sessions which can't be
+// read are deleted, once the database is backed up to backupPath, and a
+// dangling current session is unset.
+func Check(store Store, fix bool, backupPath string) ([]Issue, error) {
+	issues := []Issue{}
+	backedUp := false
+
+	sessions, err := store.ListSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	existing := map[string]bool{}
+
+	for _, name := range sessions {
+		s, err := store.GetSession(name)
+
+		var storageErr *Error
+		if errors.As(err, &storageErr) && storageErr.Op == "unmarshal session" {
+			issue := Issue{
+				Session:     name,
+				Description: fmt.Sprintf("can't be decoded: %v", storageErr.Err),
+				Fixable:     true,
+			}
+
+			if fix {
+				if !backedUp {
+					if err := store.Backup(backupPath); err != nil {
+						return issues, err
+					}
+					backedUp = true
+				}
+
+				if err := store.DeleteSession(name); err != nil {
+					return issues, err
+				}
+				issue.Description += "; deleted, kept in " + backupPath
+				issue.Fixed = true
+			}
+
+			issues = append(issues, issue)
+			continue
+		} else if err != nil {
+			return issues, err
+		}
+
+		existing[name] = true
+
+		for index, message := range s.Messages {
+			if !validRoles[message.Role] {
+				issues = append(issues, Issue{
+					Session:     name,
+					Description: fmt.Sprintf("message #%d has invalid role %q", index, message.Role),
+				})
+			}
+		}
+	}
+
+	current, err := store.GetCurrentSession()
+	if err != nil && !errors.Is(err, ErrNoCurrentSession) {
+		return issues, err
+	}
+
+	if err == nil && !existing[current] {
+		issue := Issue{
+			Description: fmt.Sprintf("current session %s does not exist", current),
+			Fixable:     true,
+		}
+
+		if fix {
+			if err := store.SetCurrentSession(""); err != nil {
+				return issues, err
+			}
+			issue.Fixed = true
+		}
+
+		issues = append(issues, issue)
+	}
+
+	return issues, nil
+}
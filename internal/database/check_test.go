@@ -0,0 +1,72 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+func TestCheckFix(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := OpenBuntDB(filepath.Join(dir, "data.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.SetSession("good", session.NewSession("", "")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("session:bad", "{", nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backupPath := filepath.Join(dir, "data.db.check.bak")
+
+	issues, err := Check(db, true, backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].Session != "bad" || !issues[0].Fixed {
+		t.Fatalf("got issues %v", issues)
+	}
+
+	if sessions, err := db.ListSessions(); err != nil || len(sessions) != 1 || sessions[0] != "good" {
+		t.Errorf("got sessions %v (%v)", sessions, err)
+	}
+
+	// The deleted value is kept as it was
+	backup, err := OpenBuntDB(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	err = backup.view(func(tx *buntdb.Tx) error {
+		val, err := tx.Get("session:bad")
+		if err == nil && val != "{" {
+			t.Errorf("backup has %q", val)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing left to fix: no other backup is made
+	if issues, err := Check(db, true, filepath.Join(dir, "other.bak")); err != nil || len(issues) != 0 {
+		t.Errorf("got issues %v (%v)", issues, err)
+	}
+	if backups, _ := filepath.Glob(filepath.Join(dir, "*.bak")); len(backups) != 1 {
+		t.Errorf("got backups %v", backups)
+	}
+}
@@ -0,0 +1,451 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+
+	"git.mkz.me/mycroft/asoai/internal/cache"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+const (
+	// Metadata key holding encryption parameters
+	metaEncryption = "encryption"
+	// Prefix of encrypted values
+	encryptedPrefix = "enc:v1:"
+	// Value encrypted to verify the key
+	keyCheck = "asoai"
+)
+
+var (
+	ErrEncrypted       = errors.New("database is encrypted: set ASOAI_DB_PASSPHRASE or ASOAI_DB_KEY_FILE")
+	ErrWrongPassphrase = errors.New("wrong database passphrase")
+)
+
+// SecretFunc returns the passphrase used to encrypt the database
+type SecretFunc func() (string, error)
+
+// Encryption parameters, stored in the database
+type encryption struct {
+	KDF   string `json:"kdf"`
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Check string `json:"check"`
+}
+
+// Returns the passphrase set in ASOAI_DB_PASSPHRASE, or the content of the
+// file set in ASOAI_DB_KEY_FILE, or an empty string
+func SecretFromEnv() (string, error) {
+	if passphrase := os.Getenv("ASOAI_DB_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	if keyFile := os.Getenv("ASOAI_DB_KEY_FILE"); keyFile != "" {
+		return SecretFromFile(keyFile)
+	}
+
+	return "", nil
+}
+
+// Returns the content of a key file, without trailing new lines
+func SecretFromFile(filePath string) (string, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("could not read key file: %w", err)
+	}
+
+	secret := strings.TrimRight(string(content), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("key file %s is empty", filePath)
+	}
+
+	return secret, nil
+}
+
+// Returns true if the database is encrypted
+func IsEncrypted(store Store) (bool, error) {
+	params, err := store.GetMeta(metaEncryption)
+	return params != "", err
+}
+
+// Returns store decrypting its values, if encrypted; secret is only called
+// in that case
+func unlock(store Store, secret SecretFunc) (Store, error) {
+	params, err := store.GetMeta(metaEncryption)
+	if err != nil || params == "" {
+		return store, err
+	}
+
+	var e encryption
+	if err := json.Unmarshal([]byte(params), &e); err != nil {
+		return nil, wrap("read encryption parameters", err)
+	}
+
+	passphrase := ""
+	if secret != nil {
+		if passphrase, err = secret(); err != nil {
+			return nil, err
+		}
+	}
+
+	if passphrase == "" {
+		return nil, ErrEncrypted
+	}
+
+	aead, err := newAEAD(passphrase, e)
+	if err != nil {
+		return nil, err
+	}
+
+	if check, err := decrypt(aead, e.Check); err != nil || check != keyCheck {
+		return nil, ErrWrongPassphrase
+	}
+
+	return &encryptedStore{Store: store, aead: aead}, nil
+}
+
+// Encrypts the values of the database file using the passphrase. Values are
+// copied encrypted to a new file, which replaces the database once complete:
+// all values of an encrypted database are encrypted, and the plaintext file is
+// kept with a timestamped .bak suffix, whose path is returned. The response
+// cache is dropped.
+func Encrypt(filePath, passphrase string) (string, error) {
+	format, err := DetectFormat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	e := encryption{
+		KDF:  "scrypt",
+		Salt: make([]byte, 16),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+
+	if _, err := rand.Read(e.Salt); err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(passphrase, e)
+	if err != nil {
+		return "", err
+	}
+
+	if e.Check, err = encrypt(aead, keyCheck); err != nil {
+		return "", err
+	}
+
+	params, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	return rewrite(filePath, format, func(dst, src Store) error {
+		if encrypted, err := IsEncrypted(src); err != nil {
+			return err
+		} else if encrypted {
+			return errors.New("database is already encrypted")
+		}
+
+		if err := dst.SetMeta(metaEncryption, string(params)); err != nil {
+			return err
+		}
+
+		return Copy(&encryptedStore{Store: dst, aead: aead}, src)
+	})
+}
+
+// Decrypts the values of the database file, copying them to a new file
+// which replaces the database once complete. The encrypted file is kept with
+// a timestamped .bak suffix, whose path is returned. The response cache is
+// dropped.
+func Decrypt(filePath string, secret SecretFunc) (string, error) {
+	format, err := DetectFormat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	// The passphrase is checked before locking the database, which is
+	// decrypted using the same one
+	passphrase := ""
+	remember := func() (string, error) {
+		if secret == nil {
+			return "", nil
+		}
+
+		var err error
+		passphrase, err = secret()
+		return passphrase, err
+	}
+
+	store, err := Open(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = unlock(store, remember)
+	store.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return rewrite(filePath, format, func(dst, src Store) error {
+		unlocked, err := unlock(src, func() (string, error) { return passphrase, nil })
+		if err != nil {
+			return err
+		}
+
+		encrypted, ok := unlocked.(*encryptedStore)
+		if !ok {
+			return errors.New("database is not encrypted")
+		}
+
+		if err := Copy(dst, encrypted); err != nil {
+			return err
+		}
+
+		// Copied along with the data
+		return dst.SetMeta(metaEncryption, "")
+	})
+}
+
+func newAEAD(passphrase string, e encryption) (cipher.AEAD, error) {
+	if e.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported key derivation function %s", e.KDF)
+	}
+
+	key, err := scrypt.Key([]byte(passphrase), e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encrypt(aead cipher.AEAD, plaintext string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts value. Empty values are kept as is; other values must be
+// encrypted, whatever their content, so no plaintext is mistaken for an
+// encrypted value.
+func decrypt(aead cipher.AEAD, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return "", errors.New("value is not encrypted")
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// encryptedStore encrypts session descriptions, message contents and index
+// chunks of the underlying store
+type encryptedStore struct {
+	Store
+	aead cipher.AEAD
+}
+
+func (db *encryptedStore) SetSession(name string, s session.Session) error {
+	if err := db.encryptSession(&s); err != nil {
+		return err
+	}
+
+	return db.Store.SetSession(name, s)
+}
+
+func (db *encryptedStore) CreateSession(name string, s session.Session) error {
+	if err := db.encryptSession(&s); err != nil {
+		return err
+	}
+
+	return db.Store.CreateSession(name, s)
+}
+
+func (db *encryptedStore) GetSession(name string) (session.Session, error) {
+	s, err := db.Store.GetSession(name)
+	if err != nil {
+		return s, err
+	}
+
+	return s, db.decryptSession(&s)
+}
+
+// Encrypts the session in place; messages are copied so the caller's slice
+// is left untouched
+func (db *encryptedStore) encryptSession(s *session.Session) error {
+	var err error
+
+	if s.Description, err = db.encrypt(s.Description); err != nil {
+		return wrap("encrypt session", err)
+	}
+
+	messages := make([]session.Message, len(s.Messages))
+	for i, message := range s.Messages {
+		if message.Content, err = db.encrypt(message.Content); err != nil {
+			return wrap("encrypt session", err)
+		}
+		messages[i] = message
+	}
+	s.Messages = messages
+
+	return nil
+}
+
+func (db *encryptedStore) decryptSession(s *session.Session) error {
+	var err error
+
+	if s.Description, err = decrypt(db.aead, s.Description); err != nil {
+		return wrap("decrypt session", err)
+	}
+
+	for i := range s.Messages {
+		if s.Messages[i].Content, err = decrypt(db.aead, s.Messages[i].Content); err != nil {
+			return wrap("decrypt session", err)
+		}
+	}
+
+	return nil
+}
+
+// Descriptions are decrypted. Sizes are those of decrypted messages, derived
+// from the size of encrypted ones without decrypting them.
+func (db *encryptedStore) ListSessionInfo() ([]session.Info, error) {
+	infos, err := db.Store.ListSessionInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	overhead := len(encryptedPrefix)
+	sealedOverhead := db.aead.NonceSize() + db.aead.Overhead()
+
+	for i := range infos {
+		if infos[i].Description, err = decrypt(db.aead, infos[i].Description); err != nil {
+			return nil, wrap("decrypt session", err)
+		}
+
+		encoded := infos[i].Size - infos[i].Messages*overhead
+		infos[i].Size = max(encoded*3/4-infos[i].Messages*sealedOverhead, 0)
+	}
+
+	return infos, nil
+}
+
+func (db *encryptedStore) UpdateSession(name string, fn func(s *session.Session) error) error {
+	return db.Store.UpdateSession(name, func(s *session.Session) error {
+		if err := db.decryptSession(s); err != nil {
+			return err
+		}
+
+		if err := fn(s); err != nil {
+			return err
+		}
+
+		return db.encryptSession(s)
+	})
+}
+
+func (db *encryptedStore) SetIndexFile(name string, file rag.File, chunks []rag.Chunk) error {
+	if chunks == nil {
+		return db.Store.SetIndexFile(name, file, nil)
+	}
+
+	encrypted := make([]rag.Chunk, len(chunks))
+	for i, chunk := range chunks {
+		var err error
+		if chunk.Content, err = db.encrypt(chunk.Content); err != nil {
+			return wrap("encrypt index chunk", err)
+		}
+		encrypted[i] = chunk
+	}
+
+	return db.Store.SetIndexFile(name, file, encrypted)
+}
+
+func (db *encryptedStore) GetIndexChunks(name string) ([]rag.Chunk, error) {
+	chunks, err := db.Store.GetIndexChunks(name)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range chunks {
+		if chunks[i].Content, err = decrypt(db.aead, chunks[i].Content); err != nil {
+			return nil, wrap("decrypt index chunk", err)
+		}
+	}
+
+	return chunks, nil
+}
+
+func (db *encryptedStore) GetCacheEntry(key string) (cache.Entry, bool, error) {
+	entry, found, err := db.Store.GetCacheEntry(key)
+	if err != nil || !found {
+		return entry, found, err
+	}
+
+	if entry.Content, err = decrypt(db.aead, entry.Content); err != nil {
+		return entry, false, wrap("decrypt cache entry", err)
+	}
+
+	return entry, true, nil
+}
+
+func (db *encryptedStore) SetCacheEntry(key string, entry cache.Entry, maxEntries int) error {
+	var err error
+	if entry.Content, err = db.encrypt(entry.Content); err != nil {
+		return wrap("encrypt cache entry", err)
+	}
+
+	return db.Store.SetCacheEntry(key, entry, maxEntries)
+}
+
+// Empty values are kept as is; others are always encrypted, even if they
+// look encrypted
+func (db *encryptedStore) encrypt(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+
+	return encrypt(db.aead, value)
+}
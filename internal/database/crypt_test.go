@@ -0,0 +1,108 @@
+package database
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+func TestEncryption(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		// Plaintext looking encrypted
+		content := encryptedPrefix + "AAAA"
+
+		s := session.NewSession("", "")
+		s.Description = encryptedPrefix
+		s.Messages = append(s.Messages, session.Message{Role: "user", Content: content})
+		if err := db.SetSession("s", s); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		backupPath, err := Encrypt(filePath, "pw")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The plaintext database is kept
+		backup, err := Open(backupPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept, err := backup.GetSession("s"); err != nil || kept.Messages[1].Content != content {
+			t.Errorf("backup: got %+v (%v)", kept, err)
+		}
+		backup.Close()
+
+		raw, err := Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stored, err := raw.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Messages[1].Content == content || !strings.HasPrefix(stored.Messages[1].Content, encryptedPrefix) || stored.Description == s.Description {
+			t.Errorf("values not encrypted: %+v", stored)
+		}
+
+		// Plaintext written without the passphrase is not taken for an
+		// encrypted value
+		if err := raw.SetSession("plain", s); err != nil {
+			t.Fatal(err)
+		}
+		raw.Close()
+
+		secret := func() (string, error) { return "pw", nil }
+		unlocked, err := OpenDatabase(filePath, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decrypted, err := unlocked.GetSession("s"); err != nil {
+			t.Fatal(err)
+		} else if decrypted.Messages[1].Content != content || decrypted.Description != s.Description {
+			t.Errorf("got %+v", decrypted)
+		}
+
+		if _, err := unlocked.GetSession("plain"); err == nil {
+			t.Errorf("plaintext value was read as encrypted")
+		}
+
+		if err := unlocked.DeleteSession("plain"); err != nil {
+			t.Fatal(err)
+		}
+		unlocked.Close()
+
+		if _, err := OpenDatabase(filePath, func() (string, error) { return "wrong", nil }); err != ErrWrongPassphrase {
+			t.Errorf("got %v with a wrong passphrase", err)
+		}
+
+		if _, err := Decrypt(filePath, secret); err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err = Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer raw.Close()
+
+		if encrypted, err := IsEncrypted(raw); err != nil || encrypted {
+			t.Errorf("database still encrypted (%v)", err)
+		}
+
+		if decrypted, err := raw.GetSession("s"); err != nil {
+			t.Fatal(err)
+		} else if decrypted.Messages[1].Content != content || decrypted.Description != s.Description {
+			t.Errorf("got %+v", decrypted)
+		}
+
+		if tmpFiles, _ := filepath.Glob(filepath.Join(filepath.Dir(filePath), "*.tmp*")); len(tmpFiles) != 0 {
+			t.Errorf("temporary files left: %v", tmpFiles)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrSessionExists    = errors.New("session already exists")
+	ErrNoCurrentSession = errors.New("no current session")
+	ErrIndexNotFound    = errors.New("index not found")
+	ErrBatchNotFound    = errors.New("batch not found")
+)
+
+// Error is returned when reading or writing the database fails
+type Error struct {
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("could not %s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Returns err wrapped in an *Error, or nil
+func wrap(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Err: err}
+}
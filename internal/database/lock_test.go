@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+const (
+	// Set in child processes to the database file they update
+	lockTestFileEnv = "ASOAI_LOCK_TEST_FILE"
+	// Set in child processes to the prefix of messages they append
+	lockTestWriterEnv = "ASOAI_LOCK_TEST_WRITER"
+	// Messages appended by each writer
+	lockTestAppends = 25
+)
+
+// Appends messages to session "s" of the database, opened by this writer
+func appendMessages(filePath, writer string) error {
+	db, err := Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for i := 0; i < lockTestAppends; i++ {
+		err := db.UpdateSession("s", func(s *session.Session) error {
+			s.Messages = append(s.Messages, session.Message{Role: "user", Content: fmt.Sprintf("%s-%d", writer, i)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Not a test: run by TestConcurrentAppends in child processes
+func TestAppendProcess(t *testing.T) {
+	filePath := os.Getenv(lockTestFileEnv)
+	if filePath == "" {
+		t.Skip("only run as a child process")
+	}
+
+	if err := appendMessages(filePath, os.Getenv(lockTestWriterEnv)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	const goroutines, processes = 4, 4
+
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		if err := db.SetSession("s", session.Session{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, goroutines+processes)
+
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(writer string) {
+				defer wg.Done()
+				errs <- appendMessages(filePath, writer)
+			}("goroutine" + strconv.Itoa(i))
+		}
+
+		for i := 0; i < processes; i++ {
+			wg.Add(1)
+			go func(writer string) {
+				defer wg.Done()
+
+				cmd := exec.Command(os.Args[0], "-test.run=^TestAppendProcess$", "-test.count=1")
+				cmd.Env = append(os.Environ(), lockTestFileEnv+"="+filePath, lockTestWriterEnv+"="+writer)
+				if output, err := cmd.CombinedOutput(); err != nil {
+					errs <- fmt.Errorf("%s: %w: %s", writer, err, output)
+					return
+				}
+				errs <- nil
+			}("process" + strconv.Itoa(i))
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s, err := db.GetSession("s")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Each writer's messages are all there, in order
+		next := map[string]int{}
+		for _, message := range s.Messages {
+			writer, n, _ := strings.Cut(message.Content, "-")
+			i, err := strconv.Atoi(n)
+			if err != nil {
+				t.Fatalf("unexpected message %q", message.Content)
+			}
+
+			if i != next[writer] {
+				t.Errorf("%s: got message %d, expected %d", writer, i, next[writer])
+			}
+			next[writer] = i + 1
+		}
+
+		if len(s.Messages) != (goroutines+processes)*lockTestAppends {
+			t.Errorf("got %d messages, expected %d", len(s.Messages), (goroutines+processes)*lockTestAppends)
+		}
+	})
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package database
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Locks f, shared by several processes unless exclusive is set; blocks until
+// the lock is acquired
+func lockFile(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags = windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	return windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &windows.Overlapped{})
+}
+
+func unlockFile(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &windows.Overlapped{})
+}
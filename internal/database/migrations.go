@@ -0,0 +1,283 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// SchemaVersion is the version of data written by this version of asoai
+const SchemaVersion = 5
+
+// A migration upgrades data from the previous schema version to version.
+// Backends with nothing to change leave their function nil.
+type migration struct {
+	version     int
+	description string
+	buntdb      func(tx *buntdb.Tx) error
+	sqlite      func(tx *sql.Tx) error
+}
+
+// Migrations, by increasing version
+var migrations = []migration{
+	{
+		version:     2,
+		description: `rename "message" field of sessions to "messages"`,
+		buntdb:      renameMessagesField,
+	},
+	{
+		version:     3,
+		description: "flag messages served from the response cache",
+		sqlite:      addMessagesCachedColumn,
+	},
+	{
+		version:     4,
+		description: "add creation and update times of sessions, and archiving",
+		buntdb:      stampSessions,
+		sqlite:      addSessionsLifecycleColumns,
+	},
+	{
+		version:     5,
+		description: "add tags of sessions",
+		sqlite:      addSessionsTagsColumn,
+	},
+}
+
+// Implemented by backends to report and upgrade their schema version
+type migrator interface {
+	// Returns the schema version; 0 for a new database, and 1 for data
+	// written before versions were stored
+	schemaVersion() (int, error)
+	// Reads the schema version again in a write transaction, so only one
+	// process migrates, and unless up to date, calls backup with it,
+	// applies newer migrations and stores SchemaVersion
+	migrate(backup func(version int) error) error
+}
+
+// Upgrades the database of the format to SchemaVersion, after backing up its
+// file
+func upgrade(filePath, format string, store Store) error {
+	m, ok := store.(migrator)
+	if !ok {
+		return nil
+	}
+
+	version, err := m.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if upToDate, err := checkVersion(version); upToDate || err != nil {
+		return err
+	}
+
+	return m.migrate(func(version int) error {
+		// New databases have nothing to back up
+		if version == 0 {
+			return nil
+		}
+
+		_, err := backupFile(filePath, format, fmt.Sprintf("v%d.%s", version, time.Now().Format("20060102-150405")))
+		return wrap("back up database", err)
+	})
+}
+
+// Returns true if data of the schema version needs no migration, or an error
+// if it was written by a newer version of asoai
+func checkVersion(version int) (bool, error) {
+	if version > SchemaVersion {
+		return true, fmt.Errorf("database schema version %d is newer than supported version %d: upgrade asoai", version, SchemaVersion)
+	}
+
+	return version == SchemaVersion, nil
+}
+
+// Copies the database file of the format to <filePath>.<suffix>.bak, or to
+// <filePath>.<suffix>-<n>.bak if taken, and returns the path of the copy
+func backupFile(filePath, format, suffix string) (string, error) {
+	for n := 0; ; n++ {
+		backupPath := fmt.Sprintf("%s.%s.bak", filePath, suffix)
+		if n > 0 {
+			backupPath = fmt.Sprintf("%s.%s-%d.bak", filePath, suffix, n)
+		}
+
+		err := copyDatabase(filePath, backupPath, format)
+		if !errors.Is(err, os.ErrExist) || n == 100 {
+			return backupPath, err
+		}
+	}
+}
+
+// Returns err, wrapped unless it already is
+func wrapMigration(err error) error {
+	var storageErr *Error
+	if errors.As(err, &storageErr) {
+		return err
+	}
+
+	return wrap("migrate database", err)
+}
+
+// Returns migrations to apply to data of schema version from; new databases
+// (version 0) are created with the current schema and need none
+func pendingMigrations(from int) []migration {
+	pending := []migration{}
+	for _, migration := range migrations {
+		if from != 0 && migration.version > from {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// Copies the database file of the format to dst, which must not exist.
+// SQLite files are copied by SQLite, as the locks it holds on them would be
+// released by closing a descriptor of the file.
+func copyDatabase(src, dst, format string) error {
+	if format == FormatSQLite {
+		return vacuumInto(src, dst)
+	}
+
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Version 2: sessions were saved with their messages in a "message" field
+func renameMessagesField(tx *buntdb.Tx) error {
+	updated := map[string]string{}
+
+	err := tx.AscendKeys("session:*", func(key, val string) bool {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal([]byte(val), &fields) != nil {
+			return true
+		}
+
+		messages, ok := fields["message"]
+		if !ok {
+			return true
+		}
+
+		delete(fields, "message")
+		if _, ok := fields["messages"]; !ok {
+			fields["messages"] = messages
+		}
+
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			return true
+		}
+
+		updated[key] = string(encoded)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, val := range updated {
+		if _, _, err := tx.Set(key, val, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Version 3: messages have a flag telling replies served from the cache.
+// Session JSON of buntdb omits it when unset.
+func addMessagesCachedColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE messages ADD COLUMN cached INTEGER NOT NULL DEFAULT 0`)
+	return err
+}
+
+// Version 4: sessions have creation and update times, and can be archived.
+// Times of existing sessions are unknown: the time of the migration is used,
+// so they are not considered old.
+func stampSessions(tx *buntdb.Tx) error {
+	now, err := json.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+
+	updated := map[string]string{}
+
+	err = tx.AscendKeys("session:*", func(key, val string) bool {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal([]byte(val), &fields) != nil {
+			return true
+		}
+
+		for _, field := range []string{"created", "updated"} {
+			if _, ok := fields[field]; !ok {
+				fields[field] = now
+			}
+		}
+
+		encoded, err := json.Marshal(fields)
+		if err != nil {
+			return true
+		}
+
+		updated[key] = string(encoded)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, val := range updated {
+		if _, _, err := tx.Set(key, val, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addSessionsLifecycleColumns(tx *sql.Tx) error {
+	for _, column := range []string{
+		`created TEXT NOT NULL DEFAULT ''`,
+		`updated TEXT NOT NULL DEFAULT ''`,
+		`archived INTEGER NOT NULL DEFAULT 0`,
+	} {
+		if _, err := tx.Exec(`ALTER TABLE sessions ADD COLUMN ` + column); err != nil {
+			return err
+		}
+	}
+
+	now := formatTime(time.Now())
+	_, err := tx.Exec(`UPDATE sessions SET created = ?, updated = ?`, now, now)
+	return err
+}
+
+// Version 5: sessions have tags. Session JSON of buntdb omits them when
+// unset.
+func addSessionsTagsColumn(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE sessions ADD COLUMN tags TEXT NOT NULL DEFAULT ''`)
+	return err
+}
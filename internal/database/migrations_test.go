@@ -0,0 +1,240 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Copies a fixture of testdata to a temporary directory, so it can be
+// migrated, and returns the path of the copy
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+
+	src, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	filePath := filepath.Join(t.TempDir(), name)
+	dst, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+
+	return filePath
+}
+
+// Returns backups of the file made by migrations
+func migrationBackups(t *testing.T, filePath string) []string {
+	t.Helper()
+
+	backups, err := filepath.Glob(filePath + ".v*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backups
+}
+
+// Checks the fixture's data was read and migrated
+func checkFixture(t *testing.T, db Store) {
+	t.Helper()
+
+	version, err := db.(migrator).schemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion {
+		t.Errorf("got schema version %d", version)
+	}
+
+	alpha, err := db.GetSession("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alpha.Description != "first session" || alpha.Model != "gpt-4o" || len(alpha.Messages) != 3 || alpha.Messages[2].Content != "hi there" {
+		t.Errorf("unexpected session %+v", alpha)
+	}
+	if alpha.Created.IsZero() || alpha.Updated.IsZero() {
+		t.Errorf("session has no creation or update time")
+	}
+
+	current, err := db.GetCurrentSession()
+	if err != nil || current != "alpha" {
+		t.Errorf("got current session %q (%v)", current, err)
+	}
+
+	infos, err := db.ListSessionInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "alpha" || infos[0].Messages != 3 || infos[1].Name != "beta" {
+		t.Errorf("unexpected infos %+v", infos)
+	}
+
+	// Columns added by migrations can be written
+	alpha.Tags = []string{"test"}
+	alpha.Archived = true
+	alpha.Messages[2].Cached = true
+	if err := db.SetSession("alpha", alpha); err != nil {
+		t.Fatal(err)
+	}
+	if alpha, err = db.GetSession("alpha"); err != nil {
+		t.Fatal(err)
+	} else if !alpha.HasTag("test") || !alpha.Archived || !alpha.Messages[2].Cached {
+		t.Errorf("new fields not saved: %+v", alpha)
+	}
+}
+
+func TestOpenMigratesFixtures(t *testing.T) {
+	for version := 1; version < SchemaVersion; version++ {
+		for _, ext := range []string{"db", "sqlite"} {
+			name := fmt.Sprintf("v%d.%s", version, ext)
+
+			t.Run(name, func(t *testing.T) {
+				filePath := copyFixture(t, name)
+
+				db, err := Open(filePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkFixture(t, db)
+				if err := db.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				backups := migrationBackups(t, filePath)
+				if len(backups) != 1 || filepath.Base(backups[0])[:len(name)+3] != fmt.Sprintf("%s.v%d", name, version) {
+					t.Errorf("unexpected backups %q", backups)
+				}
+
+				// Opening again doesn't migrate
+				db, err = Open(filePath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				db.Close()
+
+				if backups := migrationBackups(t, filePath); len(backups) != 1 {
+					t.Errorf("unexpected backups %q", backups)
+				}
+			})
+		}
+	}
+}
+
+func TestConcurrentMigrations(t *testing.T) {
+	for _, name := range []string{"v1.db", "v1.sqlite", "v3.sqlite"} {
+		t.Run(name, func(t *testing.T) {
+			filePath := copyFixture(t, name)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 8)
+
+			for i := 0; i < cap(errs); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					db, err := Open(filePath)
+					if err != nil {
+						errs <- err
+						return
+					}
+					errs <- db.Close()
+				}()
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				if err != nil {
+					t.Error(err)
+				}
+			}
+
+			if backups := migrationBackups(t, filePath); len(backups) != 1 {
+				t.Errorf("expected a single migration, got backups %q", backups)
+			}
+
+			db, err := Open(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkFixture(t, db)
+		})
+	}
+}
+
+func TestNewDatabaseIsNotMigrated(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		version, err := db.(migrator).schemaVersion()
+		if err != nil || version != SchemaVersion {
+			t.Errorf("got schema version %d (%v)", version, err)
+		}
+
+		if backups := migrationBackups(t, filePath); len(backups) != 0 {
+			t.Errorf("unexpected backups %q", backups)
+		}
+	})
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	for _, ext := range []string{"db", "sqlite"} {
+		t.Run(ext, func(t *testing.T) {
+			// Older versions are not opened, nor migrated
+			filePath := copyFixture(t, "v1."+ext)
+			before, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if db, err := OpenReadOnly(filePath); err == nil {
+				db.Close()
+				t.Error("old version was opened")
+			}
+
+			if after, err := os.ReadFile(filePath); err != nil || string(after) != string(before) {
+				t.Errorf("file was changed (%v)", err)
+			}
+			if backups := migrationBackups(t, filePath); len(backups) != 0 {
+				t.Errorf("unexpected backups %q", backups)
+			}
+
+			// Migrated data is read
+			db, err := Open(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Close()
+
+			db, err = OpenReadOnly(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			if sessions, err := db.ListSessions(); err != nil || len(sessions) != 2 {
+				t.Errorf("got sessions %v (%v)", sessions, err)
+			}
+
+			if _, ok := db.(*SQLite); ok {
+				if err := db.SetCurrentSession("beta"); err == nil {
+					t.Error("read-only database was written")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1283 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"git.mkz.me/mycroft/asoai/internal/batch"
+	"git.mkz.me/mycroft/asoai/internal/cache"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	name TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	model TEXT NOT NULL DEFAULT '',
+	created TEXT NOT NULL DEFAULT '',
+	updated TEXT NOT NULL DEFAULT '',
+	archived INTEGER NOT NULL DEFAULT 0,
+	-- Comma separated
+	tags TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	session TEXT NOT NULL REFERENCES sessions(name) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	role TEXT NOT NULL,
+	content TEXT NOT NULL,
+	cached INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (session, position)
+);
+
+CREATE TABLE IF NOT EXISTS embeddings (
+	session TEXT NOT NULL REFERENCES sessions(name) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	model TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	vector BLOB NOT NULL,
+	PRIMARY KEY (session, position)
+);
+
+CREATE TABLE IF NOT EXISTS indexes (
+	name TEXT PRIMARY KEY,
+	root TEXT NOT NULL,
+	model TEXT NOT NULL,
+	updated TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS index_files (
+	index_name TEXT NOT NULL,
+	path TEXT NOT NULL,
+	mtime TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	model TEXT NOT NULL,
+	PRIMARY KEY (index_name, path)
+);
+
+CREATE TABLE IF NOT EXISTS index_chunks (
+	index_name TEXT NOT NULL,
+	path TEXT NOT NULL,
+	position INTEGER NOT NULL,
+	start_line INTEGER NOT NULL,
+	end_line INTEGER NOT NULL,
+	content TEXT NOT NULL,
+	model TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	vector BLOB NOT NULL,
+	PRIMARY KEY (index_name, path, position)
+);
+
+CREATE TABLE IF NOT EXISTS batches (
+	id TEXT PRIMARY KEY,
+	status TEXT NOT NULL,
+	input TEXT NOT NULL,
+	input_file_id TEXT NOT NULL,
+	output_file_id TEXT NOT NULL,
+	error_file_id TEXT NOT NULL,
+	created TEXT NOT NULL,
+	total INTEGER NOT NULL,
+	completed INTEGER NOT NULL,
+	failed INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS cache (
+	key TEXT PRIMARY KEY,
+	role TEXT NOT NULL,
+	content TEXT NOT NULL,
+	-- Unix times in nanoseconds, so entries can be ordered
+	created INTEGER NOT NULL,
+	expires INTEGER NOT NULL
+);
+`
+
+// SQLite stores data in normalized tables of a SQLite database; only the
+// rows needed are read
+type SQLite struct {
+	filePath string
+	readOnly bool
+
+	// Held for reading while the handle is used, so it's only closed once
+	// unused
+	mu     sync.RWMutex
+	handle *sql.DB
+	// File the handle was opened on
+	opened os.FileInfo
+}
+
+// Number of handles of this process on SQLite files, by path. SQLite locks
+// files with POSIX locks, which a process loses when closing any descriptor
+// of the file, so files opened here are not read by other means.
+var sqliteFiles = struct {
+	sync.Mutex
+	handles map[string]int
+}{handles: map[string]int{}}
+
+// Returns true if this process has a handle on the SQLite file
+func sqliteOpen(filePath string) bool {
+	sqliteFiles.Lock()
+	defer sqliteFiles.Unlock()
+
+	return sqliteFiles.handles[filePath] > 0
+}
+
+// Opens the SQLite database located in the given file path, creating tables
+// if needed
+func OpenSQLite(filePath string) (*SQLite, error) {
+	return openSQLite(filePath, false)
+}
+
+// Opens the SQLite database; read-only databases must exist, and their
+// schema is not created
+func openSQLite(filePath string, readOnly bool) (*SQLite, error) {
+	db := &SQLite{
+		filePath: filePath,
+		readOnly: readOnly,
+	}
+
+	var err error
+	if db.handle, db.opened, err = db.open(); err != nil {
+		return nil, err
+	}
+
+	sqliteFiles.Lock()
+	sqliteFiles.handles[filePath]++
+	sqliteFiles.Unlock()
+
+	return db, nil
+}
+
+// Opens a handle on the database file, and returns it with the file it was
+// opened on
+func (db *SQLite) open() (*sql.DB, os.FileInfo, error) {
+	// Read first: if the file is replaced meanwhile, it's reopened when used
+	opened, statErr := os.Stat(db.filePath)
+	if statErr != nil && db.readOnly {
+		return nil, nil, wrap("open database", statErr)
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_txlock=immediate", db.filePath)
+	if db.readOnly {
+		dsn += "&mode=ro"
+	}
+
+	handle, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, nil, wrap("open database", err)
+	}
+
+	if db.readOnly {
+		return handle, opened, nil
+	}
+
+	if _, err := handle.Exec(sqliteSchema); err != nil {
+		handle.Close()
+		return nil, nil, wrap("open database", err)
+	}
+
+	// New files are created along with the schema
+	if statErr != nil {
+		if opened, err = os.Stat(db.filePath); err != nil {
+			handle.Close()
+			return nil, nil, wrap("open database", err)
+		}
+	}
+
+	return handle, opened, nil
+}
+
+// Returns true if the database file is no longer the one opened, as when
+// replaced by a restore or a migration of another process
+func (db *SQLite) replaced(opened os.FileInfo) bool {
+	info, err := os.Stat(db.filePath)
+	return err == nil && !os.SameFile(info, opened)
+}
+
+// Replaces the stale handle by one on the current database file, once no
+// longer used
+func (db *SQLite) reopen(stale *sql.DB) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Already reopened by another goroutine
+	if db.handle != stale {
+		return nil
+	}
+
+	handle, opened, err := db.open()
+	if err != nil {
+		return err
+	}
+
+	stale.Close()
+	db.handle, db.opened = handle, opened
+
+	return nil
+}
+
+// Runs fn in a transaction of the current database file. Replacing the file
+// takes its write lock, so once a transaction started, the file checked is
+// the one written to.
+func (db *SQLite) transaction(readOnly bool, fn func(tx *sql.Tx) error) error {
+	for {
+		db.mu.RLock()
+		handle := db.handle
+
+		tx, err := handle.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: readOnly})
+		if err != nil {
+			db.mu.RUnlock()
+			return err
+		}
+
+		if db.replaced(db.opened) {
+			tx.Rollback()
+			db.mu.RUnlock()
+
+			if err := db.reopen(handle); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = fn(tx)
+		if err == nil && !readOnly {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+
+		db.mu.RUnlock()
+		return err
+	}
+}
+
+// Runs fn with a handle on the current database file, for statements which
+// can't run in a transaction
+func (db *SQLite) withHandle(fn func(handle *sql.DB) error) error {
+	for {
+		db.mu.RLock()
+		handle := db.handle
+
+		if !db.replaced(db.opened) {
+			defer db.mu.RUnlock()
+			return fn(handle)
+		}
+
+		db.mu.RUnlock()
+
+		if err := db.reopen(handle); err != nil {
+			return err
+		}
+	}
+}
+
+// Runs fn in a transaction, committed if fn returns no error
+func (db *SQLite) update(fn func(tx *sql.Tx) error) error {
+	return db.transaction(false, fn)
+}
+
+// Runs fn in a read-only transaction, so its queries see the same data.
+// Unlike update, no write lock is taken.
+func (db *SQLite) view(fn func(tx *sql.Tx) error) error {
+	return db.transaction(true, fn)
+}
+
+func (db *SQLite) schemaVersion() (int, error) {
+	var version int
+
+	err := db.view(func(tx *sql.Tx) error {
+		var err error
+		version, err = sqliteSchemaVersion(tx)
+		return err
+	})
+
+	return version, wrap("get schema version", err)
+}
+
+func sqliteSchemaVersion(q querier) (int, error) {
+	var val string
+
+	err := q.QueryRow(`SELECT value FROM meta WHERE key = 'schema_version'`).Scan(&val)
+	if err == nil {
+		return strconv.Atoi(val)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// Tables of databases written before versions were stored lack the
+	// columns added since, which new ones are created with
+	var legacy bool
+	err = q.QueryRow(`SELECT NOT EXISTS (SELECT 1 FROM pragma_table_info('messages') WHERE name = 'cached')`).Scan(&legacy)
+	if err != nil || !legacy {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+func (db *SQLite) migrate(backup func(version int) error) error {
+	err := db.update(func(tx *sql.Tx) error {
+		from, err := sqliteSchemaVersion(tx)
+		if err != nil {
+			return wrap("get schema version", err)
+		}
+
+		if upToDate, err := checkVersion(from); upToDate || err != nil {
+			return err
+		}
+
+		// The write lock is held, so the file doesn't change meanwhile
+		if err := backup(from); err != nil {
+			return err
+		}
+
+		for _, migration := range pendingMigrations(from) {
+			if migration.sqlite == nil {
+				continue
+			}
+
+			if err := migration.sqlite(tx); err != nil {
+				return fmt.Errorf("migration to version %d (%s): %w", migration.version, migration.description, err)
+			}
+		}
+
+		_, err = tx.Exec(`INSERT INTO meta (key, value) VALUES ('schema_version', ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value`, strconv.Itoa(SchemaVersion))
+		return err
+	})
+
+	return wrapMigration(err)
+}
+
+// Get a metadata value; returns an empty string if not set
+func (db *SQLite) GetMeta(key string) (string, error) {
+	var val string
+
+	err := db.view(func(tx *sql.Tx) error {
+		return tx.QueryRow(`SELECT value FROM meta WHERE key = ?`, "meta:"+key).Scan(&val)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+
+	return val, wrap("get metadata", err)
+}
+
+// Set a metadata value; an empty value deletes it
+func (db *SQLite) SetMeta(key, value string) error {
+	err := db.update(func(tx *sql.Tx) error {
+		var err error
+
+		if value == "" {
+			_, err = tx.Exec(`DELETE FROM meta WHERE key = ?`, "meta:"+key)
+		} else {
+			_, err = tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)
+				ON CONFLICT (key) DO UPDATE SET value = excluded.value`, "meta:"+key, value)
+		}
+
+		return err
+	})
+
+	return wrap("set metadata", err)
+}
+
+// Returns t as stored in text columns; the zero time is stored as an empty
+// string
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// Returns a time stored by formatTime
+func parseTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, val)
+}
+
+// Returns tags stored comma separated
+func splitTags(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, ",")
+}
+
+// Implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Save session in database
+func (db *SQLite) SetSession(name string, session session.Session) error {
+	err := db.update(func(tx *sql.Tx) error {
+		return setSession(tx, name, session)
+	})
+
+	return wrap("save session", err)
+}
+
+// Save a new session, unless name is used
+func (db *SQLite) CreateSession(name string, session session.Session) error {
+	err := db.update(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sessions WHERE name = ?)`, name).Scan(&exists); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("%w: %s", ErrSessionExists, name)
+		}
+
+		return setSession(tx, name, session)
+	})
+
+	if errors.Is(err, ErrSessionExists) {
+		return err
+	}
+
+	return wrap("create session", err)
+}
+
+// Retrieve session from database
+func (db *SQLite) GetSession(name string) (session.Session, error) {
+	var s session.Session
+
+	// The session and its messages are read in the same transaction, so
+	// a concurrent update is seen entirely or not at all
+	err := db.view(func(tx *sql.Tx) error {
+		var err error
+		s, err = getSession(tx, name)
+		return err
+	})
+
+	var storageErr *Error
+	if err == nil || errors.Is(err, ErrSessionNotFound) || errors.As(err, &storageErr) {
+		return s, err
+	}
+
+	return s, wrap("retrieve session", err)
+}
+
+// Update session atomically: fn is given the latest saved session, which is
+// saved unless fn returns an error
+func (db *SQLite) UpdateSession(name string, fn func(s *session.Session) error) error {
+	var fnErr error
+
+	err := db.update(func(tx *sql.Tx) error {
+		s, err := getSession(tx, name)
+		if err != nil {
+			return err
+		}
+
+		if fnErr = fn(&s); fnErr != nil {
+			return fnErr
+		}
+
+		return setSession(tx, name, s)
+	})
+
+	var storageErr *Error
+	if fnErr != nil || errors.Is(err, ErrSessionNotFound) || errors.As(err, &storageErr) {
+		return err
+	}
+
+	return wrap("update session", err)
+}
+
+func setSession(q querier, name string, session session.Session) error {
+	_, err := q.Exec(`INSERT INTO sessions (name, description, model, created, updated, archived, tags) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET description = excluded.description, model = excluded.model,
+			created = excluded.created, updated = excluded.updated, archived = excluded.archived, tags = excluded.tags`,
+		name, session.Description, session.Model, formatTime(session.Created), formatTime(session.Updated), session.Archived,
+		strings.Join(session.Tags, ","))
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.Exec(`DELETE FROM messages WHERE session = ?`, name); err != nil {
+		return err
+	}
+
+	for position, message := range session.Messages {
+		_, err := q.Exec(`INSERT INTO messages (session, position, role, content, cached) VALUES (?, ?, ?, ?, ?)`,
+			name, position, message.Role, message.Content, message.Cached)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getSession(q querier, name string) (session.Session, error) {
+	var s session.Session
+	var created, updated, tags string
+
+	err := q.QueryRow(`SELECT description, model, created, updated, archived, tags FROM sessions WHERE name = ?`, name).
+		Scan(&s.Description, &s.Model, &created, &updated, &s.Archived, &tags)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+	} else if err != nil {
+		return s, wrap("retrieve session", err)
+	}
+
+	if s.Created, err = parseTime(created); err != nil {
+		return s, wrap("retrieve session", err)
+	}
+	if s.Updated, err = parseTime(updated); err != nil {
+		return s, wrap("retrieve session", err)
+	}
+	s.Tags = splitTags(tags)
+
+	rows, err := q.Query(`SELECT role, content, cached FROM messages WHERE session = ? ORDER BY position`, name)
+	if err != nil {
+		return s, wrap("retrieve session", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var message session.Message
+		if err := rows.Scan(&message.Role, &message.Content, &message.Cached); err != nil {
+			return s, wrap("retrieve session", err)
+		}
+
+		s.Messages = append(s.Messages, message)
+	}
+
+	return s, wrap("retrieve session", rows.Err())
+}
+
+// List sessions from database and returns an array of strings
+func (db *SQLite) ListSessions() ([]string, error) {
+	sessions, err := db.queryStrings(`SELECT name FROM sessions ORDER BY name`)
+	return sessions, wrap("list sessions", err)
+}
+
+// List metadata of sessions, by name, counting messages in the same query
+func (db *SQLite) ListSessionInfo() ([]session.Info, error) {
+	infos := []session.Info{}
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT s.name, s.description, s.model, s.created, s.updated, s.archived, s.tags,
+				COUNT(m.position), COALESCE(SUM(LENGTH(CAST(m.content AS BLOB))), 0)
+			FROM sessions s LEFT JOIN messages m ON m.session = s.name
+			GROUP BY s.name ORDER BY s.name`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var info session.Info
+			var created, updated, tags string
+
+			err := rows.Scan(&info.Name, &info.Description, &info.Model, &created, &updated, &info.Archived, &tags,
+				&info.Messages, &info.Size)
+			if err != nil {
+				return err
+			}
+
+			if info.Created, err = parseTime(created); err != nil {
+				return err
+			}
+			if info.Updated, err = parseTime(updated); err != nil {
+				return err
+			}
+			info.Tags = splitTags(tags)
+
+			infos = append(infos, info)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, wrap("list sessions", err)
+	}
+
+	return infos, nil
+}
+
+// Delete given session in database, along with its cached embeddings
+func (db *SQLite) DeleteSession(name string) error {
+	err := db.update(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`DELETE FROM sessions WHERE name = ?`, name)
+		if err != nil {
+			return err
+		}
+
+		if count, err := result.RowsAffected(); err == nil && count == 0 {
+			return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, ErrSessionNotFound) {
+		return err
+	}
+
+	return wrap("delete session", err)
+}
+
+// Rename session atomically, along with its cached embeddings and the
+// current session
+func (db *SQLite) RenameSession(name, newName string) error {
+	err := db.update(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sessions WHERE name = ?)`, newName).Scan(&exists); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("%w: %s", ErrSessionExists, newName)
+		}
+
+		// The new row is inserted first, as messages and embeddings reference it
+		result, err := tx.Exec(`INSERT INTO sessions (name, description, model, created, updated, archived, tags)
+			SELECT ?, description, model, created, updated, archived, tags FROM sessions WHERE name = ?`, newName, name)
+		if err != nil {
+			return err
+		}
+
+		if count, err := result.RowsAffected(); err == nil && count == 0 {
+			return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+		}
+
+		for _, query := range []string{
+			`UPDATE messages SET session = ? WHERE session = ?`,
+			`UPDATE embeddings SET session = ? WHERE session = ?`,
+			`UPDATE meta SET value = ? WHERE key = 'current' AND value = ?`,
+		} {
+			if _, err := tx.Exec(query, newName, name); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`DELETE FROM sessions WHERE name = ?`, name)
+		return err
+	})
+
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExists) {
+		return err
+	}
+
+	return wrap("rename session", err)
+}
+
+func (db *SQLite) CopySession(name, newName string) error {
+	err := db.update(func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM sessions WHERE name = ?)`, newName).Scan(&exists); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("%w: %s", ErrSessionExists, newName)
+		}
+
+		result, err := tx.Exec(`INSERT INTO sessions (name, description, model, created, updated, archived, tags)
+			SELECT ?, description, model, ?, updated, 0, tags FROM sessions WHERE name = ?`, newName, formatTime(time.Now()), name)
+		if err != nil {
+			return err
+		}
+
+		if count, err := result.RowsAffected(); err == nil && count == 0 {
+			return fmt.Errorf("%w: %s", ErrSessionNotFound, name)
+		}
+
+		for _, query := range []string{
+			`INSERT INTO messages (session, position, role, content, cached)
+				SELECT ?, position, role, content, cached FROM messages WHERE session = ?`,
+			`INSERT INTO embeddings (session, position, model, hash, vector)
+				SELECT ?, position, model, hash, vector FROM embeddings WHERE session = ?`,
+		} {
+			if _, err := tx.Exec(query, newName, name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrSessionExists) {
+		return err
+	}
+
+	return wrap("copy session", err)
+}
+
+// Set current session in database
+func (db *SQLite) SetCurrentSession(name string) error {
+	err := db.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO meta (key, value) VALUES ('current', ?)
+			ON CONFLICT (key) DO UPDATE SET value = excluded.value`, name)
+		return err
+	})
+
+	return wrap("set current session", err)
+}
+
+// Get current session from database; returns ErrNoCurrentSession if none is
+// set
+func (db *SQLite) GetCurrentSession() (string, error) {
+	var name string
+
+	err := db.view(func(tx *sql.Tx) error {
+		return tx.QueryRow(`SELECT value FROM meta WHERE key = 'current'`).Scan(&name)
+	})
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && name == "") {
+		return "", ErrNoCurrentSession
+	} else if err != nil {
+		return "", wrap("get current session", err)
+	}
+
+	return name, nil
+}
+
+// Save embeddings of session messages, indexed by message position
+func (db *SQLite) SetEmbeddings(name string, embeddings map[int]embedding.Embedding) error {
+	err := db.update(func(tx *sql.Tx) error {
+		for position, e := range embeddings {
+			_, err := tx.Exec(`INSERT INTO embeddings (session, position, model, hash, vector) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (session, position) DO UPDATE SET model = excluded.model, hash = excluded.hash, vector = excluded.vector`,
+				name, position, e.Model, e.Hash, encodeVector(e.Vector))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return wrap("save embeddings", err)
+}
+
+// Retrieve cached embeddings of session messages, indexed by message position
+func (db *SQLite) GetEmbeddings(name string) (map[int]embedding.Embedding, error) {
+	embeddings := map[int]embedding.Embedding{}
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT position, model, hash, vector FROM embeddings WHERE session = ?`, name)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var position int
+			var e embedding.Embedding
+			var vector []byte
+
+			if err := rows.Scan(&position, &e.Model, &e.Hash, &vector); err != nil {
+				return err
+			}
+
+			e.Vector = decodeVector(vector)
+			embeddings[position] = e
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, wrap("retrieve embeddings", err)
+	}
+
+	return embeddings, nil
+}
+
+// Save index details
+func (db *SQLite) SetIndex(name string, index rag.Index) error {
+	err := db.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO indexes (name, root, model, updated) VALUES (?, ?, ?, ?)
+			ON CONFLICT (name) DO UPDATE SET root = excluded.root, model = excluded.model, updated = excluded.updated`,
+			name, index.Root, index.Model, index.Updated.Format(time.RFC3339Nano))
+		return err
+	})
+
+	return wrap("save index", err)
+}
+
+// Retrieve index details
+func (db *SQLite) GetIndex(name string) (rag.Index, error) {
+	var index rag.Index
+	var updated string
+
+	err := db.view(func(tx *sql.Tx) error {
+		return tx.QueryRow(`SELECT root, model, updated FROM indexes WHERE name = ?`, name).Scan(&index.Root, &index.Model, &updated)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return index, fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	} else if err != nil {
+		return index, wrap("retrieve index", err)
+	}
+
+	index.Updated, err = time.Parse(time.RFC3339Nano, updated)
+
+	return index, wrap("retrieve index", err)
+}
+
+// List indexes names from database
+func (db *SQLite) ListIndexes() ([]string, error) {
+	indexes, err := db.queryStrings(`SELECT name FROM indexes ORDER BY name`)
+	return indexes, wrap("list indexes", err)
+}
+
+// Delete given index, along with its files and chunks
+func (db *SQLite) DeleteIndex(name string) error {
+	found := true
+
+	err := db.update(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`DELETE FROM indexes WHERE name = ?`, name)
+		if err != nil {
+			return err
+		}
+
+		if count, err := result.RowsAffected(); err == nil && count == 0 {
+			found = false
+			return nil
+		}
+
+		if _, err := tx.Exec(`DELETE FROM index_files WHERE index_name = ?`, name); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM index_chunks WHERE index_name = ?`, name)
+		return err
+	})
+
+	if err == nil && !found {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+
+	return wrap("delete index", err)
+}
+
+// Retrieve files of an index, by path
+func (db *SQLite) GetIndexFiles(name string) (map[string]rag.File, error) {
+	files := map[string]rag.File{}
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT path, mtime, size, hash, model FROM index_files WHERE index_name = ?`, name)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var file rag.File
+			var mtime string
+
+			if err := rows.Scan(&file.Path, &mtime, &file.Size, &file.Hash, &file.Model); err != nil {
+				return err
+			}
+
+			if file.ModTime, err = time.Parse(time.RFC3339Nano, mtime); err != nil {
+				return err
+			}
+
+			files[file.Path] = file
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, wrap("retrieve index files", err)
+	}
+
+	return files, nil
+}
+
+// Save an indexed file; chunks replace existing ones for this file unless nil
+func (db *SQLite) SetIndexFile(name string, file rag.File, chunks []rag.Chunk) error {
+	err := db.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO index_files (index_name, path, mtime, size, hash, model) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (index_name, path) DO UPDATE SET mtime = excluded.mtime, size = excluded.size, hash = excluded.hash, model = excluded.model`,
+			name, file.Path, file.ModTime.Format(time.RFC3339Nano), file.Size, file.Hash, file.Model)
+		if err != nil || chunks == nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM index_chunks WHERE index_name = ? AND path = ?`, name, file.Path); err != nil {
+			return err
+		}
+
+		for position, chunk := range chunks {
+			_, err := tx.Exec(`INSERT INTO index_chunks (index_name, path, position, start_line, end_line, content, model, hash, vector)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				name, file.Path, position, chunk.StartLine, chunk.EndLine, chunk.Content,
+				chunk.Embedding.Model, chunk.Embedding.Hash, encodeVector(chunk.Embedding.Vector))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return wrap("save index file", err)
+}
+
+// Delete an indexed file and its chunks
+func (db *SQLite) DeleteIndexFile(name, path string) error {
+	err := db.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM index_files WHERE index_name = ? AND path = ?`, name, path); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(`DELETE FROM index_chunks WHERE index_name = ? AND path = ?`, name, path)
+		return err
+	})
+
+	return wrap("delete index file", err)
+}
+
+// Retrieve all chunks of an index
+func (db *SQLite) GetIndexChunks(name string) ([]rag.Chunk, error) {
+	chunks := []rag.Chunk{}
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT path, start_line, end_line, content, model, hash, vector FROM index_chunks
+			WHERE index_name = ? ORDER BY path, position`, name)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var chunk rag.Chunk
+			var vector []byte
+
+			err := rows.Scan(&chunk.Path, &chunk.StartLine, &chunk.EndLine, &chunk.Content,
+				&chunk.Embedding.Model, &chunk.Embedding.Hash, &vector)
+			if err != nil {
+				return err
+			}
+
+			chunk.Embedding.Vector = decodeVector(vector)
+			chunks = append(chunks, chunk)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, wrap("retrieve index chunks", err)
+	}
+
+	return chunks, nil
+}
+
+// Returns the first column of all rows returned by query
+func (db *SQLite) queryStrings(query string, args ...any) ([]string, error) {
+	var values []string
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var value string
+			if err := rows.Scan(&value); err != nil {
+				return err
+			}
+
+			values = append(values, value)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// Save a job submitted to the Batch API
+func (db *SQLite) SetBatchJob(job batch.Job) error {
+	err := db.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO batches (id, status, input, input_file_id, output_file_id, error_file_id, created, total, completed, failed)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET status = excluded.status, input = excluded.input, input_file_id = excluded.input_file_id,
+			output_file_id = excluded.output_file_id, error_file_id = excluded.error_file_id, created = excluded.created,
+			total = excluded.total, completed = excluded.completed, failed = excluded.failed`,
+			job.ID, job.Status, job.Input, job.InputFileID, job.OutputFileID, job.ErrorFileID, job.Created.Format(time.RFC3339Nano),
+			job.Total, job.Completed, job.Failed)
+		return err
+	})
+
+	return wrap("save batch", err)
+}
+
+// Retrieve a job submitted to the Batch API
+func (db *SQLite) GetBatchJob(id string) (batch.Job, error) {
+	var job batch.Job
+
+	err := db.view(func(tx *sql.Tx) error {
+		var err error
+		job, err = scanBatchJob(tx.QueryRow(`SELECT `+batchColumns+` FROM batches WHERE id = ?`, id))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return job, fmt.Errorf("%w: %s", ErrBatchNotFound, id)
+	}
+
+	return job, wrap("retrieve batch", err)
+}
+
+// List jobs submitted to the Batch API, by creation time
+func (db *SQLite) ListBatchJobs() ([]batch.Job, error) {
+	jobs := []batch.Job{}
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT ` + batchColumns + ` FROM batches ORDER BY created`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			job, err := scanBatchJob(rows)
+			if err != nil {
+				return err
+			}
+
+			jobs = append(jobs, job)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, wrap("list batches", err)
+	}
+
+	return jobs, nil
+}
+
+const batchColumns = `id, status, input, input_file_id, output_file_id, error_file_id, created, total, completed, failed`
+
+func scanBatchJob(row scanner) (batch.Job, error) {
+	var job batch.Job
+	var created string
+
+	err := row.Scan(&job.ID, &job.Status, &job.Input, &job.InputFileID, &job.OutputFileID, &job.ErrorFileID, &created,
+		&job.Total, &job.Completed, &job.Failed)
+	if err != nil {
+		return job, err
+	}
+
+	job.Created, err = time.Parse(time.RFC3339Nano, created)
+
+	return job, err
+}
+
+// Retrieve a cached reply; expired entries are not returned
+func (db *SQLite) GetCacheEntry(key string) (cache.Entry, bool, error) {
+	var entry cache.Entry
+
+	err := db.view(func(tx *sql.Tx) error {
+		var err error
+		entry, err = scanCacheEntry(tx.QueryRow(`SELECT role, content, created, expires FROM cache WHERE key = ?`, key))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return entry, false, nil
+	} else if err != nil {
+		return entry, false, wrap("retrieve cache entry", err)
+	}
+
+	return entry, !entry.Expired(time.Now()), nil
+}
+
+// Save a cached reply, then remove expired entries and the oldest ones
+// beyond maxEntries
+func (db *SQLite) SetCacheEntry(key string, entry cache.Entry, maxEntries int) error {
+	err := db.update(func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO cache (key, role, content, created, expires) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET role = excluded.role, content = excluded.content,
+			created = excluded.created, expires = excluded.expires`,
+			key, entry.Role, entry.Content, entry.Created.UnixNano(), entry.Expires.UnixNano())
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM cache WHERE expires <= ?`, time.Now().UnixNano()); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM cache WHERE key IN (SELECT key FROM cache ORDER BY created DESC LIMIT -1 OFFSET ?)`, maxEntries)
+		return err
+	})
+
+	return wrap("save cache entry", err)
+}
+
+// Describe the content of the response cache
+func (db *SQLite) GetCacheStats() (cache.Stats, error) {
+	var stats cache.Stats
+
+	now := time.Now()
+
+	err := db.view(func(tx *sql.Tx) error {
+		rows, err := tx.Query(`SELECT role, content, created, expires FROM cache`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			entry, err := scanCacheEntry(rows)
+			if err != nil {
+				return err
+			}
+
+			stats.Add(entry, now)
+		}
+
+		return rows.Err()
+	})
+
+	return stats, wrap("get cache stats", err)
+}
+
+// Remove entries of the response cache, or only expired ones; returns the
+// number of entries removed
+func (db *SQLite) ClearCache(expiredOnly bool) (int, error) {
+	var count int64
+
+	err := db.update(func(tx *sql.Tx) error {
+		var result sql.Result
+		var err error
+
+		if expiredOnly {
+			result, err = tx.Exec(`DELETE FROM cache WHERE expires <= ?`, time.Now().UnixNano())
+		} else {
+			result, err = tx.Exec(`DELETE FROM cache`)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		count, err = result.RowsAffected()
+		return err
+	})
+
+	return int(count), wrap("clear cache", err)
+}
+
+// Implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCacheEntry(row scanner) (cache.Entry, error) {
+	var entry cache.Entry
+	var created, expires int64
+
+	if err := row.Scan(&entry.Role, &entry.Content, &created, &expires); err != nil {
+		return entry, err
+	}
+
+	entry.Created = time.Unix(0, created)
+	entry.Expires = time.Unix(0, expires)
+
+	return entry, nil
+}
+
+// Shrink/compact database
+func (db *SQLite) Shrink() error {
+	err := db.withHandle(func(handle *sql.DB) error {
+		_, err := handle.Exec(`VACUUM`)
+		return err
+	})
+
+	return wrap("shrink database", err)
+}
+
+// Write a consistent snapshot of the database to a new file
+func (db *SQLite) Backup(filePath string) error {
+	if _, err := os.Stat(filePath); err == nil {
+		return wrap("back up database", fmt.Errorf("%s: %w", filePath, os.ErrExist))
+	}
+
+	err := db.withHandle(func(handle *sql.DB) error {
+		_, err := handle.Exec(`VACUUM INTO ?`, filePath)
+		return err
+	})
+
+	return wrap("back up database", err)
+}
+
+// Close the database handle
+func (db *SQLite) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	sqliteFiles.Lock()
+	if sqliteFiles.handles[db.filePath]--; sqliteFiles.handles[db.filePath] == 0 {
+		delete(sqliteFiles.handles, db.filePath)
+	}
+	sqliteFiles.Unlock()
+
+	return wrap("close database", db.handle.Close())
+}
+
+// Writes a consistent copy of the SQLite file src to dst, which must not
+// exist, using a read-only handle
+func vacuumInto(src, dst string) error {
+	// Created empty first, so an existing file is not overwritten
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	handle, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&mode=ro", src))
+	if err == nil {
+		_, err = handle.Exec(`VACUUM INTO ?`, dst)
+		handle.Close()
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
+
+// Encodes vector as little endian float32 values
+func encodeVector(vector []float32) []byte {
+	encoded := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(encoded[4*i:], math.Float32bits(v))
+	}
+	return encoded
+}
+
+func decodeVector(encoded []byte) []float32 {
+	vector := make([]float32, len(encoded)/4)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(encoded[4*i:]))
+	}
+	return vector
+}
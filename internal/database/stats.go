@@ -0,0 +1,101 @@
+package database
+
+import "sort"
+
+// Stats summarizes the content of a database
+type Stats struct {
+	SchemaVersion int
+	Sessions      int
+	Messages      int
+	Embeddings    int
+	Indexes       int
+	IndexFiles    int
+	IndexChunks   int
+	// Sessions sorted by decreasing size
+	Largest []SessionSize
+}
+
+// SessionSize is the size of a session's messages
+type SessionSize struct {
+	Name     string
+	Messages int
+	Bytes    int
+}
+
+// Counts items stored in the database, and returns the top largest sessions
+func GetStats(store Store, top int) (Stats, error) {
+	var stats Stats
+
+	if m, ok := store.(migrator); ok {
+		version, err := m.schemaVersion()
+		if err != nil {
+			return stats, err
+		}
+		stats.SchemaVersion = version
+	}
+
+	sessions, err := store.ListSessions()
+	if err != nil {
+		return stats, err
+	}
+
+	sizes := []SessionSize{}
+
+	for _, name := range sessions {
+		s, err := store.GetSession(name)
+		if err != nil {
+			return stats, err
+		}
+
+		size := SessionSize{
+			Name:     name,
+			Messages: len(s.Messages),
+		}
+
+		for _, message := range s.Messages {
+			size.Bytes += len(message.Content)
+		}
+
+		embeddings, err := store.GetEmbeddings(name)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Sessions++
+		stats.Messages += size.Messages
+		stats.Embeddings += len(embeddings)
+		sizes = append(sizes, size)
+	}
+
+	indexes, err := store.ListIndexes()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, name := range indexes {
+		files, err := store.GetIndexFiles(name)
+		if err != nil {
+			return stats, err
+		}
+
+		chunks, err := store.GetIndexChunks(name)
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Indexes++
+		stats.IndexFiles += len(files)
+		stats.IndexChunks += len(chunks)
+	}
+
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Bytes > sizes[j].Bytes
+	})
+
+	if len(sizes) > top {
+		sizes = sizes[:top]
+	}
+	stats.Largest = sizes
+
+	return stats, nil
+}
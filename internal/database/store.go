@@ -0,0 +1,574 @@
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+
+	"git.mkz.me/mycroft/asoai/internal/batch"
+	"git.mkz.me/mycroft/asoai/internal/cache"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+// Storage formats
+const (
+	FormatBuntDB = "buntdb"
+	FormatSQLite = "sqlite"
+)
+
+// Header of SQLite database files
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Store is implemented by storage backends
+type Store interface {
+	SetSession(name string, session session.Session) error
+	// Saves a new session; fails if name exists
+	CreateSession(name string, session session.Session) error
+	GetSession(name string) (session.Session, error)
+	UpdateSession(name string, fn func(s *session.Session) error) error
+	ListSessions() ([]string, error)
+	// Returns metadata of all sessions, by name, read in a single transaction
+	ListSessionInfo() ([]session.Info, error)
+	DeleteSession(name string) error
+	// Renames a session atomically, along with its embeddings and the
+	// current session; fails if newName exists
+	RenameSession(name, newName string) error
+	// Copies a session atomically, along with its embeddings; the copy is
+	// created now and not archived. Fails if newName exists.
+	CopySession(name, newName string) error
+
+	SetCurrentSession(name string) error
+	GetCurrentSession() (string, error)
+
+	SetEmbeddings(name string, embeddings map[int]embedding.Embedding) error
+	GetEmbeddings(name string) (map[int]embedding.Embedding, error)
+
+	SetIndex(name string, index rag.Index) error
+	GetIndex(name string) (rag.Index, error)
+	ListIndexes() ([]string, error)
+	DeleteIndex(name string) error
+	GetIndexFiles(name string) (map[string]rag.File, error)
+	SetIndexFile(name string, file rag.File, chunks []rag.Chunk) error
+	DeleteIndexFile(name, path string) error
+	GetIndexChunks(name string) ([]rag.Chunk, error)
+
+	SetBatchJob(job batch.Job) error
+	GetBatchJob(id string) (batch.Job, error)
+	// Returns jobs by creation time
+	ListBatchJobs() ([]batch.Job, error)
+
+	// Expired entries are not returned
+	GetCacheEntry(key string) (cache.Entry, bool, error)
+	// Expired entries are removed, then the oldest ones beyond maxEntries
+	SetCacheEntry(key string, entry cache.Entry, maxEntries int) error
+	GetCacheStats() (cache.Stats, error)
+	// Returns the number of entries removed
+	ClearCache(expiredOnly bool) (int, error)
+
+	GetMeta(key string) (string, error)
+	SetMeta(key, value string) error
+
+	Backup(filePath string) error
+	Shrink() error
+	Close() error
+}
+
+// Opens the database located at given path, or at the default location if
+// the path is empty. Values of encrypted databases are decrypted using the
+// passphrase returned by secret.
+func OpenDatabase(dbPath string, secret SecretFunc) (Store, error) {
+	filePath, err := ResolvePath(dbPath)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	unlocked, err := unlock(store, secret)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return unlocked, nil
+}
+
+// Returns given path, or the default database path if empty
+func ResolvePath(dbPath string) (string, error) {
+	if dbPath != "" {
+		return dbPath, nil
+	}
+
+	return GetDefaultDbFilePath()
+}
+
+// Get database default file path, in the XDG data directory
+func GetDefaultDbFilePath() (string, error) {
+	filePath, err := xdg.DataFile("asoai/data.db")
+	if err != nil {
+		return "", wrap("find a suitable location for database", err)
+	}
+
+	return filePath, nil
+}
+
+// Opens the database located in the given file path, using the backend
+// matching its format. Data of older schema versions is migrated, after
+// backing up the file. Values of encrypted databases are returned encrypted.
+func Open(filePath string) (Store, error) {
+	format, err := DetectFormat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return openFormat(filePath, format)
+}
+
+func openFormat(filePath, format string) (Store, error) {
+	store, err := openBackend(filePath, format)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := upgrade(filePath, format, store); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Opens the database without migrating it, for lookups which must not
+// change it: SQLite databases are opened read-only. Fails if its data is not
+// of SchemaVersion. Values of encrypted databases are returned encrypted.
+func OpenReadOnly(filePath string) (Store, error) {
+	format, err := DetectFormat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var store Store
+	if format == FormatSQLite {
+		store, err = openSQLite(filePath, true)
+	} else {
+		store, err = OpenBuntDB(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := store.(migrator); ok {
+		version, err := m.schemaVersion()
+		if err == nil && version != SchemaVersion {
+			err = fmt.Errorf("database schema version %d is not the supported version %d", version, SchemaVersion)
+		}
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Opens the database using the backend of the format, without migrating it
+func openBackend(filePath, format string) (Store, error) {
+	switch format {
+	case FormatBuntDB:
+		return OpenBuntDB(filePath)
+	case FormatSQLite:
+		return OpenSQLite(filePath)
+	default:
+		return nil, fmt.Errorf("unknown database format %s", format)
+	}
+}
+
+// Returns the format of the database file. Files starting with the SQLite
+// header are SQLite databases; new files use SQLite if their name ends with
+// .sqlite or .sqlite3, and buntdb otherwise.
+func DetectFormat(filePath string) (string, error) {
+	// Closing a descriptor of the file would release the locks of its
+	// handles
+	if sqliteOpen(filePath) {
+		return FormatSQLite, nil
+	}
+
+	f, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		if strings.HasSuffix(filePath, ".sqlite") || strings.HasSuffix(filePath, ".sqlite3") {
+			return FormatSQLite, nil
+		}
+		return FormatBuntDB, nil
+	} else if err != nil {
+		return "", wrap("open database", err)
+	}
+	defer f.Close()
+
+	header := make([]byte, len(sqliteHeader))
+	if _, err := io.ReadFull(f, header); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", wrap("read database", err)
+	}
+
+	if bytes.Equal(header, sqliteHeader) {
+		return FormatSQLite, nil
+	}
+
+	return FormatBuntDB, nil
+}
+
+// Converts the database file to given format. The original file is kept with
+// a timestamped .bak suffix, whose path is returned.
+func Migrate(filePath, format string) (string, error) {
+	current, err := DetectFormat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	if current == format {
+		return "", fmt.Errorf("%s is already a %s database", filePath, format)
+	}
+
+	return rewrite(filePath, format, func(dst, src Store) error {
+		return Copy(dst, src)
+	})
+}
+
+// Replaces the database file with given backup, upgraded if it comes from
+// an older version. The replaced file is kept with a timestamped .bak suffix,
+// whose path is returned.
+func Restore(filePath, backup string) (string, error) {
+	format, err := DetectFormat(backup)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Stat(backup); err != nil {
+		return "", wrap("open backup", err)
+	}
+
+	// Make sure the backup is readable before replacing anything
+	if err := verify(backup, format); err != nil {
+		return "", err
+	}
+
+	tmpPath, err := tempCopy(filePath, backup, format)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+
+	backupPath := ""
+
+	err = lockDatabase(filePath, func(current string) error {
+		if _, err := os.Stat(filePath); err == nil {
+			path, err := backupFile(filePath, current, time.Now().Format("20060102-150405"))
+			if err != nil {
+				return wrap("back up database", err)
+			}
+			backupPath = path
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return wrap("back up database", err)
+		}
+
+		// Other processes reopen the file when they see it was replaced
+		return wrap("restore database", os.Rename(tmpPath, filePath))
+	})
+
+	return backupPath, err
+}
+
+// Copies src to a temporary file next to filePath, upgrades it and returns
+// its path. src itself is left untouched, so the migration makes no other
+// backup.
+func tempCopy(filePath, src, format string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return "", wrap("copy database", err)
+	}
+	tmp.Close()
+
+	// Only its name is needed: the copy creates it
+	tmpPath := tmp.Name()
+	os.Remove(tmpPath)
+
+	if err := copyDatabase(src, tmpPath, format); err != nil {
+		os.Remove(tmpPath)
+		return "", wrap("copy database", err)
+	}
+
+	store, err := openBackend(tmpPath, format)
+	if err == nil {
+		if m, ok := store.(migrator); ok {
+			err = m.migrate(func(int) error { return nil })
+		}
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	// Left by the buntdb backend
+	os.Remove(tmpPath + ".lock")
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	return tmpPath, nil
+}
+
+// Runs fn, given the format of the database file, while no other process
+// writes to it: buntdb files are locked using their lock file, and SQLite
+// files by holding their write lock.
+func lockDatabase(filePath string, fn func(format string) error) error {
+	format, err := DetectFormat(filePath)
+	if err != nil {
+		return err
+	}
+
+	if format == FormatSQLite {
+		if _, err := os.Stat(filePath); errors.Is(err, os.ErrNotExist) {
+			return fn(format)
+		}
+
+		db, err := OpenSQLite(filePath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		return db.update(func(tx *sql.Tx) error { return fn(format) })
+	}
+
+	lock, err := os.OpenFile(filePath+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return wrap("lock database", err)
+	}
+	defer lock.Close()
+
+	if err := lockFile(lock, true); err != nil {
+		return wrap("lock database", err)
+	}
+	defer unlockFile(lock)
+
+	return fn(format)
+}
+
+// Writes a new database of the format using fill, which copies src, a
+// snapshot of the database file, then replaces the file with it. The
+// database stays locked meanwhile, so no write is lost. It's only replaced if
+// the copy has as many sessions as src, and is kept with a timestamped .bak
+// suffix, whose path is returned.
+func rewrite(filePath, format string, fill func(dst, src Store) error) (string, error) {
+	backupPath := ""
+
+	err := lockDatabase(filePath, func(current string) error {
+		snapshot, err := tempCopy(filePath, filePath, current)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(snapshot)
+		// Left by the buntdb backend
+		defer os.Remove(snapshot + ".lock")
+
+		src, err := openBackend(snapshot, current)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+		if err != nil {
+			return wrap("create database", err)
+		}
+		tmp.Close()
+
+		tmpPath := tmp.Name()
+		defer os.Remove(tmpPath)
+		defer os.Remove(tmpPath + ".lock")
+
+		dst, err := openFormat(tmpPath, format)
+		if err != nil {
+			return err
+		}
+
+		err = fill(dst, src)
+		if err == nil {
+			err = checkCopy(dst, src)
+		}
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		if backupPath, err = backupFile(filePath, current, time.Now().Format("20060102-150405")); err != nil {
+			backupPath = ""
+			return wrap("back up database", err)
+		}
+
+		return wrap("replace database", os.Rename(tmpPath, filePath))
+	})
+
+	return backupPath, err
+}
+
+// Returns an error unless dst has as many sessions as src, which it was
+// copied from
+func checkCopy(dst, src Store) error {
+	copied, err := dst.ListSessions()
+	if err != nil {
+		return err
+	}
+
+	sessions, err := src.ListSessions()
+	if err != nil {
+		return err
+	}
+
+	if len(copied) != len(sessions) {
+		return fmt.Errorf("copied %d sessions out of %d: database left unchanged", len(copied), len(sessions))
+	}
+
+	return nil
+}
+
+// Opens the database without migrating it and lists its sessions
+func verify(filePath, format string) error {
+	store, err := openBackend(filePath, format)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	_, err = store.ListSessions()
+	return err
+}
+
+// Copies sessions, current session, embeddings, indexes, batch jobs and
+// encryption parameters from src to dst. The response cache is not copied.
+func Copy(dst, src Store) error {
+	sessions, err := src.ListSessions()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sessions {
+		s, err := src.GetSession(name)
+		if err != nil {
+			return err
+		}
+
+		if err := dst.SetSession(name, s); err != nil {
+			return err
+		}
+
+		embeddings, err := src.GetEmbeddings(name)
+		if err != nil {
+			return err
+		}
+
+		if len(embeddings) > 0 {
+			if err := dst.SetEmbeddings(name, embeddings); err != nil {
+				return err
+			}
+		}
+	}
+
+	params, err := src.GetMeta(metaEncryption)
+	if err != nil {
+		return err
+	} else if params != "" {
+		if err := dst.SetMeta(metaEncryption, params); err != nil {
+			return err
+		}
+	}
+
+	current, err := src.GetCurrentSession()
+	if err != nil && !errors.Is(err, ErrNoCurrentSession) {
+		return err
+	} else if err == nil {
+		if err := dst.SetCurrentSession(current); err != nil {
+			return err
+		}
+	}
+
+	indexes, err := src.ListIndexes()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range indexes {
+		if err := copyIndex(dst, src, name); err != nil {
+			return err
+		}
+	}
+
+	jobs, err := src.ListBatchJobs()
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if err := dst.SetBatchJob(job); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyIndex(dst, src Store, name string) error {
+	index, err := src.GetIndex(name)
+	if err != nil {
+		return err
+	}
+
+	files, err := src.GetIndexFiles(name)
+	if err != nil {
+		return err
+	}
+
+	chunks, err := src.GetIndexChunks(name)
+	if err != nil {
+		return err
+	}
+
+	chunksByPath := map[string][]rag.Chunk{}
+	for _, chunk := range chunks {
+		chunksByPath[chunk.Path] = append(chunksByPath[chunk.Path], chunk)
+	}
+
+	for path, file := range files {
+		fileChunks := chunksByPath[path]
+		if fileChunks == nil {
+			fileChunks = []rag.Chunk{}
+		}
+
+		// buntdb returns chunks in key order, not in file order
+		sort.SliceStable(fileChunks, func(i, j int) bool {
+			return fileChunks[i].StartLine < fileChunks[j].StartLine
+		})
+
+		if err := dst.SetIndexFile(name, file, fileChunks); err != nil {
+			return err
+		}
+	}
+
+	return dst.SetIndex(name, index)
+}
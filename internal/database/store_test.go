@@ -0,0 +1,528 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"git.mkz.me/mycroft/asoai/internal/cache"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+// Database file names of each backend, in a temporary directory
+var testFiles = map[string]string{
+	FormatBuntDB: "data.db",
+	FormatSQLite: "data.sqlite",
+}
+
+// Runs fn against a new database of each backend
+func forEachBackend(t *testing.T, fn func(t *testing.T, filePath string, db Store)) {
+	for format, name := range testFiles {
+		t.Run(format, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), name)
+
+			db, err := Open(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			fn(t, filePath, db)
+		})
+	}
+}
+
+func TestEmbeddingsOfSimilarNames(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		names := []string{"a", "a:b", "a*", "a?"}
+		for _, name := range names {
+			if err := db.SetSession(name, session.NewSession("", "")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SetEmbeddings(name, map[int]embedding.Embedding{0: {Hash: name}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := db.DeleteSession("a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.RenameSession("a*", "c"); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := map[string]string{"a": "", "a:b": "a:b", "a*": "", "a?": "a?", "c": "a*"}
+		for name, hash := range expected {
+			embeddings, err := db.GetEmbeddings(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if embeddings[0].Hash != hash || (hash == "" && len(embeddings) != 0) {
+				t.Errorf("embeddings of %s: got %v, expected hash %q", name, embeddings, hash)
+			}
+		}
+	})
+}
+
+func TestGetSessionConsistency(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		if err := db.SetSession("s", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() {
+			defer close(done)
+
+			// Each update adds a message and counts messages in the
+			// description
+			for i := 0; i < 200; i++ {
+				err := db.UpdateSession("s", func(s *session.Session) error {
+					s.Messages = append(s.Messages, session.Message{Role: "user", Content: "message"})
+					s.Description = strconv.Itoa(len(s.Messages))
+					return nil
+				})
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			default:
+			}
+
+			s, err := db.GetSession("s")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s.Description != "" && s.Description != strconv.Itoa(len(s.Messages)) {
+				t.Fatalf("description %s read with %d messages", s.Description, len(s.Messages))
+			}
+		}
+	})
+}
+
+func TestRestore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		if err := db.SetSession("old", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+
+		backup := filepath.Join(t.TempDir(), "backup")
+		if err := db.Backup(backup); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.SetSession("new", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+
+		backupPath, err := Restore(filePath, backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// buntdb reloads the replaced file
+		if _, ok := db.(*BuntDB); ok {
+			if sessions, err := db.ListSessions(); err != nil || len(sessions) != 1 || sessions[0] != "old" {
+				t.Errorf("got sessions %v (%v)", sessions, err)
+			}
+		}
+
+		for path, expected := range map[string]int{filePath: 1, backupPath: 2} {
+			restored, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if sessions, err := restored.ListSessions(); err != nil || len(sessions) != expected {
+				t.Errorf("%s: got sessions %v (%v)", path, sessions, err)
+			}
+			restored.Close()
+		}
+
+		if tmpFiles, _ := filepath.Glob(filepath.Join(filepath.Dir(filePath), "*.tmp*")); len(tmpFiles) != 0 {
+			t.Errorf("temporary files left: %v", tmpFiles)
+		}
+	})
+}
+
+func TestRestoreOldVersion(t *testing.T) {
+	for format, name := range testFiles {
+		t.Run(format, func(t *testing.T) {
+			fixture := copyFixture(t, "v1."+filepath.Ext(name)[1:])
+			filePath := filepath.Join(t.TempDir(), name)
+
+			if _, err := Restore(filePath, fixture); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := Open(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkFixture(t, db)
+
+			// The restored file had no data to back up, and the upgraded
+			// copy needs no backup
+			for _, path := range []string{filePath, fixture} {
+				if backups := migrationBackups(t, path); len(backups) != 0 {
+					t.Errorf("unexpected backups %q", backups)
+				}
+			}
+
+			if files, _ := filepath.Glob(filepath.Join(filepath.Dir(filePath), "*")); len(files) > 2 {
+				t.Errorf("unexpected files %q", files)
+			}
+		})
+	}
+}
+
+func TestCopySession(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		s := session.NewSession("gpt-4o", "be brief")
+		s.Created = s.Created.Add(-time.Hour)
+		s.Archived = true
+		s.Tags = []string{"work"}
+		if err := db.SetSession("src", s); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetEmbeddings("src", map[int]embedding.Embedding{0: {Hash: "h0"}, 1: {Hash: "h1"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetSession("other", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.CopySession("src", "other"); !errors.Is(err, ErrSessionExists) {
+			t.Errorf("got %v copying to an existing session", err)
+		}
+		if err := db.CopySession("missing", "new"); !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("got %v copying a missing session", err)
+		}
+
+		if err := db.CopySession("src", "dst"); err != nil {
+			t.Fatal(err)
+		}
+
+		copied, err := db.GetSession("dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied.Archived || !copied.Created.After(s.Created) || copied.Model != "gpt-4o" || !copied.HasTag("work") ||
+			len(copied.Messages) != 1 || copied.Messages[0].Content != "be brief" {
+			t.Errorf("unexpected copy %+v", copied)
+		}
+
+		for _, name := range []string{"src", "dst"} {
+			embeddings, err := db.GetEmbeddings(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(embeddings) != 2 || embeddings[1].Hash != "h1" {
+				t.Errorf("embeddings of %s: got %v", name, embeddings)
+			}
+		}
+
+		if src, err := db.GetSession("src"); err != nil || !src.Archived {
+			t.Errorf("source changed: %+v (%v)", src, err)
+		}
+	})
+}
+
+func TestConcurrentCopySession(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		const copies = 8
+
+		for i := 0; i < copies; i++ {
+			if err := db.SetSession("src"+strconv.Itoa(i), session.NewSession("", strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		errs := make(chan error, copies)
+		for i := 0; i < copies; i++ {
+			go func(name string) {
+				errs <- db.CopySession(name, "dst")
+			}("src" + strconv.Itoa(i))
+		}
+
+		copied := 0
+		for i := 0; i < copies; i++ {
+			if err := <-errs; err == nil {
+				copied++
+			} else if !errors.Is(err, ErrSessionExists) {
+				t.Error(err)
+			}
+		}
+
+		if copied != 1 {
+			t.Errorf("session copied %d times", copied)
+		}
+	})
+}
+
+func TestCopy(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, src Store) {
+		for _, name := range []string{"a", "a:b"} {
+			if err := src.SetSession(name, session.NewSession("", name)); err != nil {
+				t.Fatal(err)
+			}
+			if err := src.SetEmbeddings(name, map[int]embedding.Embedding{0: {Hash: name}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := src.SetCurrentSession("a:b"); err != nil {
+			t.Fatal(err)
+		}
+
+		for format, name := range testFiles {
+			dst, err := Open(filepath.Join(t.TempDir(), name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			if err := Copy(dst, src); err != nil {
+				t.Fatal(err)
+			}
+
+			sessions, err := dst.ListSessions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 2 || sessions[0] != "a" || sessions[1] != "a:b" {
+				t.Errorf("%s: got sessions %v", format, sessions)
+			}
+
+			for _, name := range sessions {
+				s, err := dst.GetSession(name)
+				if err != nil || s.Messages[0].Content != name {
+					t.Errorf("%s: got session %s %+v (%v)", format, name, s, err)
+				}
+
+				embeddings, err := dst.GetEmbeddings(name)
+				if err != nil || len(embeddings) != 1 || embeddings[0].Hash != name {
+					t.Errorf("%s: got embeddings of %s %v (%v)", format, name, embeddings, err)
+				}
+			}
+
+			if current, err := dst.GetCurrentSession(); err != nil || current != "a:b" {
+				t.Errorf("%s: got current session %s (%v)", format, current, err)
+			}
+		}
+	})
+}
+
+func TestRewriteChecksSessions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		for _, name := range []string{"a", "b"} {
+			if err := db.SetSession(name, session.NewSession("", name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Loses session b
+		format, _ := DetectFormat(filePath)
+		_, err := rewrite(filePath, format, func(dst, src Store) error {
+			s, err := src.GetSession("a")
+			if err != nil {
+				return err
+			}
+			return dst.SetSession("a", s)
+		})
+		if err == nil {
+			t.Fatal("database replaced by an incomplete copy")
+		}
+
+		if sessions, err := db.ListSessions(); err != nil || len(sessions) != 2 {
+			t.Errorf("got sessions %v (%v)", sessions, err)
+		}
+
+		if backups, _ := filepath.Glob(filePath + ".*.bak"); len(backups) != 0 {
+			t.Errorf("got backups %v", backups)
+		}
+	})
+}
+
+func TestWritesAfterRestore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		if err := db.SetSession("replaced", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+
+		backup := filepath.Join(t.TempDir(), filepath.Base(filePath))
+		restored, err := Open(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := restored.SetSession("restored", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+		restored.Close()
+
+		if _, err := Restore(filePath, backup); err != nil {
+			t.Fatal(err)
+		}
+
+		// Written by a handle opened before the restore
+		if err := db.SetSession("written", session.NewSession("", "")); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+
+		if sessions, err := reopened.ListSessions(); err != nil || len(sessions) != 2 || sessions[0] != "restored" || sessions[1] != "written" {
+			t.Errorf("got sessions %v (%v)", sessions, err)
+		}
+	})
+}
+
+func TestWritesDuringRewrite(t *testing.T) {
+	const appends = 50
+
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		if err := db.SetSession("s", session.Session{}); err != nil {
+			t.Fatal(err)
+		}
+
+		format, err := DetectFormat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan error)
+		go func() {
+			for i := 0; i < appends; i++ {
+				err := db.UpdateSession("s", func(s *session.Session) error {
+					s.Messages = append(s.Messages, session.Message{Role: "user", Content: strconv.Itoa(i)})
+					return nil
+				})
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+
+		for i := 0; i < 5; i++ {
+			_, err := rewrite(filePath, format, func(dst, src Store) error {
+				return Copy(dst, src)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := Open(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+
+		if s, err := reopened.GetSession("s"); err != nil || len(s.Messages) != appends {
+			t.Errorf("got %d messages out of %d (%v)", len(s.Messages), appends, err)
+		}
+	})
+}
+
+func TestCreateSession(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		if err := db.CreateSession("s", session.NewSession("gpt-4o", "first")); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.CreateSession("s", session.NewSession("gpt-4o-mini", "second")); !errors.Is(err, ErrSessionExists) {
+			t.Errorf("got %v creating an existing session", err)
+		}
+
+		if s, err := db.GetSession("s"); err != nil || s.Model != "gpt-4o" || s.Messages[0].Content != "first" {
+			t.Errorf("session overwritten: %+v (%v)", s, err)
+		}
+	})
+}
+
+func TestCacheEntries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, filePath string, db Store) {
+		now := time.Now()
+		entry := func(content string, age, ttl time.Duration) cache.Entry {
+			return cache.Entry{Role: "assistant", Content: content, Created: now.Add(-age), Expires: now.Add(ttl)}
+		}
+
+		if err := db.SetCacheEntry("short", entry("short", 0, 100*time.Millisecond), 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetCacheEntry("old", entry("old", 2*time.Minute, time.Hour), 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetCacheEntry("new", entry("new", time.Minute, time.Hour), 10); err != nil {
+			t.Fatal(err)
+		}
+
+		if e, found, err := db.GetCacheEntry("new"); err != nil || !found || e.Content != "new" || !e.Created.Equal(now.Add(-time.Minute)) {
+			t.Errorf("got %+v, %v (%v)", e, found, err)
+		}
+		if _, found, err := db.GetCacheEntry("missing"); err != nil || found {
+			t.Errorf("missing entry found (%v)", err)
+		}
+
+		// Expired entries are kept until the next write, but not returned
+		time.Sleep(150 * time.Millisecond)
+
+		if _, found, err := db.GetCacheEntry("short"); err != nil || found {
+			t.Errorf("expired entry found (%v)", err)
+		}
+		if stats, err := db.GetCacheStats(); err != nil || stats.Entries != 3 || stats.Expired != 1 || stats.Size != int64(len("shortoldnew")) {
+			t.Errorf("got stats %+v (%v)", stats, err)
+		}
+
+		// Saving removes expired entries, then the oldest beyond the limit
+		if err := db.SetCacheEntry("newest", entry("newest", 0, time.Hour), 2); err != nil {
+			t.Fatal(err)
+		}
+
+		for key, kept := range map[string]bool{"short": false, "old": false, "new": true, "newest": true} {
+			if _, found, err := db.GetCacheEntry(key); err != nil || found != kept {
+				t.Errorf("entry %s: found %v, expected %v (%v)", key, found, kept, err)
+			}
+		}
+
+		// An entry older than the others is evicted as soon as it is saved
+		if err := db.SetCacheEntry("oldest", entry("oldest", time.Hour, time.Hour), 2); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, err := db.GetCacheEntry("oldest"); err != nil || found {
+			t.Errorf("entry beyond the limit found (%v)", err)
+		}
+
+		if removed, err := db.ClearCache(true); err != nil || removed != 0 {
+			t.Errorf("removed %d expired entries (%v)", removed, err)
+		}
+		if removed, err := db.ClearCache(false); err != nil || removed != 2 {
+			t.Errorf("removed %d entries out of 2 (%v)", removed, err)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package embedding
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Default model used to compute embeddings
+const DefaultModel = string(openai.SmallEmbedding3)
+
+// Maximum number of bytes sent for a single input. The API refuses inputs
+// longer than 8192 tokens; this keeps a safe margin without a tokenizer.
+const MaxInputLength = 24000
+
+// Maximum number of inputs sent in a single API call
+const batchSize = 100
+
+// Embedding is a vector computed for a piece of text. The model and a hash of
+// the text are kept alongside so stale vectors can be detected.
+type Embedding struct {
+	Model  string    `json:"model"`
+	Hash   string    `json:"hash"`
+	Vector []float32 `json:"vector"`
+}
+
+// Returns the hash used to detect content changes
+func Hash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns true if the embedding was computed with given model for given content
+func (e Embedding) Matches(model, content string) bool {
+	return e.Model == model && e.Hash == Hash(content)
+}
+
+// Truncates input to MaxInputLength bytes, without splitting a rune
+func truncate(input string) string {
+	if len(input) <= MaxInputLength {
+		return input
+	}
+
+	cut := MaxInputLength
+	for cut > 0 && !utf8.RuneStart(input[cut]) {
+		cut--
+	}
+
+	return input[:cut]
+}
+
+// Computes embeddings for all inputs, splitting them in batches. Returned
+// vectors are in the same order as inputs.
+func Create(ctx context.Context, client *openai.Client, model string, inputs []string) ([][]float32, error) {
+	vectors := make([][]float32, len(inputs))
+
+	for start := 0; start < len(inputs); start += batchSize {
+		end := min(start+batchSize, len(inputs))
+
+		batch := make([]string, 0, end-start)
+		for _, input := range inputs[start:end] {
+			batch = append(batch, truncate(input))
+		}
+
+		resp, err := client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+			Input: batch,
+			Model: openai.EmbeddingModel(model),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not create embeddings: %w", err)
+		}
+
+		for _, data := range resp.Data {
+			if data.Index < 0 || data.Index >= len(batch) {
+				return nil, fmt.Errorf("unexpected embedding index %d in response", data.Index)
+			}
+			vectors[start+data.Index] = data.Embedding
+		}
+	}
+
+	return vectors, nil
+}
+
+// Returns the cosine similarity of two vectors, or 0 if they can't be compared
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
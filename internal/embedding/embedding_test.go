@@ -0,0 +1,31 @@
+package embedding
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, input := range []string{
+		"short",
+		strings.Repeat("a", MaxInputLength+10),
+		"a" + strings.Repeat("é", MaxInputLength),
+		strings.Repeat("語", MaxInputLength),
+	} {
+		truncated := truncate(input)
+
+		if len(truncated) > MaxInputLength {
+			t.Errorf("truncated input is %d bytes long", len(truncated))
+		}
+		if !utf8.ValidString(truncated) || !strings.HasPrefix(input, truncated) {
+			t.Errorf("invalid truncation of %.10q...", input)
+		}
+		if len(input) <= MaxInputLength && truncated != input {
+			t.Errorf("short input was truncated")
+		}
+		if len(input) > MaxInputLength && len(truncated) < MaxInputLength-utf8.UTFMax {
+			t.Errorf("input truncated to %d bytes", len(truncated))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Marker written in hooks installed by asoai, so they can be told apart from
+// user hooks
+const HookMarker = "# installed by asoai"
+
+// Script of the prepare-commit-msg hook. Messages given with -m, merges,
+// squashes and amends are left untouched, and failures never block commits.
+const prepareCommitMsgHook = `#!/bin/sh
+` + HookMarker + `
+case "$2" in
+message|merge|squash|commit) exit 0 ;;
+esac
+asoai git commit-msg --message-file "$1" || true
+`
+
+// Runs git in dir (current directory if empty) and returns its output
+func Run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+// Returns the path of a file in the .git directory, as in COMMIT_EDITMSG or
+// hooks/prepare-commit-msg
+func GitPath(dir, name string) (string, error) {
+	out, err := Run(dir, "rev-parse", "--git-path", name)
+	if err != nil {
+		return "", err
+	}
+
+	path := strings.TrimSpace(out)
+	if !filepath.IsAbs(path) && dir != "" {
+		path = filepath.Join(dir, path)
+	}
+
+	return path, nil
+}
+
+// Returns files changed in the given range, as understood by git diff. Names
+// are NUL separated so they are not quoted by git.
+func ChangedFiles(dir string, args ...string) ([]string, error) {
+	out, err := Run(dir, append([]string{"diff", "--name-only", "-z"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, name := range strings.Split(out, "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+
+	return files, nil
+}
+
+// Installs the prepare-commit-msg hook. An existing hook is only replaced if
+// it was installed by asoai or force is set.
+func InstallHook(dir string, force bool) (string, error) {
+	path, err := GitPath(dir, "hooks/prepare-commit-msg")
+	if err != nil {
+		return "", err
+	}
+
+	existing, err := os.ReadFile(path)
+	if err == nil && !force && !strings.Contains(string(existing), HookMarker) {
+		return "", fmt.Errorf("a prepare-commit-msg hook already exists in %s", path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(path, []byte(prepareCommitMsgHook), 0755); err != nil {
+		return "", fmt.Errorf("could not write hook: %w", err)
+	}
+
+	return path, nil
+}
+
+// Splits a unified diff in per-file diffs, keyed by file path
+func SplitDiff(diff string) ([]string, map[string]string) {
+	files := []string{}
+	diffs := map[string]string{}
+
+	var current string
+	var sb strings.Builder
+	// Set until the first hunk of a file, whose lines may look like headers
+	header := false
+
+	flush := func() {
+		if current != "" {
+			diffs[current] = sb.String()
+		}
+		sb.Reset()
+	}
+
+	// Renamed files are named after their new path
+	rename := func(path string) {
+		current = path
+		files[len(files)-1] = path
+	}
+
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		name := strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			flush()
+
+			current = headerPath(strings.TrimPrefix(name, "diff --git "))
+			files = append(files, current)
+			header = true
+		case header && strings.HasPrefix(line, "@@"):
+			header = false
+		case header && strings.HasPrefix(line, "+++ b/"):
+			rename(strings.TrimPrefix(name, "+++ b/"))
+		case header && strings.HasPrefix(line, "rename to "):
+			rename(strings.TrimPrefix(name, "rename to "))
+		}
+
+		sb.WriteString(line)
+	}
+	flush()
+
+	return files, diffs
+}
+
+// Returns the path of a "a/<path> b/<path>" diff header. Paths may hold
+// spaces: both halves are the same unless the file was renamed, then the path
+// follows the last " b/".
+func headerPath(paths string) string {
+	if n := len(paths); n%2 == 1 && strings.HasPrefix(paths, "a/") {
+		half := n / 2
+		if paths[half:half+3] == " b/" && paths[2:half] == paths[half+3:] {
+			return paths[2:half]
+		}
+	}
+
+	if i := strings.LastIndex(paths, " b/"); i >= 0 {
+		return paths[i+3:]
+	}
+
+	return paths
+}
@@ -0,0 +1,53 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitDiff(t *testing.T) {
+	diffs := []string{
+		"diff --git a/main.go b/main.go\nindex 1..2 100644\n--- a/main.go\n+++ b/main.go\n@@ -1 +1 @@\n-old\n+new\n",
+		"diff --git a/my file.txt b/my file.txt\nindex 1..2 100644\n--- a/my file.txt\n+++ b/my file.txt\n@@ -1 +1 @@\n-old\n+new\n",
+		"diff --git a/a b/c.txt b/a b/c.txt\nnew file mode 100644\nindex 0..1\n--- /dev/null\n+++ b/a b/c.txt\n@@ -0,0 +1 @@\n+++ b/not a file\n",
+		"diff --git a/old name.txt b/new name.txt\nsimilarity index 100%\nrename from old name.txt\nrename to new name.txt\n",
+		"diff --git a/gone.txt b/gone.txt\ndeleted file mode 100644\nindex 1..0\n--- a/gone.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-gone\n",
+	}
+
+	diff := ""
+	for _, d := range diffs {
+		diff += d
+	}
+
+	files, split := SplitDiff(diff)
+
+	want := []string{"main.go", "my file.txt", "a b/c.txt", "new name.txt", "gone.txt"}
+	if !reflect.DeepEqual(files, want) {
+		t.Fatalf("got files %q, want %q", files, want)
+	}
+
+	for i, file := range files {
+		if split[file] != diffs[i] {
+			t.Errorf("diff of %s: got %q, want %q", file, split[file], diffs[i])
+		}
+	}
+}
+
+func TestHeaderPath(t *testing.T) {
+	tests := []struct {
+		paths string
+		path  string
+	}{
+		{"a/main.go b/main.go", "main.go"},
+		{"a/my file.txt b/my file.txt", "my file.txt"},
+		{"a/x b/y b/x b/y", "x b/y"},
+		{"a/old.txt b/new.txt", "new.txt"},
+		{"a/old name.txt b/new name.txt", "new name.txt"},
+	}
+
+	for _, test := range tests {
+		if path := headerPath(test.paths); path != test.path {
+			t.Errorf("headerPath(%q) = %q, want %q", test.paths, path, test.path)
+		}
+	}
+}
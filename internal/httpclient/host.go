@@ -0,0 +1,23 @@
+package httpclient
+
+import (
+	"net"
+	"strings"
+)
+
+// LocalHost returns true if the host, with an optional port, names the local
+// machine
+func LocalHost(host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,22 @@
+package httpclient
+
+import "testing"
+
+func TestLocalHost(t *testing.T) {
+	for host, expected := range map[string]bool{
+		"localhost":          true,
+		"LocalHost:8080":     true,
+		"127.0.0.1":          true,
+		"127.0.0.2:8080":     true,
+		"[::1]:8080":         true,
+		"::1":                true,
+		"example.com":        false,
+		"localhost.evil.com": false,
+		"192.168.1.1:8080":   false,
+		"":                   false,
+	} {
+		if LocalHost(host) != expected {
+			t.Errorf("%q: expected %v", host, expected)
+		}
+	}
+}
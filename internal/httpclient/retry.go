@@ -0,0 +1,198 @@
+package httpclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts = 4
+	DefaultMaxDelay    = 30 * time.Second
+	DefaultTimeout     = 2 * time.Minute
+
+	// Delay before the first retry, doubled on each attempt
+	baseDelay = 500 * time.Millisecond
+)
+
+// Retry is a transport retrying requests which failed on network errors or
+// got a 429 or 5xx status. Delays grow exponentially with jitter, unless the
+// server tells when to retry using Retry-After or x-ratelimit-reset-*.
+type Retry struct {
+	// Transport used for requests; http.DefaultTransport if nil
+	Base http.RoundTripper
+	// Maximum number of attempts, including the first one
+	MaxAttempts int
+	// Maximum delay between attempts
+	MaxDelay time.Duration
+	// Time after which attempts are abandoned, bounding the time to get a
+	// response; 0 means no limit. Reading the response body is not limited,
+	// so long streamed replies are not cut.
+	Timeout time.Duration
+}
+
+func (t *Retry) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	maxAttempts := t.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxAttempts
+	}
+
+	// Bodies can only be sent again if they can be rewound
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		maxAttempts = 1
+	}
+
+	// Attempts are canceled when the timeout expires, until a response is
+	// returned; its body then cancels the context once closed
+	ctx, cancel := context.WithCancel(req.Context())
+	var deadline *time.Timer
+	if t.Timeout > 0 {
+		deadline = time.AfterFunc(t.Timeout, cancel)
+	}
+
+	resp, err := t.roundTrip(base, req.WithContext(ctx), maxAttempts)
+
+	if deadline != nil && !deadline.Stop() && err != nil && req.Context().Err() == nil {
+		err = fmt.Errorf("no response after %s: %w", t.Timeout, context.DeadlineExceeded)
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (t *Retry) roundTrip(base http.RoundTripper, req *http.Request, maxAttempts int) (*http.Response, error) {
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := base.RoundTrip(req)
+
+		if attempt >= maxAttempts || !retryable(req, resp, err) {
+			return resp, err
+		}
+
+		delay := t.delay(attempt, resp)
+		if t.Timeout > 0 && time.Since(start)+delay > t.Timeout {
+			return resp, err
+		}
+
+		if resp != nil {
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// cancelBody cancels the context of its request once closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Returns true if the request failed on a transient error
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Network errors, unless the request was canceled
+		return req.Context().Err() == nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// Returns the delay before the next attempt
+func (t *Retry) delay(attempt int, resp *http.Response) time.Duration {
+	maxDelay := t.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxDelay
+	}
+
+	if resp != nil {
+		if delay, ok := serverDelay(resp.Header); ok {
+			return min(delay, maxDelay)
+		}
+	}
+
+	// Full jitter: a random delay up to the exponential backoff
+	backoff := min(baseDelay<<(attempt-1), maxDelay)
+
+	return time.Duration(rand.Int63n(int64(backoff))) + time.Millisecond
+}
+
+// Returns the delay asked by the server, from Retry-After or, once a limit
+// is exhausted, from the matching x-ratelimit-reset-* header
+func serverDelay(header http.Header) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+
+		if date, err := http.ParseTime(value); err == nil {
+			return max(time.Until(date), 0), true
+		}
+	}
+
+	if value := header.Get("Retry-After-Ms"); value != "" {
+		if ms, err := strconv.Atoi(value); err == nil {
+			return time.Duration(ms) * time.Millisecond, true
+		}
+	}
+
+	delay, found := time.Duration(0), false
+
+	for _, limit := range []string{"requests", "tokens"} {
+		if header.Get("X-Ratelimit-Remaining-"+limit) != "0" {
+			continue
+		}
+
+		// OpenAI gives durations such as "1s", "6m0s" or "20ms"
+		reset, err := time.ParseDuration(strings.TrimSpace(header.Get("X-Ratelimit-Reset-" + limit)))
+		if err == nil && reset > delay {
+			delay, found = reset, true
+		}
+	}
+
+	return delay, found
+}
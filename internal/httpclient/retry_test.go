@@ -0,0 +1,151 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Starts a server answering with the statuses in turn, then with 200, and
+// returns it along with its number of requests
+func statusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		n := int(requests.Add(1))
+		if n <= len(statuses) {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestRetryStatuses(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		status   int
+		requests int32
+	}{
+		{"ok", nil, http.StatusOK, 1},
+		{"rate limited", []int{http.StatusTooManyRequests}, http.StatusOK, 2},
+		{"server errors", []int{http.StatusInternalServerError, http.StatusBadGateway}, http.StatusOK, 3},
+		{"too many errors", []int{500, 500, 500, 500}, http.StatusInternalServerError, 3},
+		{"client error", []int{http.StatusBadRequest}, http.StatusBadRequest, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := statusServer(t, nil, test.statuses...)
+			client := &http.Client{Transport: &Retry{MaxAttempts: 3, MaxDelay: 10 * time.Millisecond}}
+
+			resp, err := client.Post(server.URL, "application/json", strings.NewReader("body"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != test.status || requests.Load() != test.requests {
+				t.Errorf("got status %d after %d requests, expected %d after %d", resp.StatusCode, requests.Load(), test.status, test.requests)
+			}
+
+			// Bodies are sent again
+			if resp.StatusCode == http.StatusOK && string(body) != "body" {
+				t.Errorf("got body %q", body)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, requests := statusServer(t, http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests)
+	client := &http.Client{Transport: &Retry{}}
+
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || requests.Load() != 2 || elapsed < time.Second {
+		t.Errorf("got status %d after %d requests in %s", resp.StatusCode, requests.Load(), elapsed)
+	}
+}
+
+func TestRetryAfterBeyondTimeout(t *testing.T) {
+	server, requests := statusServer(t, http.Header{"Retry-After": {"5"}}, http.StatusTooManyRequests)
+	client := &http.Client{Transport: &Retry{Timeout: time.Second}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The delay asked would exceed the timeout: the error is returned
+	if resp.StatusCode != http.StatusTooManyRequests || requests.Load() != 1 {
+		t.Errorf("got status %d after %d requests", resp.StatusCode, requests.Load())
+	}
+}
+
+func TestRetryTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Retry{Timeout: 100 * time.Millisecond}}
+
+	start := time.Now()
+	_, err := client.Get(server.URL)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request lasted %s", elapsed)
+	}
+}
+
+func TestRetryTimeoutKeepsBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("data: 1\n"))
+		w.(http.Flusher).Flush()
+
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("data: 2\n"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &Retry{Timeout: 100 * time.Millisecond}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Streamed replies are not cut by the timeout
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "data: 1\ndata: 2\n" {
+		t.Errorf("got body %q (%v)", body, err)
+	}
+}
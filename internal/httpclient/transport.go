@@ -0,0 +1,110 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Options configure the network settings of a transport
+type Options struct {
+	// Proxy URL; HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used if empty
+	Proxy string
+	// PEM files holding CAs trusted along with the system ones
+	CAFiles []string
+	// Client certificate and key PEM files, for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Time to wait for the server to answer a request; 0 means no limit
+	Timeout time.Duration
+	// Headers added to every request
+	Headers map[string]string
+}
+
+// Returns a transport using given network settings
+func NewTransport(opts Options) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.Proxy != "" {
+		proxy, err := url.Parse(opts.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %q", opts.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	// A limit on the whole request would cut long streamed replies
+	transport.ResponseHeaderTimeout = opts.Timeout
+
+	if len(opts.Headers) == 0 {
+		return transport, nil
+	}
+
+	return &headerTransport{base: transport, headers: opts.Headers}, nil
+}
+
+func newTLSConfig(opts Options) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(opts.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, caFile := range opts.CAFiles {
+			content, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CA file: %w", err)
+			}
+
+			if !pool.AppendCertsFromPEM(content) {
+				return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+			}
+		}
+
+		config.RootCAs = pool
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+
+	if opts.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// headerTransport adds static headers to requests
+type headerTransport struct {
+	base    http.RoundTripper
+	headers map[string]string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests must not be modified by transports
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	return t.base.RoundTrip(req)
+}
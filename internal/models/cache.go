@@ -0,0 +1,59 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// Age after which the cached model list is refreshed
+const CacheMaxAge = 24 * time.Hour
+
+// List of model ids exposed by an API, as cached
+type cachedList struct {
+	Fetched time.Time `json:"fetched"`
+	IDs     []string  `json:"ids"`
+}
+
+// Returns the path of the list cached for the API at baseURL, in the XDG
+// cache directory
+func CachePath(baseURL string) (string, error) {
+	sum := sha256.Sum256([]byte(baseURL))
+
+	filePath, err := xdg.CacheFile("asoai/models-" + hex.EncodeToString(sum[:6]) + ".json")
+	if err != nil {
+		return "", fmt.Errorf("could not find a suitable location for the model list: %w", err)
+	}
+
+	return filePath, nil
+}
+
+// Returns cached model ids and the time they were fetched
+func ReadCache(filePath string) ([]string, time.Time, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var list cachedList
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid model list %s: %w", filePath, err)
+	}
+
+	return list.IDs, list.Fetched, nil
+}
+
+// Caches model ids, fetched now
+func WriteCache(filePath string, ids []string) error {
+	content, err := json.Marshal(cachedList{Fetched: time.Now(), IDs: ids})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filePath, content, 0644)
+}
@@ -0,0 +1,46 @@
+package models
+
+var (
+	chatAll   = []string{CapabilityVision, CapabilityTools, CapabilityJSON}
+	chatTools = []string{CapabilityTools, CapabilityJSON}
+)
+
+// Built-in metadata, by model id or family
+var catalog = map[string]Model{
+	"gpt-4o":            {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 16384, Capabilities: chatAll, InputPrice: 2.5, OutputPrice: 10},
+	"gpt-4o-2024-05-13": {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: chatAll, InputPrice: 5, OutputPrice: 15},
+	"gpt-4o-mini":       {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 16384, Capabilities: chatAll, InputPrice: 0.15, OutputPrice: 0.6},
+
+	"gpt-4-turbo":               {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: chatAll, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-turbo-preview":       {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: chatTools, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-0125-preview":        {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: chatTools, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-1106-preview":        {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: chatTools, InputPrice: 10, OutputPrice: 30},
+	"gpt-4-vision-preview":      {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: []string{CapabilityVision}, InputPrice: 10, OutputPrice: 30, Deprecation: "2024-12-06"},
+	"gpt-4-1106-vision-preview": {Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 4096, Capabilities: []string{CapabilityVision}, InputPrice: 10, OutputPrice: 30, Deprecation: "2024-12-06"},
+	"gpt-4":                     {Known: true, Type: TypeChat, ContextWindow: 8192, MaxOutput: 8192, Capabilities: []string{CapabilityTools}, InputPrice: 30, OutputPrice: 60},
+	"gpt-4-0314":                {Known: true, Type: TypeChat, ContextWindow: 8192, MaxOutput: 8192, InputPrice: 30, OutputPrice: 60, Deprecation: "2024-06-13"},
+	"gpt-4-32k":                 {Known: true, Type: TypeChat, ContextWindow: 32768, MaxOutput: 32768, InputPrice: 60, OutputPrice: 120, Deprecation: "2025-06-06"},
+
+	"gpt-3.5-turbo":      {Known: true, Type: TypeChat, ContextWindow: 16385, MaxOutput: 4096, Capabilities: chatTools, InputPrice: 0.5, OutputPrice: 1.5},
+	"gpt-3.5-turbo-1106": {Known: true, Type: TypeChat, ContextWindow: 16385, MaxOutput: 4096, Capabilities: chatTools, InputPrice: 1, OutputPrice: 2},
+	"gpt-3.5-turbo-0613": {Known: true, Type: TypeChat, ContextWindow: 4096, MaxOutput: 4096, Capabilities: []string{CapabilityTools}, InputPrice: 1.5, OutputPrice: 2, Deprecation: "2024-09-13"},
+	"gpt-3.5-turbo-0301": {Known: true, Type: TypeChat, ContextWindow: 4096, MaxOutput: 4096, InputPrice: 1.5, OutputPrice: 2, Deprecation: "2024-06-13"},
+	"gpt-3.5-turbo-16k":  {Known: true, Type: TypeChat, ContextWindow: 16385, MaxOutput: 4096, Capabilities: []string{CapabilityTools}, InputPrice: 3, OutputPrice: 4, Deprecation: "2024-09-13"},
+
+	"gpt-3.5-turbo-instruct": {Known: true, Type: TypeCompletion, ContextWindow: 4096, MaxOutput: 4096, InputPrice: 1.5, OutputPrice: 2},
+	"babbage-002":            {Known: true, Type: TypeCompletion, ContextWindow: 16384, MaxOutput: 16384, InputPrice: 0.4, OutputPrice: 0.4},
+	"davinci-002":            {Known: true, Type: TypeCompletion, ContextWindow: 16384, MaxOutput: 16384, InputPrice: 2, OutputPrice: 2},
+
+	"text-embedding-3-small": {Known: true, Type: TypeEmbedding, ContextWindow: 8191, InputPrice: 0.02},
+	"text-embedding-3-large": {Known: true, Type: TypeEmbedding, ContextWindow: 8191, InputPrice: 0.13},
+	"text-embedding-ada-002": {Known: true, Type: TypeEmbedding, ContextWindow: 8191, InputPrice: 0.1},
+
+	"text-moderation-latest": {Known: true, Type: TypeModeration, ContextWindow: 32768},
+	"text-moderation-stable": {Known: true, Type: TypeModeration, ContextWindow: 32768},
+
+	"dall-e-2":  {Known: true, Type: TypeImage},
+	"dall-e-3":  {Known: true, Type: TypeImage},
+	"whisper-1": {Known: true, Type: TypeAudio},
+	"tts-1":     {Known: true, Type: TypeAudio},
+	"tts-1-hd":  {Known: true, Type: TypeAudio},
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Types of models
+const (
+	TypeChat       = "chat"
+	TypeEmbedding  = "embedding"
+	TypeImage      = "image"
+	TypeAudio      = "audio"
+	TypeModeration = "moderation"
+	TypeCompletion = "completion"
+)
+
+// Capabilities of chat models
+const (
+	CapabilityVision = "vision"
+	CapabilityTools  = "tools"
+	CapabilityJSON   = "json"
+)
+
+// Model is a model exposed by the API, with known metadata
+type Model struct {
+	ID      string    `json:"id"`
+	OwnedBy string    `json:"owned_by,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	// False if asoai has no metadata about the model; fields below are unset
+	Known bool   `json:"known"`
+	Type  string `json:"type,omitempty"`
+	// Maximum number of tokens of a request and of its reply
+	ContextWindow int `json:"context_window,omitempty"`
+	// Maximum number of tokens of a reply
+	MaxOutput    int      `json:"max_output,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Prices in USD for a million tokens
+	InputPrice  float64 `json:"input_price,omitempty"`
+	OutputPrice float64 `json:"output_price,omitempty"`
+	// Date the model is or was shut down, as YYYY-MM-DD
+	Deprecation string `json:"deprecation,omitempty"`
+}
+
+// Returns true if the model has the capability
+func (m Model) Has(capability string) bool {
+	return slices.Contains(m.Capabilities, capability)
+}
+
+// Returns true if the model is deprecated
+func (m Model) Deprecated() bool {
+	return m.Deprecation != ""
+}
+
+// Returns true if the model is deprecated and its shutdown date is not after
+// the day of now
+func (m Model) ShutDown(now time.Time) bool {
+	return m.Deprecated() && m.Deprecation <= now.Format(time.DateOnly)
+}
+
+// Returns the model, with metadata of the model or of its family: dated
+// versions such as gpt-4o-2024-08-06 are handled as gpt-4o unless they are
+// known
+func Lookup(id string) (Model, bool) {
+	if m, ok := catalog[id]; ok {
+		m.ID = id
+		return m, true
+	}
+
+	family := ""
+	for known := range catalog {
+		if strings.HasPrefix(id, known+"-") && len(known) > len(family) {
+			family = known
+		}
+	}
+
+	if family == "" {
+		return Model{ID: id}, false
+	}
+
+	m := catalog[family]
+	m.ID = id
+
+	return m, true
+}
+
+// Returns models listed by the API with their metadata, sorted by id
+func Merge(listed []openai.Model) []Model {
+	merged := []Model{}
+
+	for _, l := range listed {
+		m, _ := Lookup(l.ID)
+		m.OwnedBy = l.OwnedBy
+		if l.CreatedAt > 0 {
+			m.Created = time.Unix(l.CreatedAt, 0)
+		}
+		merged = append(merged, m)
+	}
+
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].ID < merged[j].ID
+	})
+
+	return merged
+}
+
+// Returns ids of models having built-in metadata, sorted
+func Known() []string {
+	ids := []string{}
+	for id := range catalog {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Returns the models matching filter, a type or a part of their id, and
+// having all capabilities
+func Filter(all []Model, filter string, capabilities []string) []Model {
+	filtered := []Model{}
+
+	for _, m := range all {
+		if filter != "" && m.Type != filter && !strings.Contains(m.ID, filter) {
+			continue
+		}
+
+		if !slices.ContainsFunc(capabilities, func(c string) bool { return !m.Has(c) }) {
+			filtered = append(filtered, m)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		id        string
+		known     bool
+		maxOutput int
+		price     float64
+	}{
+		{"gpt-4o", true, 16384, 2.5},
+		// Dated versions in the catalog are not handled as their family
+		{"gpt-4o-2024-05-13", true, 4096, 5},
+		{"gpt-4o-2024-08-06", true, 16384, 2.5},
+		// The longest family matches
+		{"gpt-4o-mini-2024-07-18", true, 16384, 0.15},
+		{"gpt-4-turbo-2024-04-09", true, 4096, 10},
+		{"gpt-4-0613", true, 8192, 30},
+		// Families only match up to a dash
+		{"gpt-4omni", false, 0, 0},
+		{"o1-preview", false, 0, 0},
+	}
+
+	for _, test := range tests {
+		m, ok := Lookup(test.id)
+		if ok != test.known || m.Known != test.known || m.ID != test.id || m.MaxOutput != test.maxOutput || m.InputPrice != test.price {
+			t.Errorf("Lookup(%q) = %+v, %v", test.id, m, ok)
+		}
+	}
+}
+
+func TestShutDown(t *testing.T) {
+	now := time.Date(2025, 6, 6, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		deprecation string
+		shutDown    bool
+	}{
+		{"", false},
+		{"2024-06-13", true},
+		{"2025-06-06", true},
+		{"2025-06-07", false},
+	}
+
+	for _, test := range tests {
+		m := Model{Deprecation: test.deprecation}
+		if m.ShutDown(now) != test.shutDown {
+			t.Errorf("model deprecated on %q: got %v, want %v", test.deprecation, !test.shutDown, test.shutDown)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	merged := Merge([]openai.Model{
+		{ID: "whisper-1", OwnedBy: "openai-internal", CreatedAt: 1677532384},
+		{ID: "gpt-4o-2024-08-06", OwnedBy: "system"},
+		{ID: "ft:gpt-4o-mini:org::id", OwnedBy: "org"},
+	})
+
+	want := []Model{
+		{ID: "ft:gpt-4o-mini:org::id", OwnedBy: "org"},
+		{ID: "gpt-4o-2024-08-06", OwnedBy: "system", Known: true, Type: TypeChat, ContextWindow: 128000, MaxOutput: 16384, Capabilities: chatAll, InputPrice: 2.5, OutputPrice: 10},
+		{ID: "whisper-1", OwnedBy: "openai-internal", Created: time.Unix(1677532384, 0), Known: true, Type: TypeAudio},
+	}
+
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("got %+v, want %+v", merged, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	all := []Model{}
+	for _, id := range []string{"gpt-3.5-turbo", "gpt-4", "gpt-4-vision-preview", "gpt-4o", "gpt-4o-mini", "text-embedding-3-small", "whisper-1"} {
+		m, _ := Lookup(id)
+		all = append(all, m)
+	}
+
+	tests := []struct {
+		filter       string
+		capabilities []string
+		want         []string
+	}{
+		{"", nil, []string{"gpt-3.5-turbo", "gpt-4", "gpt-4-vision-preview", "gpt-4o", "gpt-4o-mini", "text-embedding-3-small", "whisper-1"}},
+		{TypeEmbedding, nil, []string{"text-embedding-3-small"}},
+		{TypeAudio, nil, []string{"whisper-1"}},
+		{"4o", nil, []string{"gpt-4o", "gpt-4o-mini"}},
+		{"", []string{CapabilityVision}, []string{"gpt-4-vision-preview", "gpt-4o", "gpt-4o-mini"}},
+		{"", []string{CapabilityVision, CapabilityTools}, []string{"gpt-4o", "gpt-4o-mini"}},
+		{"gpt-4", []string{CapabilityTools}, []string{"gpt-4", "gpt-4o", "gpt-4o-mini"}},
+		{"dall-e", nil, []string{}},
+	}
+
+	for _, test := range tests {
+		ids := []string{}
+		for _, m := range Filter(all, test.filter, test.capabilities) {
+			ids = append(ids, m.ID)
+		}
+
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("Filter(%q, %v) = %v, want %v", test.filter, test.capabilities, ids, test.want)
+		}
+	}
+}
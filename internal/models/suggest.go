@@ -0,0 +1,65 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// Maximum number of suggestions
+const maxSuggestions = 3
+
+// Returns candidates close to name, the closest first
+func Suggest(name string, candidates []string) []string {
+	type scored struct {
+		candidate string
+		distance  int
+	}
+
+	maxDistance := max(2, len(name)/3)
+	found := []scored{}
+
+	for _, candidate := range candidates {
+		distance := levenshtein(strings.ToLower(name), strings.ToLower(candidate))
+		if distance <= maxDistance || (len(name) >= 3 && strings.HasPrefix(candidate, name)) {
+			found = append(found, scored{candidate, distance})
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].distance < found[j].distance
+	})
+
+	suggestions := []string{}
+	for _, s := range found[:min(len(found), maxSuggestions)] {
+		suggestions = append(suggestions, s.candidate)
+	}
+
+	return suggestions
+}
+
+// Returns the number of single character edits turning a into b
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	previous := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current := make([]int, len(rb)+1)
+		current[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous = current
+	}
+
+	return previous[len(rb)]
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"gpt-4", "gpt-4o", "gpt-4o-mini", "gpt-3.5-turbo", "text-embedding-3-small", "fast"}
+
+	tests := []struct {
+		name       string
+		candidates []string
+		want       []string
+	}{
+		// Ties keep the order of candidates
+		{"gpt-4p", candidates, []string{"gpt-4", "gpt-4o"}},
+		{"gpt-4p", []string{"gpt-4o", "gpt-4"}, []string{"gpt-4o", "gpt-4"}},
+		{"GPT-4O", candidates, []string{"gpt-4o", "gpt-4"}},
+		{"gpt-4o", candidates, []string{"gpt-4o", "gpt-4", "gpt-4o-mini"}},
+		// Candidates starting with the name are suggested after closer ones
+		{"gpt-3.5", candidates, []string{"gpt-3.5-turbo"}},
+		{"text-embedding", candidates, []string{"text-embedding-3-small"}},
+		// At most maxSuggestions, the closest first
+		{"gpt-4", []string{"gpt-4-32k", "gpt-3", "gpt-4o", "gpt-4"}, []string{"gpt-4", "gpt-3", "gpt-4o"}},
+		{"fsat", candidates, []string{"fast"}},
+		// No match
+		{"claude", candidates, []string{}},
+		{"gp", []string{"gpt-4o"}, []string{}},
+		{"gpt-4o", nil, []string{}},
+	}
+
+	for _, test := range tests {
+		got := Suggest(test.name, test.candidates)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Suggest(%q, %v) = %v, want %v", test.name, test.candidates, got, test.want)
+		}
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"gpt-4o", "gpt-4o", 0},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		// Runes are compared, not bytes
+		{"héllo", "hello", 1},
+	}
+
+	for _, test := range tests {
+		if d := levenshtein(test.a, test.b); d != test.distance {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", test.a, test.b, d, test.distance)
+		}
+	}
+}
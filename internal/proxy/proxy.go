@@ -0,0 +1,480 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+
+	"git.mkz.me/mycroft/asoai/internal/httpclient"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+// Header naming the session a request is recorded in
+const SessionHeader = "X-Asoai-Session"
+
+// Proxy forwards OpenAI API requests to the backend and records chat
+// completions as sessions
+type Proxy struct {
+	client *asoai.Client
+	// Base URL of the backend, e.g. https://api.openai.com/v1
+	baseURL string
+	// API key sent to the backend
+	apiKey string
+	// Client used to reach the backend
+	httpClient *http.Client
+	// Token expected from clients; no check if empty
+	token string
+	mux   *http.ServeMux
+}
+
+// Options configure a proxy
+type Options struct {
+	// Base URL of the backend; OpenAI's API is used if empty
+	BaseURL string
+	// API key sent to the backend
+	APIKey string
+	// Client used to reach the backend; http.DefaultClient is used if nil
+	HTTPClient *http.Client
+	// Token clients must send as API key; no check if empty
+	Token string
+}
+
+// Returns a proxy recording conversations with the client
+func New(client *asoai.Client, opts Options) *Proxy {
+	p := &Proxy{
+		client:     client,
+		baseURL:    strings.TrimSuffix(opts.BaseURL, "/"),
+		apiKey:     opts.APIKey,
+		httpClient: opts.HTTPClient,
+		token:      opts.Token,
+		mux:        http.NewServeMux(),
+	}
+
+	if p.baseURL == "" {
+		p.baseURL = openai.DefaultConfig("").BaseURL
+	}
+
+	if p.httpClient == nil {
+		p.httpClient = http.DefaultClient
+	}
+
+	p.mux.HandleFunc("POST /v1/chat/completions", p.chatCompletions)
+	p.mux.HandleFunc("GET /v1/models", p.forward)
+	p.mux.HandleFunc("GET /v1/models/{model}", p.forward)
+
+	return p
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.token != "" {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(p.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+	} else if !httpclient.LocalHost(r.Host) {
+		// Without a token, the proxy only listens locally: other names are
+		// those of sites reaching it from a browser through DNS rebinding,
+		// to use the API key
+		writeError(w, http.StatusMisdirectedRequest, fmt.Errorf("invalid host %s", r.Host))
+		return
+	}
+
+	p.mux.ServeHTTP(w, r)
+}
+
+// Forwards the request and copies the response back
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) {
+	resp, err := p.send(r, nil)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// chatRequest holds the fields of a chat completion request needed to record
+// it; the request is forwarded unchanged
+type chatRequest struct {
+	Model    string        `json:"model"`
+	Messages []chatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+}
+
+type chatMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+type chatStreamResponse struct {
+	Choices []struct {
+		Delta struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+func (p *Proxy) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	// Browsers only send other types from other sites without asking
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 32<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("could not read request: %w", err))
+		return
+	}
+
+	var req chatRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return
+	}
+
+	resp, err := p.send(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+
+	var reply asoai.Message
+
+	if req.Stream {
+		reply, err = passStream(w, resp.Body)
+	} else {
+		reply, err = passResponse(w, resp.Body)
+	}
+
+	if err != nil {
+		log.Printf("could not forward response: %v", err)
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 || reply.Role == "" {
+		return
+	}
+
+	messages := conversation(req.Messages, reply)
+
+	name := r.Header.Get(SessionHeader)
+	if name != "" {
+		err = p.record(name, req.Model, messages, true)
+	} else {
+		name, err = p.recordConversation(req.Model, messages)
+	}
+
+	if err != nil {
+		log.Printf("could not record session %s: %v", name, err)
+	}
+}
+
+// Sends the request to the backend with given body, or the request body if
+// nil
+func (p *Proxy) send(r *http.Request, body []byte) (*http.Response, error) {
+	if body == nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, fmt.Errorf("could not read request: %w", err)
+		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1")
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, p.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"Content-Type", "Accept", "OpenAI-Organization", "OpenAI-Project"} {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	return p.httpClient.Do(req)
+}
+
+// Copies the response and returns the reply it holds
+func passResponse(w io.Writer, body io.Reader) (asoai.Message, error) {
+	var buf bytes.Buffer
+
+	if _, err := io.Copy(w, io.TeeReader(body, &buf)); err != nil {
+		return asoai.Message{}, err
+	}
+
+	var resp chatResponse
+	if json.Unmarshal(buf.Bytes(), &resp) != nil || len(resp.Choices) == 0 {
+		return asoai.Message{}, nil
+	}
+
+	return asoai.Message{
+		Role:    resp.Choices[0].Message.Role,
+		Content: resp.Choices[0].Message.Content,
+	}, nil
+}
+
+// Copies server-sent events line by line as they arrive, and returns the
+// reply built from their deltas
+func passStream(w http.ResponseWriter, body io.Reader) (asoai.Message, error) {
+	flusher, _ := w.(http.Flusher)
+	reply := asoai.Message{}
+	reader := bufio.NewReader(body)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				return reply, err
+			}
+
+			// Events end with a blank line
+			if flusher != nil && len(bytes.TrimSpace(line)) == 0 {
+				flusher.Flush()
+			}
+
+			data, found := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+			data = bytes.TrimSpace(data)
+
+			var chunk chatStreamResponse
+			if found && !bytes.Equal(data, []byte("[DONE]")) && json.Unmarshal(data, &chunk) == nil && len(chunk.Choices) > 0 {
+				if chunk.Choices[0].Delta.Role != "" {
+					reply.Role = chunk.Choices[0].Delta.Role
+				}
+				reply.Content += chunk.Choices[0].Delta.Content
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return reply, nil
+		} else if err != nil {
+			return reply, err
+		}
+	}
+}
+
+// Returned when recording a conversation in a session holding another one
+var errOtherConversation = errors.New("session holds another conversation")
+
+// Returns the messages of the request followed by the reply
+func conversation(messages []chatMessage, reply asoai.Message) []asoai.Message {
+	conversation := []asoai.Message{}
+
+	for _, message := range messages {
+		conversation = append(conversation, asoai.Message{
+			Role:    message.Role,
+			Content: contentText(message.Content),
+		})
+	}
+
+	return append(conversation, reply)
+}
+
+// Records the conversation in a session named after its start. Clients send
+// the whole conversation on each request: it goes to the first session it
+// continues, so conversations starting alike don't replace each other, or
+// to a new one. Returns the name of the session.
+func (p *Proxy) recordConversation(model string, messages []asoai.Message) (string, error) {
+	id := conversationID(messages)
+
+	for n := 1; ; n++ {
+		name := id
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d", id, n)
+		}
+
+		err := p.record(name, model, messages, false)
+		if !errors.Is(err, errOtherConversation) {
+			return name, err
+		}
+	}
+}
+
+// Records the conversation in the session, created if missing. The session
+// is replaced by the conversation if it continues it. Otherwise, the last
+// turn of the conversation is appended if appendTurn is set, or
+// errOtherConversation is returned.
+func (p *Proxy) record(name, model string, messages []asoai.Message, appendTurn bool) error {
+	for {
+		err := p.client.UpdateSession(name, func(s *asoai.Session) error {
+			switch {
+			case continues(messages, s.Messages):
+				s.Messages = messages
+			case appendTurn:
+				s.Messages = append(s.Messages, lastTurn(messages)...)
+			default:
+				return errOtherConversation
+			}
+
+			s.Model = model
+			s.Updated = time.Now()
+
+			return nil
+		})
+		if !errors.Is(err, asoai.ErrSessionNotFound) {
+			return err
+		}
+
+		// Check the session again if it was created meanwhile
+		err = p.create(name, model, messages)
+		if !errors.Is(err, asoai.ErrSessionExists) {
+			return err
+		}
+	}
+}
+
+// Creates the session, failing with asoai.ErrSessionExists if it exists:
+// it's saved under a temporary name, then renamed
+func (p *Proxy) create(name, model string, messages []asoai.Message) error {
+	now := time.Now()
+	s := asoai.Session{Model: model, Messages: messages, Created: now, Updated: now}
+
+	tmpName := "proxy-tmp-" + uuid.New().String()
+	if err := p.client.SaveSession(tmpName, s); err != nil {
+		return err
+	}
+
+	err := p.client.RenameSession(tmpName, name)
+	if err != nil {
+		p.client.DeleteSession(tmpName)
+	}
+
+	return err
+}
+
+// Returns true if the conversation starts with the recorded messages
+func continues(messages, recorded []asoai.Message) bool {
+	if len(recorded) > len(messages) {
+		return false
+	}
+
+	for i, message := range recorded {
+		if message.Role != messages[i].Role || message.Content != messages[i].Content {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the last turn of the conversation: the messages following the
+// previous reply, and the reply
+func lastTurn(messages []asoai.Message) []asoai.Message {
+	for i := len(messages) - 2; i >= 0; i-- {
+		if messages[i].Role == openai.ChatMessageRoleAssistant {
+			return messages[i+1:]
+		}
+	}
+
+	return messages
+}
+
+// Returns an identifier derived from the start of the conversation, up to
+// the first user message, so following requests of a conversation are
+// recorded in the same session
+func conversationID(messages []asoai.Message) string {
+	hash := sha256.New()
+
+	for _, message := range messages {
+		fmt.Fprintf(hash, "%s\x00%s\x00", message.Role, message.Content)
+
+		if message.Role == openai.ChatMessageRoleUser {
+			break
+		}
+	}
+
+	return "proxy-" + hex.EncodeToString(hash.Sum(nil))[:12]
+}
+
+// Returns the text of a message content, which is either a string or a list
+// of parts
+func contentText(content json.RawMessage) string {
+	var text string
+	if json.Unmarshal(content, &text) == nil {
+		return text
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(content, &parts) != nil {
+		return string(content)
+	}
+
+	texts := []string{}
+	for _, part := range parts {
+		if part.Type == "text" {
+			texts = append(texts, part.Text)
+		}
+	}
+
+	return strings.Join(texts, "\n")
+}
+
+// Copies response headers, except the ones set by the server
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Connection", "Transfer-Encoding":
+			continue
+		}
+
+		dst[name] = values
+	}
+}
+
+// Writes an error as the OpenAI API does
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]string{
+			"message": err.Error(),
+			"type":    "proxy_error",
+		},
+	})
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+// Fake API answering "reply <n>" to the nth chat completion
+type testBackend struct {
+	mu       sync.Mutex
+	requests int
+	// Authorization headers received
+	authorizations []string
+}
+
+func (b *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	b.requests++
+	n := b.requests
+	b.authorizations = append(b.authorizations, r.Header.Get("Authorization"))
+	b.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if strings.Contains(string(body), `"stream":true`) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\",\"content\":\"reply \"}}]}\n\n")
+		fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":\"%d\"}}]}\n\n", n)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"choices":[{"message":{"role":"assistant","content":"reply %d"}}]}`, n)
+}
+
+// Returns a proxy to a fake API, recording sessions in a new database
+func newTestProxy(t *testing.T, token string) (*httptest.Server, *testBackend, *asoai.Client) {
+	t.Helper()
+
+	backend := &testBackend{}
+	api := httptest.NewServer(backend)
+	t.Cleanup(api.Close)
+
+	client, err := asoai.New(asoai.Options{DBPath: filepath.Join(t.TempDir(), "data.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server := httptest.NewServer(New(client, Options{
+		BaseURL: api.URL,
+		APIKey:  "sk-real",
+		Token:   token,
+	}))
+	t.Cleanup(server.Close)
+
+	return server, backend, client
+}
+
+// Sends a chat completion request with the messages, given as role and
+// content pairs, and returns the status and body of the response
+func chat(t *testing.T, server *httptest.Server, header http.Header, stream bool, messages ...string) (int, string) {
+	t.Helper()
+
+	encoded := []string{}
+	for i := 0; i < len(messages); i += 2 {
+		encoded = append(encoded, fmt.Sprintf(`{"role":%q,"content":%q}`, messages[i], messages[i+1]))
+	}
+	body := fmt.Sprintf(`{"model":"gpt-4o","stream":%t,"messages":[%s]}`, stream, strings.Join(encoded, ","))
+
+	req, err := http.NewRequest("POST", server.URL+"/v1/chat/completions", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(content)
+}
+
+// Checks the contents of the messages of the session
+func checkSession(t *testing.T, client *asoai.Client, name string, contents ...string) {
+	t.Helper()
+
+	s, err := client.Session(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, message := range s.Messages {
+		got = append(got, message.Content)
+	}
+
+	if strings.Join(got, "|") != strings.Join(contents, "|") {
+		t.Errorf("session %s: got messages %q, expected %q", name, got, contents)
+	}
+}
+
+func TestRecordConversations(t *testing.T) {
+	server, backend, client := newTestProxy(t, "")
+
+	chat(t, server, nil, false, "system", "be brief", "user", "hi")
+	chat(t, server, nil, true, "system", "be brief", "user", "hi", "assistant", "reply 1", "user", "more")
+
+	// Another conversation starting alike
+	chat(t, server, nil, false, "system", "be brief", "user", "hi")
+	chat(t, server, nil, false, "system", "be brief", "user", "hi", "assistant", "reply 3", "user", "other")
+
+	id := conversationID([]asoai.Message{{Role: "system", Content: "be brief"}, {Role: "user", Content: "hi"}})
+
+	checkSession(t, client, id, "be brief", "hi", "reply 1", "more", "reply 2")
+	checkSession(t, client, id+"-2", "be brief", "hi", "reply 3", "other", "reply 4")
+
+	if sessions, err := client.Sessions(); err != nil || len(sessions) != 2 {
+		t.Errorf("got sessions %v (%v)", sessions, err)
+	}
+
+	// The API key is sent to the backend, not the client's
+	for _, authorization := range backend.authorizations {
+		if authorization != "Bearer sk-real" {
+			t.Errorf("backend got authorization %q", authorization)
+		}
+	}
+}
+
+func TestRecordNamedSession(t *testing.T) {
+	server, _, client := newTestProxy(t, "")
+	header := http.Header{SessionHeader: {"named"}}
+
+	chat(t, server, header, false, "user", "hi")
+	chat(t, server, header, false, "user", "hi", "assistant", "reply 1", "user", "more")
+
+	// Another conversation is appended
+	chat(t, server, header, false, "user", "other")
+
+	checkSession(t, client, "named", "hi", "reply 1", "more", "reply 2", "other", "reply 3")
+}
+
+func TestRejectedRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header http.Header
+		status int
+	}{
+		{"local", "", nil, http.StatusOK},
+		{"localhost", "", http.Header{"Host": {"localhost:8081"}}, http.StatusOK},
+		{"rebinding", "", http.Header{"Host": {"attacker.example:8081"}}, http.StatusMisdirectedRequest},
+		{"form", "", http.Header{"Content-Type": {"text/plain"}}, http.StatusUnsupportedMediaType},
+		{"no token", "secret", nil, http.StatusUnauthorized},
+		{"token", "secret", http.Header{"Authorization": {"Bearer secret"}, "Host": {"proxy.example"}}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, backend, _ := newTestProxy(t, test.token)
+
+			status, body := chat(t, server, test.header, false, "user", "hi")
+			if status != test.status {
+				t.Errorf("got %d %q, expected %d", status, body, test.status)
+			}
+
+			if forwarded := backend.requests > 0; forwarded != (status == http.StatusOK) {
+				t.Errorf("request forwarded: %t", forwarded)
+			}
+		})
+	}
+}
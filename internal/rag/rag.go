@@ -0,0 +1,346 @@
+package rag
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+)
+
+const (
+	// Maximum number of bytes in a chunk
+	chunkSize = 1500
+	// Maximum number of lines repeated at the start of the next chunk, and
+	// their maximum size
+	chunkOverlap     = 5
+	chunkOverlapSize = chunkSize / 5
+	// Files larger than this are not indexed
+	maxFileSize = 1 << 20
+)
+
+// Extensions of files considered as text, markdown or source code
+var indexedExtensions = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".adoc": true, ".org": true,
+	".go": true, ".py": true, ".rb": true, ".rs": true, ".java": true, ".kt": true, ".scala": true,
+	".c": true, ".h": true, ".cc": true, ".cpp": true, ".hpp": true, ".cs": true, ".swift": true,
+	".js": true, ".jsx": true, ".ts": true, ".tsx": true, ".vue": true, ".php": true, ".lua": true,
+	".pl": true, ".sh": true, ".bash": true, ".zsh": true, ".fish": true, ".sql": true,
+	".html": true, ".css": true, ".scss": true, ".json": true, ".yaml": true, ".yml": true,
+	".toml": true, ".ini": true, ".xml": true, ".proto": true, ".tf": true, ".nix": true,
+}
+
+// Directories never walked while indexing
+var skippedDirs = map[string]bool{
+	"node_modules": true,
+	"vendor":       true,
+}
+
+// Index describes a set of indexed documents
+type Index struct {
+	Root    string    `json:"root"`
+	Model   string    `json:"model"`
+	Updated time.Time `json:"updated"`
+}
+
+// File is an indexed file, with the details used to detect changes
+type File struct {
+	Path    string    `json:"path"`
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"`
+	Model   string    `json:"model"`
+}
+
+// Chunk is a part of an indexed file, along with its embedding
+type Chunk struct {
+	Path      string              `json:"path"`
+	StartLine int                 `json:"start_line"`
+	EndLine   int                 `json:"end_line"`
+	Content   string              `json:"content"`
+	Embedding embedding.Embedding `json:"embedding"`
+}
+
+// Result is a chunk retrieved for a query
+type Result struct {
+	Chunk
+	Score float64
+}
+
+// Stats summarizes an index update
+type Stats struct {
+	Indexed   int
+	Unchanged int
+	Removed   int
+	Chunks    int
+}
+
+// Store keeps indexed files and chunks
+type Store interface {
+	GetIndexFiles(name string) (map[string]File, error)
+	// Saves file details; chunks replace existing ones for this file unless nil
+	SetIndexFile(name string, file File, chunks []Chunk) error
+	DeleteIndexFile(name, path string) error
+}
+
+// Returns a citation for the chunk, as path:start-end
+func (c Chunk) Source() string {
+	return fmt.Sprintf("%s:%d-%d", c.Path, c.StartLine, c.EndLine)
+}
+
+// Returns true if path looks like a file worth indexing
+func IsIndexable(path string) bool {
+	return indexedExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// Walks root and indexes new or modified files. Files are first compared by
+// modification time and size, then by content hash; only changed files are
+// chunked and sent to the embedding API. Files that disappeared are removed.
+func Update(ctx context.Context, store Store, client *openai.Client, name, root, model string) (Stats, error) {
+	var stats Stats
+
+	known, err := store.GetIndexFiles(name)
+	if err != nil {
+		return stats, err
+	}
+
+	seen := map[string]bool{}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if path != root && (strings.HasPrefix(d.Name(), ".") || skippedDirs[d.Name()]) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || !IsIndexable(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.Size() > maxFileSize {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		seen[relPath] = true
+
+		previous, exists := known[relPath]
+		if exists && previous.Model == model && previous.Size == info.Size() && previous.ModTime.Equal(info.ModTime()) {
+			stats.Unchanged++
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if strings.ContainsRune(string(content), 0) {
+			// binary content
+			return nil
+		}
+
+		file := File{
+			Path:    relPath,
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+			Hash:    embedding.Hash(string(content)),
+			Model:   model,
+		}
+
+		if exists && previous.Model == model && previous.Hash == file.Hash {
+			stats.Unchanged++
+			return store.SetIndexFile(name, file, nil)
+		}
+
+		chunks, err := embedChunks(ctx, client, model, relPath, string(content))
+		if err != nil {
+			return err
+		}
+
+		stats.Indexed++
+		stats.Chunks += len(chunks)
+
+		return store.SetIndexFile(name, file, chunks)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("could not index %s: %w", root, err)
+	}
+
+	for path := range known {
+		if !seen[path] {
+			if err := store.DeleteIndexFile(name, path); err != nil {
+				return stats, err
+			}
+			stats.Removed++
+		}
+	}
+
+	return stats, nil
+}
+
+// Splits content in chunks and computes their embeddings
+func embedChunks(ctx context.Context, client *openai.Client, model, path, content string) ([]Chunk, error) {
+	chunks := Split(path, content)
+	if len(chunks) == 0 {
+		return []Chunk{}, nil
+	}
+
+	inputs := []string{}
+	for _, chunk := range chunks {
+		// Path gives context to the embedded content
+		inputs = append(inputs, fmt.Sprintf("%s\n%s", chunk.Path, chunk.Content))
+	}
+
+	vectors, err := embedding.Create(ctx, client, model, inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range chunks {
+		chunks[i].Embedding = embedding.Embedding{
+			Model:  model,
+			Hash:   embedding.Hash(chunks[i].Content),
+			Vector: vectors[i],
+		}
+	}
+
+	return chunks, nil
+}
+
+// A line, or a part of a line longer than chunkSize
+type segment struct {
+	line int
+	text string
+}
+
+// Splits content in chunks of whole lines, up to chunkSize bytes; longer
+// lines are cut. The last lines of a chunk, up to chunkOverlapSize bytes,
+// are repeated at the start of the next one, so passages cut at a boundary
+// are still found.
+func Split(path, content string) []Chunk {
+	chunks := []Chunk{}
+
+	if strings.TrimSpace(content) == "" {
+		return chunks
+	}
+
+	segments := []segment{}
+	for i, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		for len(line) > chunkSize {
+			cut := chunkSize
+			for cut > 0 && !utf8.RuneStart(line[cut]) {
+				cut--
+			}
+			segments = append(segments, segment{i + 1, line[:cut]})
+			line = line[cut:]
+		}
+		segments = append(segments, segment{i + 1, line})
+	}
+
+	start := 0
+	for start < len(segments) {
+		end := start
+		size := 0
+
+		for end < len(segments) && (end == start || size+len(segments[end].text)+1 <= chunkSize) {
+			size += len(segments[end].text) + 1
+			end++
+		}
+
+		texts := []string{}
+		for i := start; i < end; i++ {
+			// Parts of a cut line are not separated by a new line
+			if i > start && segments[i].line == segments[i-1].line {
+				texts[len(texts)-1] += segments[i].text
+			} else {
+				texts = append(texts, segments[i].text)
+			}
+		}
+
+		chunks = append(chunks, Chunk{
+			Path:      path,
+			StartLine: segments[start].line,
+			EndLine:   segments[end-1].line,
+			Content:   strings.Join(texts, "\n"),
+		})
+
+		if end >= len(segments) {
+			break
+		}
+
+		// Overlapping segments are fewer than those of the chunk, so the
+		// next one always moves forward by most of this one
+		overlap := 0
+		overlapSize := 0
+		for overlap < chunkOverlap && overlap < end-start-1 {
+			overlapSize += len(segments[end-overlap-1].text) + 1
+			if overlapSize > chunkOverlapSize {
+				break
+			}
+			overlap++
+		}
+
+		start = end - overlap
+	}
+
+	return chunks
+}
+
+// Returns the k chunks most similar to given vector
+func Search(chunks []Chunk, vector []float32, k int) []Result {
+	results := []Result{}
+
+	for _, chunk := range chunks {
+		results = append(results, Result{
+			Chunk: chunk,
+			Score: embedding.CosineSimilarity(vector, chunk.Embedding.Vector),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+
+	return results
+}
+
+// Formats retrieved chunks as a message giving context to the model
+func FormatContext(results []Result) string {
+	var sb strings.Builder
+
+	sb.WriteString("Use the following excerpts from local documents to answer the next message if they are relevant. ")
+	sb.WriteString("When you use one, cite its source as given in brackets, e.g. [1] path/to/file:10-20.\n")
+
+	for i, result := range results {
+		fmt.Fprintf(&sb, "\n[%d] %s\n```\n%s\n```\n", i+1, result.Source(), result.Content)
+	}
+
+	return sb.String()
+}
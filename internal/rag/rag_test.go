@@ -0,0 +1,66 @@
+package rag
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		maxChunks int
+	}{
+		{"empty", "\n \n", 0},
+		{"short", "package main\n\nfunc main() {}\n", 1},
+		{"short lines", strings.Repeat("some line of code\n", 500), 10},
+		{"minified", strings.Repeat("var a=1;", maxFileSize/8), maxFileSize/chunkSize + 1},
+		{"long lines", strings.Repeat(strings.Repeat("x", 400)+"\n", 100), 40},
+		{"runes", strings.Repeat("語", 2000) + "\n" + strings.Repeat("é", 2000), 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := Split("file", test.content)
+
+			if len(chunks) > test.maxChunks || (test.maxChunks > 0 && len(chunks) == 0) {
+				t.Fatalf("got %d chunks, expected at most %d", len(chunks), test.maxChunks)
+			}
+
+			lines := strings.Split(test.content, "\n")
+			for i, chunk := range chunks {
+				if len(chunk.Content) > chunkSize {
+					t.Errorf("chunk %d is %d bytes long", i, len(chunk.Content))
+				}
+				if !utf8.ValidString(chunk.Content) {
+					t.Errorf("chunk %d is not valid UTF-8", i)
+				}
+				if i > 0 && chunk.StartLine < chunks[i-1].StartLine {
+					t.Errorf("chunk %d starts before the previous one", i)
+				}
+
+				// Content comes from the lines the chunk refers to
+				if source := strings.Join(lines[chunk.StartLine-1:chunk.EndLine], "\n"); !strings.Contains(source, chunk.Content) {
+					t.Errorf("chunk %d content is not in lines %d-%d", i, chunk.StartLine, chunk.EndLine)
+				}
+			}
+
+			// Every line is in a chunk
+			if len(chunks) > 0 && chunks[len(chunks)-1].EndLine != len(strings.Split(strings.TrimRight(test.content, "\n"), "\n")) {
+				t.Errorf("last chunk ends at line %d", chunks[len(chunks)-1].EndLine)
+			}
+		})
+	}
+}
+
+func TestSplitOverlap(t *testing.T) {
+	content := strings.Repeat("a short line\n", 200)
+	chunks := Split("file", content)
+
+	for i := 1; i < len(chunks); i++ {
+		if overlap := chunks[i-1].EndLine - chunks[i].StartLine + 1; overlap != chunkOverlap {
+			t.Errorf("chunks %d and %d overlap by %d lines", i-1, i, overlap)
+		}
+	}
+}
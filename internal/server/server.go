@@ -0,0 +1,381 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+
+	"git.mkz.me/mycroft/asoai/internal/httpclient"
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+// Server exposes the sessions of a client over HTTP
+type Server struct {
+	client *asoai.Client
+	// Token expected in the Authorization header; no check if empty
+	token string
+	// Returns an error if a resolved model is unknown; no check if nil
+	checkModel func(model string) error
+	mux        *http.ServeMux
+}
+
+// Returns a server handling requests with the client. Requests must carry
+// the token as a bearer token, unless it is empty. Models given in requests
+// are resolved, then checked with checkModel if not nil.
+func New(client *asoai.Client, token string, checkModel func(model string) error) *Server {
+	s := &Server{
+		client:     client,
+		token:      token,
+		checkModel: checkModel,
+		mux:        http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("GET /sessions", s.listSessions)
+	s.mux.HandleFunc("POST /sessions", s.createSession)
+	s.mux.HandleFunc("GET /sessions/{name}", s.getSession)
+	s.mux.HandleFunc("PATCH /sessions/{name}", s.configureSession)
+	s.mux.HandleFunc("DELETE /sessions/{name}", s.deleteSession)
+	s.mux.HandleFunc("POST /sessions/{name}/messages", s.sendMessage)
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.token != "" {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+	} else if !httpclient.LocalHost(r.Host) {
+		// Without a token, the server only listens locally: other names are
+		// those of sites reaching it from a browser through DNS rebinding
+		writeError(w, http.StatusMisdirectedRequest, fmt.Errorf("invalid host %s", r.Host))
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+type createRequest struct {
+	Name   string `json:"name"`
+	Model  string `json:"model"`
+	Prompt string `json:"system_prompt"`
+}
+
+type configureRequest struct {
+	Description *string `json:"description"`
+	Model       *string `json:"model"`
+	Prompt      *string `json:"system_prompt"`
+}
+
+type messageRequest struct {
+	Content   string `json:"content"`
+	Model     string `json:"model"`
+	MaxTokens int    `json:"max_tokens"`
+	// Streams the reply as server-sent events
+	Stream bool `json:"stream"`
+}
+
+type sessionResponse struct {
+	Name string `json:"name"`
+	asoai.Session
+}
+
+type replyResponse struct {
+	Role    string      `json:"role"`
+	Content string      `json:"content"`
+	Usage   asoai.Usage `json:"usage"`
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	names, err := s.client.Sessions()
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	if names == nil {
+		names = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, names)
+}
+
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	model, err := s.resolveModel(req.Model)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	name, created, err := s.client.CreateSession(req.Name, model, req.Prompt, false)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Location", "/sessions/"+name)
+	writeJSON(w, http.StatusCreated, sessionResponse{Name: name, Session: created})
+}
+
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	found, err := s.client.Session(name)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessionResponse{Name: name, Session: found})
+}
+
+func (s *Server) configureSession(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var req configureRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Model != nil {
+		model, err := s.resolveModel(*req.Model)
+		if err != nil {
+			writeError(w, errorStatus(err), err)
+			return
+		}
+		req.Model = &model
+	}
+
+	var updated asoai.Session
+
+	err := s.client.UpdateSession(name, func(session *asoai.Session) error {
+		if req.Description != nil {
+			session.Description = *req.Description
+		}
+
+		if req.Model != nil {
+			session.Model = *req.Model
+		}
+
+		if req.Prompt != nil {
+			if len(session.Messages) == 0 || session.Messages[0].Role != openai.ChatMessageRoleSystem {
+				return badRequest{fmt.Errorf("session %s has no system prompt", name)}
+			}
+			session.Messages[0].Content = *req.Prompt
+		}
+
+		updated = *session
+
+		return nil
+	})
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessionResponse{Name: name, Session: updated})
+}
+
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	// Deleting a missing session is not an error for the store
+	if _, err := s.client.Session(name); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	if err := s.client.DeleteSession(name); err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	var req messageRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Content == "" {
+		writeError(w, http.StatusBadRequest, errors.New("message content is empty"))
+		return
+	}
+
+	model, err := s.resolveModel(req.Model)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	opts := []asoai.SendOption{}
+	if model != "" {
+		opts = append(opts, asoai.WithModel(model))
+	}
+	if req.MaxTokens != 0 {
+		opts = append(opts, asoai.WithMaxTokens(req.MaxTokens))
+	}
+
+	if req.Stream || r.Header.Get("Accept") == "text/event-stream" {
+		s.streamMessage(w, r, name, req.Content, opts)
+		return
+	}
+
+	reply, err := s.client.Send(r.Context(), name, req.Content, opts...)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, replyResponse{Role: reply.Role, Content: reply.Content, Usage: reply.Usage})
+}
+
+// Sends the reply as server-sent events: a "message" event by chunk, then a
+// "done" event, or an "error" event if the stream failed
+func (s *Server) streamMessage(w http.ResponseWriter, r *http.Request, name, content string, opts []asoai.SendOption) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	chunks, err := s.client.SendStream(r.Context(), name, content, opts...)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	reply := ""
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			writeEvent(w, "error", map[string]string{"error": chunk.Err.Error()})
+			flusher.Flush()
+			// Drain the channel so the reply goroutine ends
+			for range chunks {
+			}
+			return
+		}
+
+		reply += chunk.Content
+		writeEvent(w, "message", map[string]string{"content": chunk.Content})
+		flusher.Flush()
+	}
+
+	writeEvent(w, "done", replyResponse{Role: openai.ChatMessageRoleAssistant, Content: reply})
+	flusher.Flush()
+}
+
+// Returns the model an alias stands for, refusing unknown models; an empty
+// model is kept as is
+func (s *Server) resolveModel(model string) (string, error) {
+	if model == "" {
+		return "", nil
+	}
+
+	model = s.client.ResolveModel(model)
+
+	if s.checkModel != nil {
+		if err := s.checkModel(model); err != nil {
+			return "", badRequest{err}
+		}
+	}
+
+	return model, nil
+}
+
+// badRequest is returned for requests which are refused, e.g. by session
+// updates
+type badRequest struct {
+	error
+}
+
+// Returns the HTTP status matching the error
+func errorStatus(err error) int {
+	var badReq badRequest
+	var apiErr *openai.APIError
+	var requestErr *openai.RequestError
+
+	switch {
+	case errors.As(err, &badReq):
+		return http.StatusBadRequest
+	case errors.Is(err, asoai.ErrSessionNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, asoai.ErrSessionExists):
+		return http.StatusConflict
+	case errors.As(err, &apiErr), errors.As(err, &requestErr), errors.Is(err, asoai.ErrMissingAPIKey):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Decodes the request body into v, writing an error if it is invalid. JSON
+// content must be declared: browsers only send other types from other sites
+// without asking.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return false
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusInternalServerError {
+		log.Printf("error: %v", err)
+	}
+
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeEvent(w http.ResponseWriter, event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("could not encode event: %v", err)
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mkz.me/mycroft/asoai/pkg/asoai"
+)
+
+// Returns a server using a new database and a fake API answering "hello"
+func newTestServer(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "text/event-stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, word := range []string{"hel", "lo"} {
+				fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", word)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}]}`)
+	}))
+	t.Cleanup(api.Close)
+
+	client, err := asoai.New(asoai.Options{
+		DBPath:       filepath.Join(t.TempDir(), "data.db"),
+		APIKey:       "sk-test",
+		BaseURL:      api.URL + "/v1",
+		HTTPClient:   api.Client(),
+		ModelAliases: map[string]string{"fast": "gpt-4o-mini"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	checkModel := func(model string) error {
+		if model != "gpt-4o" && model != "gpt-4o-mini" {
+			return fmt.Errorf("unknown model %s", model)
+		}
+		return nil
+	}
+
+	server := httptest.NewServer(New(client, token, checkModel))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// Sends a request with a JSON body, if not empty, and returns the status and
+// body of the response
+func do(t *testing.T, server *httptest.Server, method, path, body string, header http.Header) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(content)
+}
+
+func TestSessions(t *testing.T) {
+	server := newTestServer(t, "")
+
+	steps := []struct {
+		method, path, body string
+		status             int
+		// Expected in the response body
+		contains string
+	}{
+		{"GET", "/sessions", "", http.StatusOK, "[]"},
+		{"POST", "/sessions", `{"name":"s","model":"gpt-4o","system_prompt":"be brief"}`, http.StatusCreated, `"name":"s"`},
+		{"POST", "/sessions", `{"name":"s"}`, http.StatusConflict, "already exists"},
+		{"POST", "/sessions", `{"name":"t","unknown":1}`, http.StatusBadRequest, "unknown field"},
+		{"GET", "/sessions", "", http.StatusOK, `["s"]`},
+		{"PATCH", "/sessions/s", `{"description":"test"}`, http.StatusOK, `"description":"test"`},
+		{"PATCH", "/sessions/s", `{"model":"fast"}`, http.StatusOK, `"model":"gpt-4o-mini"`},
+		{"PATCH", "/sessions/s", `{"model":"gpt-4p"}`, http.StatusBadRequest, "unknown model gpt-4p"},
+		{"POST", "/sessions", `{"name":"t","model":"gpt-4p"}`, http.StatusBadRequest, "unknown model gpt-4p"},
+		{"POST", "/sessions/s/messages", `{"content":"hi","model":"gpt-4p"}`, http.StatusBadRequest, "unknown model gpt-4p"},
+		{"GET", "/sessions/s", "", http.StatusOK, `"model":"gpt-4o-mini"`},
+		{"POST", "/sessions/s/messages", `{"content":"hi"}`, http.StatusOK, `"content":"hello"`},
+		{"POST", "/sessions/s/messages", `{"content":"again","stream":true}`, http.StatusOK, "event: done\ndata: {\"role\":\"assistant\",\"content\":\"hello\""},
+		{"POST", "/sessions/s/messages", `{"content":""}`, http.StatusBadRequest, "empty"},
+		{"POST", "/sessions/missing/messages", `{"content":"hi"}`, http.StatusNotFound, "not found"},
+		{"DELETE", "/sessions/s", "", http.StatusNoContent, ""},
+		{"GET", "/sessions/s", "", http.StatusNotFound, "not found"},
+	}
+
+	for _, step := range steps {
+		status, body := do(t, server, step.method, step.path, step.body, nil)
+		if status != step.status || !strings.Contains(body, step.contains) {
+			t.Errorf("%s %s %s: got %d %q, expected %d with %q", step.method, step.path, step.body, status, body, step.status, step.contains)
+		}
+
+		// The conversation is saved before the session is deleted
+		if step.method == "POST" && strings.Contains(step.body, "again") {
+			_, body := do(t, server, "GET", "/sessions/s", "", nil)
+
+			var s asoai.Session
+			if err := json.Unmarshal([]byte(body), &s); err != nil {
+				t.Fatal(err)
+			}
+			if len(s.Messages) != 5 || s.Messages[0].Content != "be brief" || s.Messages[4].Content != "hello" {
+				t.Errorf("unexpected session %+v", s)
+			}
+		}
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header http.Header
+		status int
+	}{
+		{"local", "", nil, http.StatusCreated},
+		{"localhost", "", http.Header{"Host": {"localhost:8080"}}, http.StatusCreated},
+		{"ipv6", "", http.Header{"Host": {"[::1]:8080"}}, http.StatusCreated},
+		{"rebinding", "", http.Header{"Host": {"attacker.example:8080"}}, http.StatusMisdirectedRequest},
+		{"form", "", http.Header{"Content-Type": {"text/plain"}}, http.StatusUnsupportedMediaType},
+		{"no token", "secret", nil, http.StatusUnauthorized},
+		{"wrong token", "secret", http.Header{"Authorization": {"Bearer other"}}, http.StatusUnauthorized},
+		{"token", "secret", http.Header{"Authorization": {"Bearer secret"}, "Host": {"asoai.example"}}, http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t, test.token)
+
+			status, body := do(t, server, "POST", "/sessions", `{"name":"s"}`, test.header)
+			if status != test.status {
+				t.Errorf("got %d %q, expected %d", status, body, test.status)
+			}
+		})
+	}
+}
@@ -1,16 +1,59 @@
 package session
 
-import "github.com/sashabaranov/go-openai"
+import (
+	"slices"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Set on replies served from the response cache
+	Cached bool `json:"cached,omitempty"`
 }
 
 type Session struct {
 	Description string    `json:"description"`
 	Model       string    `json:"model"`
-	Messages    []Message `json:"message"`
+	Messages    []Message `json:"messages"`
+	Created     time.Time `json:"created"`
+	// Time of the last message
+	Updated time.Time `json:"updated"`
+	// Archived sessions are hidden from session list
+	Archived bool     `json:"archived,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// Info is the metadata of a session, listed without its messages
+type Info struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Model       string    `json:"model"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Archived    bool      `json:"archived,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	// Number of messages, and their size in bytes
+	Messages int `json:"messages"`
+	Size     int `json:"size"`
+}
+
+// Returns an estimate of the number of tokens of the messages, about four
+// bytes each
+func (i Info) Tokens() int {
+	return (i.Size + 3) / 4
+}
+
+// Returns true if the session has the tag
+func (s Session) HasTag(tag string) bool {
+	return slices.Contains(s.Tags, tag)
+}
+
+// Returns true if the session has the tag
+func (i Info) HasTag(tag string) bool {
+	return slices.Contains(i.Tags, tag)
 }
 
 func NewSession(model, prompt string) Session {
@@ -21,8 +64,12 @@ func NewSession(model, prompt string) Session {
 		prompt = "You are chatgpt, a large language model trained by OpenAI, based on the GPT-4 architecture."
 	}
 
+	now := time.Now()
+
 	return Session{
-		Model: model,
+		Model:   model,
+		Created: now,
+		Updated: now,
 		Messages: []Message{
 			{
 				Role:    openai.ChatMessageRoleSystem,
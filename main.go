@@ -13,7 +13,7 @@ func init() {
 
 func main() {
 	if err := commands.RootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(commands.ExitCode(err))
 	}
 }
@@ -0,0 +1,333 @@
+// Package asoai exposes asoai's session handling to other Go programs: it
+// opens the session database, loads or creates sessions and sends messages to
+// the API, saving conversations as the asoai command does.
+package asoai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/sashabaranov/go-openai"
+
+	"git.mkz.me/mycroft/asoai/internal/database"
+	"git.mkz.me/mycroft/asoai/internal/embedding"
+	"git.mkz.me/mycroft/asoai/internal/httpclient"
+	"git.mkz.me/mycroft/asoai/internal/models"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+// Session is a saved conversation
+type Session = session.Session
+
+// Message is a message of a conversation
+type Message = session.Message
+
+// SessionInfo is the metadata of a session
+type SessionInfo = session.Info
+
+// Model is a model exposed by the API, with metadata known by asoai
+type Model = models.Model
+
+// Options configure a Client
+type Options struct {
+	// Database file path; the default location in the XDG data directory is
+	// used if empty
+	DBPath string
+	// Returns the passphrase of an encrypted database; ASOAI_DB_PASSPHRASE
+	// or ASOAI_DB_KEY_FILE are used if nil
+	DBPassphrase func() (string, error)
+	// API key; OPENAI_API_KEY is used if empty
+	APIKey string
+	// Returns the API key when the API is first used, if APIKey is empty;
+	// OPENAI_API_KEY is used if it returns an empty key
+	APIKeyFunc func() (string, error)
+	// Base URL of the API; OpenAI's is used if empty
+	BaseURL string
+	// Client used for API calls; a client retrying calls failing on
+	// transient errors is used if nil
+	HTTPClient *http.Client
+	// Maximum number of replies kept in the response cache; 1000 if 0
+	CacheMaxEntries int
+	// Models by alias, resolved wherever a model is given
+	ModelAliases map[string]string
+}
+
+// Client handles sessions stored in the database and sends them to the API
+type Client struct {
+	db   database.Store
+	opts Options
+
+	// API client, created when first used
+	api     *openai.Client
+	apiErr  error
+	apiOnce sync.Once
+
+	// Indexes used for retrieval, loaded once
+	indexes     map[string]ragIndex
+	indexesLock sync.Mutex
+}
+
+type ragIndex struct {
+	rag.Index
+	chunks []rag.Chunk
+}
+
+// Opens the database and returns a client. The API key is only required
+// when the API is used.
+func New(opts Options) (*Client, error) {
+	secret := database.SecretFunc(opts.DBPassphrase)
+	if secret == nil {
+		secret = database.SecretFromEnv
+	}
+
+	db, err := database.OpenDatabase(opts.DBPath, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		db:      db,
+		opts:    opts,
+		indexes: map[string]ragIndex{},
+	}, nil
+}
+
+// Closes the database
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+// Returns the API client, or ErrMissingAPIKey if no API key was found
+func (c *Client) apiClient() (*openai.Client, error) {
+	c.apiOnce.Do(func() {
+		c.api, c.apiErr = newAPIClient(c.opts)
+	})
+
+	return c.api, c.apiErr
+}
+
+func newAPIClient(opts Options) (*openai.Client, error) {
+	apiKey := opts.APIKey
+
+	if apiKey == "" && opts.APIKeyFunc != nil {
+		var err error
+		if apiKey, err = opts.APIKeyFunc(); err != nil {
+			return nil, err
+		}
+	}
+
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAI_API_KEY")
+	}
+
+	if apiKey == "" {
+		return nil, ErrMissingAPIKey
+	}
+
+	config := openai.DefaultConfig(apiKey)
+	if opts.BaseURL != "" {
+		config.BaseURL = opts.BaseURL
+	}
+	if opts.HTTPClient != nil {
+		config.HTTPClient = opts.HTTPClient
+	} else {
+		config.HTTPClient = &http.Client{
+			Transport: &httpclient.Retry{Timeout: httpclient.DefaultTimeout},
+		}
+	}
+
+	return openai.NewClientWithConfig(config), nil
+}
+
+// Returns names of all sessions
+func (c *Client) Sessions() ([]string, error) {
+	return c.db.ListSessions()
+}
+
+// Returns metadata of all sessions, by name, without loading their messages
+func (c *Client) SessionInfos() ([]SessionInfo, error) {
+	return c.db.ListSessionInfo()
+}
+
+// Returns the session with given name
+func (c *Client) Session(name string) (Session, error) {
+	return c.db.GetSession(name)
+}
+
+// Saves a session under given name
+func (c *Client) SaveSession(name string, s Session) error {
+	return c.db.SetSession(name, s)
+}
+
+// Updates a session atomically, even if other processes use the database:
+// fn is given the latest saved session, which is saved unless fn returns an
+// error
+func (c *Client) UpdateSession(name string, fn func(s *Session) error) error {
+	return c.db.UpdateSession(name, fn)
+}
+
+// Deletes the session with given name; no session is current anymore if it
+// was
+func (c *Client) DeleteSession(name string) error {
+	current, err := c.db.GetCurrentSession()
+	if err != nil && !errors.Is(err, ErrNoCurrentSession) {
+		return err
+	}
+
+	if err := c.db.DeleteSession(name); err != nil {
+		return err
+	}
+
+	if current == name {
+		return c.db.SetCurrentSession("")
+	}
+
+	return nil
+}
+
+// Returns the name of the current session, or ErrNoCurrentSession if none is
+// set
+func (c *Client) CurrentSession() (string, error) {
+	return c.db.GetCurrentSession()
+}
+
+// Sets the current session
+func (c *Client) SetCurrentSession(name string) error {
+	return c.db.SetCurrentSession(name)
+}
+
+// Creates a session and returns its name; a random one is used if name is
+// empty, and ErrSessionExists is returned if it is used. The session becomes
+// the current one if setCurrent is set.
+func (c *Client) CreateSession(name, model, prompt string, setCurrent bool) (string, Session, error) {
+	if name == "" {
+		name = uuid.New().String()
+	}
+
+	created := session.NewSession(c.ResolveModel(model), prompt)
+
+	if err := c.db.CreateSession(name, created); err != nil {
+		return "", Session{}, err
+	}
+
+	if setCurrent {
+		if err := c.db.SetCurrentSession(name); err != nil {
+			return "", Session{}, err
+		}
+	}
+
+	return name, created, nil
+}
+
+// Renames a session atomically, keeping it current if it was; fails with
+// ErrSessionExists if newName is used
+func (c *Client) RenameSession(name, newName string) error {
+	if name == newName {
+		_, err := c.db.GetSession(name)
+		return err
+	}
+
+	return c.db.RenameSession(name, newName)
+}
+
+// Copies a session atomically under a new name, along with its embeddings;
+// fails with ErrSessionExists if newName is used. The copy is not archived.
+func (c *Client) CopySession(name, newName string) error {
+	return c.db.CopySession(name, newName)
+}
+
+// Archives or unarchives a session
+func (c *Client) SetArchived(name string, archived bool) error {
+	return c.db.UpdateSession(name, func(s *Session) error {
+		s.Archived = archived
+		return nil
+	})
+}
+
+// Returns identifiers of models exposed by the API, sorted
+func (c *Client) Models(ctx context.Context) ([]string, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	models, err := api.ListModels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list models: %w", err)
+	}
+
+	ids := []string{}
+	for _, model := range models.Models {
+		ids = append(ids, model.ID)
+	}
+
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// Returns the model an alias stands for, or the model itself if it is not an
+// alias
+func (c *Client) ResolveModel(model string) string {
+	if resolved, ok := c.opts.ModelAliases[model]; ok {
+		return resolved
+	}
+	return model
+}
+
+// Returns models exposed by the API with their metadata, sorted by id
+func (c *Client) ModelCatalog(ctx context.Context) ([]Model, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	listed, err := api.ListModels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list models: %w", err)
+	}
+
+	return models.Merge(listed.Models), nil
+}
+
+// Returns a model exposed by the API with its metadata
+func (c *Client) Model(ctx context.Context, id string) (Model, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return Model{}, err
+	}
+
+	found, err := api.GetModel(ctx, id)
+	if err != nil {
+		return Model{}, fmt.Errorf("could not get model %s: %w", id, err)
+	}
+
+	return models.Merge([]openai.Model{found})[0], nil
+}
+
+// Returns built-in metadata of a model, without using the API; false if the
+// model is unknown
+func LookupModel(id string) (Model, bool) {
+	return models.Lookup(id)
+}
+
+// Returns embeddings of inputs, in the same order
+func (c *Client) Embed(ctx context.Context, model string, inputs []string) ([][]float32, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if model == "" {
+		model = embedding.DefaultModel
+	}
+
+	return embedding.Create(ctx, api, model, inputs)
+}
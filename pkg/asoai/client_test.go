@@ -0,0 +1,32 @@
+package asoai
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCreateExistingSession(t *testing.T) {
+	client := newTestClient(t, 0)
+
+	name, _, err := client.CreateSession("s", "gpt-4o", "be brief", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Send(context.Background(), name, "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := client.CreateSession("s", "gpt-4o-mini", "", false); !errors.Is(err, ErrSessionExists) {
+		t.Errorf("got %v creating an existing session", err)
+	}
+
+	s, err := client.Session("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Model != "gpt-4o" || len(s.Messages) != 3 {
+		t.Errorf("session overwritten: %+v", s)
+	}
+}
@@ -0,0 +1,29 @@
+package asoai
+
+import (
+	"errors"
+
+	"git.mkz.me/mycroft/asoai/internal/database"
+)
+
+var (
+	// Returned when the API is used without an API key
+	ErrMissingAPIKey = errors.New("no API key found: set OPENAI_API_KEY or run asoai auth login")
+	// Returned when a session does not exist
+	ErrSessionNotFound = database.ErrSessionNotFound
+	// Returned when a session is renamed or copied to an existing name
+	ErrSessionExists = database.ErrSessionExists
+	// Returned when no session is set as current
+	ErrNoCurrentSession = database.ErrNoCurrentSession
+	// Returned when an index does not exist
+	ErrIndexNotFound = database.ErrIndexNotFound
+	// Returned when a batch job is not tracked in the database
+	ErrBatchNotFound = database.ErrBatchNotFound
+	// Returned when an encrypted database is opened without passphrase
+	ErrEncrypted = database.ErrEncrypted
+	// Returned when the passphrase of an encrypted database is wrong
+	ErrWrongPassphrase = database.ErrWrongPassphrase
+)
+
+// StorageError is returned when reading or writing the database fails
+type StorageError = database.Error
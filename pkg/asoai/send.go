@@ -0,0 +1,470 @@
+package asoai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+
+	"git.mkz.me/mycroft/asoai/internal/cache"
+	"git.mkz.me/mycroft/asoai/internal/rag"
+	"git.mkz.me/mycroft/asoai/internal/session"
+)
+
+// Reply is the assistant answer to a message
+type Reply struct {
+	Role    string
+	Content string
+	Usage   Usage
+	// Set if the reply was served from the response cache
+	Cached bool
+}
+
+// Usage is the number of tokens used by a request
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Chunk is a part of a streamed reply. Err is set on the last chunk if the
+// stream failed.
+type Chunk struct {
+	Content string
+	Err     error
+}
+
+// SendOption changes how a message is sent
+type SendOption func(*sendOptions)
+
+type sendOptions struct {
+	model        string
+	systemPrompt string
+	maxTokens    int
+	ragIndex     string
+	ragTopK      int
+	cacheTTL     time.Duration
+}
+
+// Uses given model instead of the session's one
+func WithModel(model string) SendOption {
+	return func(o *sendOptions) {
+		o.model = model
+	}
+}
+
+// Uses given system prompt instead of the session's one
+func WithSystemPrompt(prompt string) SendOption {
+	return func(o *sendOptions) {
+		o.systemPrompt = prompt
+	}
+}
+
+// Limits the number of tokens of the reply
+func WithMaxTokens(maxTokens int) SendOption {
+	return func(o *sendOptions) {
+		o.maxTokens = maxTokens
+	}
+}
+
+// Gives the topK excerpts of index most relevant to the message to the model.
+// Excerpts are not saved in the session.
+func WithRAG(index string, topK int) SendOption {
+	return func(o *sendOptions) {
+		o.ragIndex = index
+		o.ragTopK = topK
+	}
+}
+
+// Serves replies to requests sent before from the response cache, if they
+// are younger than ttl, and caches new replies for ttl. The cache is keyed
+// by the whole request, including the conversation.
+func WithCache(ttl time.Duration) SendOption {
+	return func(o *sendOptions) {
+		o.cacheTTL = ttl
+	}
+}
+
+// Sends input as a user message of the session and returns the reply. Both
+// are saved in the session; the message is removed if no reply is received.
+func (c *Client) Send(ctx context.Context, sessionName, input string, opts ...SendOption) (Reply, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return Reply{}, err
+	}
+
+	req, err := c.prepare(ctx, sessionName, input, opts)
+	if err != nil {
+		return Reply{}, err
+	}
+
+	reply, err := c.createCachedReply(ctx, api, req, newSendOptions(opts))
+	if err != nil {
+		return Reply{}, c.rollback(sessionName, input, err)
+	}
+
+	return reply, c.saveReply(sessionName, reply)
+}
+
+// Sends input as a user message of the session and streams the reply. The
+// channel is closed once the reply is complete and saved in the session. If
+// the stream fails, or ctx is done before the reply is read, the message is
+// removed from the session.
+func (c *Client) SendStream(ctx context.Context, sessionName, input string, opts ...SendOption) (<-chan Chunk, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.prepare(ctx, sessionName, input, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	options := newSendOptions(opts)
+
+	chunks := make(chan Chunk)
+
+	// Returns false if the caller gave up reading chunks
+	send := func(chunk Chunk) bool {
+		select {
+		case chunks <- chunk:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// Cached replies are replayed as a single chunk
+	if reply, found := c.cachedReply(req, options); found {
+		go func() {
+			defer close(chunks)
+
+			if !send(Chunk{Content: reply.Content}) {
+				c.rollback(sessionName, input, ctx.Err())
+				return
+			}
+
+			if err := c.saveReply(sessionName, reply); err != nil {
+				send(Chunk{Err: err})
+			}
+		}()
+
+		return chunks, nil
+	}
+
+	req.Stream = true
+
+	stream, err := api.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, c.rollback(sessionName, input, fmt.Errorf("ChatCompletionStream error: %w", err))
+	}
+
+	go func() {
+		defer close(chunks)
+		defer stream.Close()
+
+		reply := Reply{Role: openai.ChatMessageRoleAssistant}
+
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				err = fmt.Errorf("error while streaming response: %w", err)
+				send(Chunk{Err: c.rollback(sessionName, input, err)})
+				return
+			}
+
+			if len(resp.Choices) == 0 {
+				continue
+			}
+
+			delta := resp.Choices[0].Delta
+			if delta.Role != "" {
+				reply.Role = delta.Role
+			}
+
+			if delta.Content != "" {
+				reply.Content += delta.Content
+				if !send(Chunk{Content: delta.Content}) {
+					c.rollback(sessionName, input, ctx.Err())
+					return
+				}
+			}
+		}
+
+		c.cacheReply(req, options, reply)
+
+		if err := c.saveReply(sessionName, reply); err != nil {
+			send(Chunk{Err: err})
+		}
+	}()
+
+	return chunks, nil
+}
+
+// Sends a one-off conversation, which is not saved in any session
+func (c *Client) Complete(ctx context.Context, model string, messages []Message, opts ...SendOption) (Reply, error) {
+	api, err := c.apiClient()
+	if err != nil {
+		return Reply{}, err
+	}
+
+	options := newSendOptions(opts)
+	req := buildRequest(Session{Model: model, Messages: messages}, options)
+	req.Model = c.ResolveModel(req.Model)
+
+	return c.createCachedReply(ctx, api, req, options)
+}
+
+// Returns the cached reply to the request if caching is enabled, or sends
+// the request and caches its reply
+func (c *Client) createCachedReply(ctx context.Context, api *openai.Client, req openai.ChatCompletionRequest, options sendOptions) (Reply, error) {
+	if reply, found := c.cachedReply(req, options); found {
+		return reply, nil
+	}
+
+	reply, err := createReply(ctx, api, req)
+	if err != nil {
+		return reply, err
+	}
+
+	c.cacheReply(req, options, reply)
+
+	return reply, nil
+}
+
+// Returns the cached reply to the request, if caching is enabled. Cache
+// failures are treated as misses, as the request can still be sent.
+func (c *Client) cachedReply(req openai.ChatCompletionRequest, options sendOptions) (Reply, bool) {
+	if options.cacheTTL <= 0 {
+		return Reply{}, false
+	}
+
+	key, err := cache.Key(req)
+	if err != nil {
+		return Reply{}, false
+	}
+
+	entry, found, err := c.db.GetCacheEntry(key)
+	if err != nil || !found {
+		return Reply{}, false
+	}
+
+	return Reply{Role: entry.Role, Content: entry.Content, Cached: true}, true
+}
+
+// Caches the reply to the request, if caching is enabled. Failures are
+// ignored, as the reply was received anyway.
+func (c *Client) cacheReply(req openai.ChatCompletionRequest, options sendOptions, reply Reply) {
+	if options.cacheTTL <= 0 || reply.Content == "" {
+		return
+	}
+
+	key, err := cache.Key(req)
+	if err != nil {
+		return
+	}
+
+	maxEntries := c.opts.CacheMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = cache.DefaultMaxEntries
+	}
+
+	now := time.Now()
+
+	c.db.SetCacheEntry(key, cache.Entry{
+		Role:    reply.Role,
+		Content: reply.Content,
+		Created: now,
+		Expires: now.Add(options.cacheTTL),
+	}, maxEntries)
+}
+
+// Sends the request and returns the first choice of the response
+func createReply(ctx context.Context, api *openai.Client, req openai.ChatCompletionRequest) (Reply, error) {
+	resp, err := api.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return Reply{}, fmt.Errorf("ChatCompletion error: %w", err)
+	}
+
+	if len(resp.Choices) == 0 {
+		return Reply{}, fmt.Errorf("ChatCompletion error: empty response")
+	}
+
+	return Reply{
+		Role:    resp.Choices[0].Message.Role,
+		Content: resp.Choices[0].Message.Content,
+		Usage: Usage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		},
+	}, nil
+}
+
+func newSendOptions(opts []SendOption) sendOptions {
+	options := sendOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// Saves the user message in the session and returns the request to send
+func (c *Client) prepare(ctx context.Context, sessionName, input string, opts []SendOption) (openai.ChatCompletionRequest, error) {
+	options := newSendOptions(opts)
+
+	// Excerpts are retrieved first, as the session is locked while updated
+	excerpts := ""
+	if options.ragIndex != "" {
+		var err error
+		if excerpts, err = c.retrieve(ctx, options.ragIndex, options.ragTopK, input); err != nil {
+			return openai.ChatCompletionRequest{}, err
+		}
+	}
+
+	var req openai.ChatCompletionRequest
+
+	// Messages saved meanwhile by other processes are part of the request
+	err := c.db.UpdateSession(sessionName, func(s *session.Session) error {
+		req = buildRequest(*s, options)
+		req.Model = c.ResolveModel(req.Model)
+
+		s.Messages = append(s.Messages, session.Message{
+			Role:    openai.ChatMessageRoleUser,
+			Content: input,
+		})
+		s.Updated = time.Now()
+
+		return nil
+	})
+	if err != nil {
+		return req, err
+	}
+
+	if excerpts != "" {
+		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: excerpts,
+		})
+	}
+
+	req.Messages = append(req.Messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: input,
+	})
+
+	return req, nil
+}
+
+// Builds the request for the conversation of a session
+func buildRequest(s Session, options sendOptions) openai.ChatCompletionRequest {
+	messages := []openai.ChatCompletionMessage{}
+
+	for _, message := range s.Messages {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    message.Role,
+			Content: message.Content,
+		})
+	}
+
+	// overwrite system prompt, if needed
+	if options.systemPrompt != "" {
+		if len(messages) > 0 && messages[0].Role == openai.ChatMessageRoleSystem {
+			messages[0].Content = options.systemPrompt
+		} else {
+			messages = append([]openai.ChatCompletionMessage{{
+				Role:    openai.ChatMessageRoleSystem,
+				Content: options.systemPrompt,
+			}}, messages...)
+		}
+	}
+
+	model := s.Model
+	if options.model != "" {
+		model = options.model
+	}
+
+	req := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: messages,
+	}
+
+	if options.maxTokens != 0 {
+		req.MaxTokens = options.maxTokens
+	}
+
+	return req
+}
+
+// Appends the reply to the session
+func (c *Client) saveReply(sessionName string, reply Reply) error {
+	return c.db.UpdateSession(sessionName, func(s *session.Session) error {
+		s.Messages = append(s.Messages, session.Message{
+			Role:    reply.Role,
+			Content: reply.Content,
+			Cached:  reply.Cached,
+		})
+		s.Updated = time.Now()
+		return nil
+	})
+}
+
+// Removes the unanswered user message from the session after the request
+// failed with given error, which is returned along with any removal error
+func (c *Client) rollback(sessionName, input string, err error) error {
+	rollbackErr := c.db.UpdateSession(sessionName, func(s *session.Session) error {
+		// Another process may have answered or added messages meanwhile
+		last := len(s.Messages) - 1
+		if last >= 0 && s.Messages[last].Role == openai.ChatMessageRoleUser && s.Messages[last].Content == input {
+			s.Messages = s.Messages[:last]
+		}
+		return nil
+	})
+	if rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("could not remove unanswered message: %w", rollbackErr))
+	}
+
+	return err
+}
+
+// Returns the excerpts of index most relevant to input, formatted for the model
+func (c *Client) retrieve(ctx context.Context, name string, topK int, input string) (string, error) {
+	c.indexesLock.Lock()
+	index, ok := c.indexes[name]
+	c.indexesLock.Unlock()
+
+	if !ok {
+		var err error
+
+		index.Index, err = c.db.GetIndex(name)
+		if err != nil {
+			return "", fmt.Errorf("could not get %s index: %w", name, err)
+		}
+
+		index.chunks, err = c.db.GetIndexChunks(name)
+		if err != nil {
+			return "", fmt.Errorf("could not get %s index chunks: %w", name, err)
+		}
+
+		c.indexesLock.Lock()
+		c.indexes[name] = index
+		c.indexesLock.Unlock()
+	}
+
+	if len(index.chunks) == 0 {
+		return "", nil
+	}
+
+	vectors, err := c.Embed(ctx, index.Model, []string{input})
+	if err != nil {
+		return "", fmt.Errorf("could not retrieve excerpts: %w", err)
+	}
+
+	return rag.FormatContext(rag.Search(index.chunks, vectors[0], topK)), nil
+}
@@ -0,0 +1,202 @@
+package asoai
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns a client using a new database and a fake API, whose streams send
+// count chunks
+func newTestClient(t *testing.T, count int) *Client {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "text/event-stream" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"id":"1","object":"chat.completion","model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}]}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(w, "data: {\"id\":\"1\",\"object\":\"chat.completion.chunk\",\"model\":\"gpt-4o\",\"choices\":[{\"index\":0,\"delta\":{\"content\":\"word%d \"}}]}\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client, err := New(Options{
+		DBPath:     filepath.Join(t.TempDir(), "data.db"),
+		APIKey:     "sk-test",
+		BaseURL:    server.URL + "/v1",
+		HTTPClient: server.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// Waits until the session only holds its system prompt
+func waitRollback(t *testing.T, client *Client, name string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s, err := client.Session(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Messages) == 1 {
+			return
+		}
+	}
+
+	t.Fatal("unanswered message was not removed")
+}
+
+func TestSendStream(t *testing.T) {
+	client := newTestClient(t, 3)
+
+	name, _, err := client.CreateSession("stream", "gpt-4o", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := client.SendStream(context.Background(), name, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := ""
+	for chunk := range chunks {
+		if chunk.Err != nil {
+			t.Fatal(chunk.Err)
+		}
+		content += chunk.Content
+	}
+
+	if content != "word0 word1 word2 " {
+		t.Errorf("got content %q", content)
+	}
+
+	s, err := client.Session(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Messages) != 3 || s.Messages[2].Content != content {
+		t.Errorf("reply not saved: %+v", s.Messages)
+	}
+}
+
+func TestSendStreamCancel(t *testing.T) {
+	client := newTestClient(t, 1000)
+
+	name, _, err := client.CreateSession("stream", "gpt-4o", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks, err := client.SendStream(ctx, name, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller stops reading after the first chunk
+	<-chunks
+	cancel()
+
+	waitRollback(t, client, name)
+
+	select {
+	case <-chunks:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not closed")
+	}
+}
+
+func TestSendStreamCachedCancel(t *testing.T) {
+	client := newTestClient(t, 1)
+
+	for _, name := range []string{"first", "second"} {
+		if _, _, err := client.CreateSession(name, "gpt-4o", "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := client.Send(context.Background(), "first", "hi", WithCache(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	chunks, err := client.SendStream(ctx, "second", "hi", WithCache(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached reply is never read
+	cancel()
+
+	waitRollback(t, client, "second")
+
+	if _, ok := <-chunks; ok {
+		t.Fatal("stream was not closed")
+	}
+}
+
+func TestSendCached(t *testing.T) {
+	client := newTestClient(t, 3)
+
+	for _, name := range []string{"first", "second", "third"} {
+		if _, _, err := client.CreateSession(name, "gpt-4o", "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chunks, err := client.SendStream(context.Background(), "first", "hi", WithCache(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range chunks {
+	}
+
+	// Streamed replies serve requests which are not streamed, and the other
+	// way around: the API would answer "hello"
+	reply, err := client.Send(context.Background(), "second", "hi", WithCache(time.Hour))
+	if err != nil || !reply.Cached || reply.Content != "word0 word1 word2 " {
+		t.Fatalf("got %+v (%v)", reply, err)
+	}
+
+	chunks, err = client.SendStream(context.Background(), "third", "hi", WithCache(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached replies are replayed as a single chunk
+	replayed := []Chunk{}
+	for chunk := range chunks {
+		replayed = append(replayed, chunk)
+	}
+	if len(replayed) != 1 || replayed[0].Err != nil || replayed[0].Content != "word0 word1 word2 " {
+		t.Errorf("got chunks %+v", replayed)
+	}
+
+	s, err := client.Session("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Messages) != 3 || s.Messages[2].Content != "word0 word1 word2 " {
+		t.Errorf("replayed reply not saved: %+v", s.Messages)
+	}
+}